@@ -0,0 +1,122 @@
+package client
+
+import (
+	"hilldan/mqtt/packet"
+	"sync"
+	"time"
+)
+
+// AckTimeout decides what happens when a message received in manual
+// acknowledgement mode is not acknowledged in time.
+type AckTimeout uint8
+
+const (
+	// AckTimeoutAck acknowledges the message as if Ack was called.
+	AckTimeoutAck = AckTimeout(iota)
+	// AckTimeoutDisconnect closes the connection without acknowledging, so
+	// that the server redelivers the message after reconnecting.
+	AckTimeoutDisconnect
+)
+
+// AckListener is implemented by the event listener that wants to acknowledge
+// messages by itself in manual acknowledgement mode. OnMessage is called
+// instead of OnPublishReceived.
+type AckListener interface {
+	OnMessage(m Message)
+}
+
+// Ack acknowledges the message. In manual acknowledgement mode the PUBACK or
+// PUBREC of a QoS 1/2 message is only sent after Ack is called, and in the
+// order the messages were received: a message acknowledged early waits for
+// the ones received before it. Otherwise Ack does nothing.
+// It is safe to call Ack more than once.
+func (m Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// pendingAck is a received message waiting for acknowledgement.
+type pendingAck struct {
+	packetId packet.Integer
+	qos      packet.Bit2
+	acked    bool
+	timer    *time.Timer
+}
+
+// ackQueue keeps the unacknowledged messages in the received order.
+type ackQueue struct {
+	sync.Mutex
+	q []*pendingAck
+}
+
+// add appends a message to the queue and returns the function acknowledging
+// it, ok false if the message of the packet id is already waiting, as for a
+// duplicate redelivered.
+func (aq *ackQueue) add(c *mqttConn, p packet.PublishPacket) (ack func(), ok bool) {
+	aq.Lock()
+	defer aq.Unlock()
+	for _, v := range aq.q {
+		if v.packetId == p.PacketId {
+			return nil, false
+		}
+	}
+	pa := &pendingAck{
+		packetId: p.PacketId,
+		qos:      p.Qos,
+	}
+	if ackTimeout > 0 {
+		pa.timer = time.AfterFunc(ackTimeout, func() {
+			if ackTimeoutPolicy == AckTimeoutDisconnect {
+				c.closeConn("message acknowledgement timeout", true)
+				return
+			}
+			aq.ack(c, pa)
+		})
+	}
+	aq.q = append(aq.q, pa)
+	return func() { aq.ack(c, pa) }, true
+}
+
+// ack marks pa acknowledged and responds to every acknowledged message at the
+// head of the queue.
+func (aq *ackQueue) ack(c *mqttConn, pa *pendingAck) {
+	aq.Lock()
+	defer aq.Unlock()
+	if pa.acked {
+		return
+	}
+	pa.acked = true
+	if pa.timer != nil {
+		pa.timer.Stop()
+	}
+	n := 0
+	for ; n < len(aq.q) && aq.q[n].acked; n++ {
+		c.respondPublish(aq.q[n].packetId, aq.q[n].qos)
+	}
+	aq.q = aq.q[n:]
+}
+
+// pending reports whether the message is still waiting for acknowledgement.
+func (aq *ackQueue) pending(packetId packet.Integer) bool {
+	aq.Lock()
+	defer aq.Unlock()
+	for _, v := range aq.q {
+		if v.packetId == packetId {
+			return true
+		}
+	}
+	return false
+}
+
+// stop stops the timers of the messages not acknowledged.
+func (aq *ackQueue) stop() {
+	aq.Lock()
+	for _, v := range aq.q {
+		if v.timer != nil {
+			v.timer.Stop()
+		}
+	}
+	aq.q = nil
+	aq.Unlock()
+}
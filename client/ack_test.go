@@ -0,0 +1,85 @@
+package client
+
+import (
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"testing"
+	"time"
+)
+
+func TestAckInOrder(t *testing.T) {
+	c := &mqttConn{
+		writech: make(chan packet.ControlPacketer, 10),
+		exitch:  make(chan struct{}),
+	}
+	acks := make([]func(), 3)
+	for i := range acks {
+		acks[i], _ = c.acks.add(c, packet.PublishPacket{
+			Qos:      packet.Bit2(i%2 + 1),
+			PacketId: packet.Integer(i + 1),
+		})
+	}
+
+	acks[1]()
+	acks[1]()
+	if len(c.writech) != 0 {
+		t.Fatalf("acknowledged before the earlier message, got %d packets", len(c.writech))
+	}
+	acks[0]()
+	if len(c.writech) != 2 {
+		t.Fatalf("want 2 packets actual %d", len(c.writech))
+	}
+	if p := <-c.writech; p.ControlType() != packet.TypePUBACK {
+		t.Errorf("want PUBACK actual %v", p.ControlType())
+	}
+	if p := <-c.writech; p.ControlType() != packet.TypePUBREC {
+		t.Errorf("want PUBREC actual %v", p.ControlType())
+	}
+	if !c.acks.pending(3) {
+		t.Errorf("packet 3 should be pending")
+	}
+	acks[2]()
+	if c.acks.pending(3) || len(c.writech) != 1 {
+		t.Errorf("packet 3 should be acknowledged")
+	}
+}
+
+func TestManualAckHanded(t *testing.T) {
+	c := &mqttConn{
+		listener: mqtt.DefaultListener{},
+		writech:  make(chan packet.ControlPacketer, 10),
+		exitch:   make(chan struct{}),
+	}
+	SetManualAck(true, time.Minute, AckTimeoutAck)
+	defer SetManualAck(false, 0, AckTimeoutAck)
+
+	//handed to nobody
+	c.receiveManual(packet.PublishPacket{Qos: packet.QoS1, PacketId: 1, TopicName: "a"})
+	if len(c.writech) != 1 || c.acks.pending(1) {
+		t.Fatalf("not acknowledged on receipt")
+	}
+	<-c.writech
+
+	s := &chanSub{filter: "a", ch: make(chan Message, 2), done: make(chan struct{})}
+	c.chans.Add(s)
+	defer c.chans.Remove(s)
+	p := packet.PublishPacket{Qos: packet.QoS1, PacketId: 2, TopicName: "a"}
+	c.receiveManual(p)
+	p.Dup = true
+	c.receiveManual(p)
+	if len(c.writech) != 0 || len(s.ch) != 1 {
+		t.Fatalf("%d acknowledged %d delivered", len(c.writech), len(s.ch))
+	}
+	m := <-s.ch
+	m.Ack()
+	if len(c.writech) != 1 || c.acks.pending(2) {
+		t.Errorf("not acknowledged once")
+	}
+}
+
+func TestManualAckTimeout(t *testing.T) {
+	SetManualAck(true, 0, AckTimeoutAck)
+	if manualAck {
+		t.Errorf("manual acknowledgement without timeout")
+	}
+}
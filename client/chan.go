@@ -0,0 +1,142 @@
+package client
+
+import (
+	"hilldan/mqtt/packet"
+	"sync"
+	"sync/atomic"
+)
+
+// Message is an application message received from server, delivered to a
+// channel subscriber or an AckListener.
+type Message struct {
+	packet.PublishPacket
+	ack func()
+}
+
+// Overflow decides what happens when a channel subscriber does not keep up
+// with the incoming messages and its buffer is full.
+type Overflow uint8
+
+const (
+	// OverflowBlock blocks the goroutine reading packets from the server until
+	// the consumer receives the message. Nothing is lost, but every other
+	// inbound packet waits too.
+	OverflowBlock = Overflow(iota)
+	// OverflowDrop discards the message for that subscriber only.
+	OverflowDrop
+	// OverflowDisconnect closes the connection. The message was acknowledged
+	// already, and is lost, unless the manual acknowledgement mode is on: the
+	// QoS 1 messages not acknowledged are redelivered by the server after
+	// reconnecting, see SetManualAck.
+	OverflowDisconnect
+)
+
+func (o Overflow) String() string {
+	switch o {
+	case OverflowBlock:
+		return "block"
+	case OverflowDrop:
+		return "drop"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "invalid overflow policy"
+}
+
+// chanSub is a subscription delivered through a channel.
+type chanSub struct {
+	filter     string
+	overflow   Overflow
+	ch         chan Message
+	done       chan struct{}
+	packetId   packet.Integer //of the SUBSCRIBE
+	subscribed chan struct{}  //closed once SUBACK received
+	refused    bool           //by the SUBACK, set before subscribed closed
+
+	sync.Mutex
+	closed bool
+}
+
+// send delivers m according to the overflow policy, and reports whether m was
+// sent. ok is false when the subscriber is too slow and the connection ought
+// to be closed.
+func (s *chanSub) send(m Message) (sent, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return false, true
+	}
+	switch s.overflow {
+	case OverflowDrop, OverflowDisconnect:
+		select {
+		case s.ch <- m:
+		default:
+			return false, s.overflow == OverflowDrop
+		}
+	default:
+		select {
+		case s.ch <- m:
+		case <-s.done:
+			return false, true
+		}
+	}
+	return true, true
+}
+
+func (s *chanSub) close() {
+	close(s.done) //release a blocked sender first
+	s.Lock()
+	s.closed = true
+	close(s.ch)
+	s.Unlock()
+}
+
+// SubscribeChan subscribes filter and returns a channel receiving the matched
+// messages, buffered by bufSize. A full buffer is handled by policy.
+// Calling cancel sends UNSUBSCRIBE to server and closes the channel.
+func (c *mqttConn) SubscribeChan(filter string, qos packet.Bit2, bufSize int, policy Overflow) (ch <-chan Message, cancel func()) {
+	s, cancel := c.subscribeChan(filter, qos, bufSize, policy)
+	return s.ch, cancel
+}
+
+func (c *mqttConn) subscribeChan(filter string, qos packet.Bit2, bufSize int, policy Overflow) (s *chanSub, cancel func()) {
+	if bufSize < 0 {
+		bufSize = 0
+	}
+	s = &chanSub{
+		filter:     filter,
+		overflow:   policy,
+		ch:         make(chan Message, bufSize),
+		done:       make(chan struct{}),
+		packetId:   packet.Integer(atomic.AddUint32(&PacketId, 1)),
+		subscribed: make(chan struct{}),
+	}
+	c.chans.Add(s)
+	c.subscribe(s.packetId, []packet.TopicFilter{{Topic: packet.String(filter), Qos: qos}})
+
+	var once sync.Once
+	cancel = func() {
+		once.Do(func() {
+			if c.chans.Remove(s) {
+				c.Unsubscribe([]packet.String{packet.String(filter)})
+			}
+			s.close()
+		})
+	}
+	return
+}
+
+// dispatch delivers m to every channel subscriber whose filter matches. It
+// reports whether m was handed to any of them.
+func (c *mqttConn) dispatch(m Message) (handed bool) {
+	subs := c.chans.Match(string(m.TopicName))
+	for _, s := range subs {
+		sent, ok := s.send(m)
+		if !ok {
+			c.closeConn("channel subscriber too slow: "+s.filter, true)
+			return
+		}
+		handed = handed || sent
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+func chanConn() *mqttConn {
+	cnn, _ := net.Pipe()
+	return &mqttConn{
+		key:       KeySession,
+		persister: mqtt.NewMemPersist(),
+		listener:  mqtt.DefaultListener{},
+		cnn:       cnn,
+		writech:   make(chan packet.ControlPacketer, 10),
+		exitch:    make(chan struct{}),
+		pingch:    make(chan struct{}),
+		session:   mqtt.NewSession(),
+		window:    newWindow(0, false),
+	}
+}
+
+func message(topic string) Message {
+	return Message{PublishPacket: packet.PublishPacket{TopicName: packet.String(topic)}}
+}
+
+func TestSubscribeChan(t *testing.T) {
+	c := chanConn()
+	ch, cancel := c.SubscribeChan("a/+", packet.QoS1, 1, OverflowDrop)
+	ch2, cancel2 := c.SubscribeChan("a/+", packet.QoS1, 1, OverflowDrop)
+	if p := <-c.writech; p.ControlType() != packet.TypeSUBSCRIBE {
+		t.Fatalf("want SUBSCRIBE actual %v", p.ControlType())
+	}
+	<-c.writech
+
+	if !c.dispatch(message("a/1")) || len(ch) != 1 || len(ch2) != 1 {
+		t.Fatalf("not dispatched")
+	}
+	if c.dispatch(message("b")) {
+		t.Errorf("dispatched not matched")
+	}
+	//dropped, the connection kept
+	if c.dispatch(message("a/2")) || c.IsDead() {
+		t.Errorf("not dropped")
+	}
+
+	//unsubscribed by the last one
+	cancel2()
+	if len(c.writech) != 0 {
+		t.Errorf("unsubscribed while subscribed by another")
+	}
+	cancel()
+	cancel()
+	if p := <-c.writech; p.ControlType() != packet.TypeUNSUBSCRIBE || len(c.writech) != 0 {
+		t.Errorf("want one UNSUBSCRIBE actual %v", p.ControlType())
+	}
+	if m := <-ch; m.TopicName != "a/1" {
+		t.Errorf("received %s", m.TopicName)
+	}
+	if _, ok := <-ch; ok {
+		t.Errorf("channel not closed")
+	}
+	if c.dispatch(message("a/1")) {
+		t.Errorf("dispatched once cancelled")
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	c := chanConn()
+	ch, cancel := c.SubscribeChan("a", packet.QoS0, 0, OverflowBlock)
+	handed := make(chan bool)
+	go func() { handed <- c.dispatch(message("a")) }()
+	select {
+	case <-handed:
+		t.Fatalf("not blocked")
+	case <-time.After(20 * time.Millisecond):
+	}
+	<-ch
+	if !<-handed {
+		t.Errorf("not handed")
+	}
+
+	//released by cancelling
+	go func() { handed <- c.dispatch(message("a")) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if <-handed {
+		t.Errorf("handed once cancelled")
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	c := chanConn()
+	_, cancel := c.SubscribeChan("a", packet.QoS0, 1, OverflowDisconnect)
+	defer cancel()
+	c.dispatch(message("a"))
+	if c.IsDead() {
+		t.Fatalf("closed within the buffer")
+	}
+	c.dispatch(message("a"))
+	if !c.IsDead() {
+		t.Errorf("not closed")
+	}
+}
@@ -1,11 +1,9 @@
 package client
 
 import (
-	"encoding/json"
 	"hilldan/mqtt"
 	"hilldan/mqtt/packet"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -18,21 +16,45 @@ import (
 // It provides the means to send an ordered, lossless, stream of bytes in both directions.
 type mqttConn struct {
 	//comunication between server and client
-	cnn     net.Conn
-	readch  chan mqtt.PacketReaded
-	writech chan packet.ControlPacketer
-	exitch  chan struct{}
+	clientId  string //ClientId is reassigned by the next RunMQTT
+	key       string //of the session persisted
+	persister mqtt.Persister
+	listener  mqtt.EventListener
+	manualAck bool
+	cnn       net.Conn
+	readch    chan mqtt.PacketReaded
+	writech   chan packet.ControlPacketer
+	exitch    chan struct{}
 
 	//session management
 	session *mqtt.Session
+	acks    ackQueue      //messages waiting for manual acknowledgement
+	window  *window       //QoS 1/2 messages in flight
+	replies replyRegistry //requests waiting for response
+	chans   chanRegistry  //subscriptions delivered through channels
 
 	//keepalive
 	deadline time.Duration
 	pingch   chan struct{}
 
 	//close status
-	dead  bool
-	deadl sync.Mutex
+	dead     bool
+	deadl    sync.Mutex
+	routines sync.WaitGroup //started by connect, see spawn
+}
+
+// spawn runs f in a goroutine, waited by wait.
+func (c *mqttConn) spawn(f func()) {
+	c.routines.Add(1)
+	go func() {
+		defer c.routines.Done()
+		f()
+	}()
+}
+
+// wait waits for the goroutines spawned to exit, once closed.
+func (c *mqttConn) wait() {
+	c.routines.Wait()
 }
 
 func (c *mqttConn) read() {
@@ -53,7 +75,7 @@ func (c *mqttConn) read() {
 	}
 exit:
 	close(c.readch)
-	log.Printf("read no leak")
+	logger.Debug("read exit", c.fields()...)
 }
 
 func (c *mqttConn) write() {
@@ -67,10 +89,22 @@ func (c *mqttConn) write() {
 				c.cnn.Close()
 				goto exit
 			}
+			if mqtt.DebugEnabled(logger) {
+				logger.Debug("packet sent", c.fields(mqtt.PacketFields(p)...)...)
+			}
 		}
 	}
 exit:
-	log.Printf("write no leak")
+	logger.Debug("write exit", c.fields()...)
+}
+
+// fields returns the fields logged of the connection, followed by args.
+func (c *mqttConn) fields(args ...any) []any {
+	fields := []any{"client_id", c.clientId}
+	if addr := c.cnn.RemoteAddr(); addr != nil {
+		fields = append(fields, "remote_addr", addr.String())
+	}
+	return append(fields, args...)
 }
 
 func (c *mqttConn) Close(cause string) {
@@ -78,19 +112,21 @@ func (c *mqttConn) Close(cause string) {
 }
 
 func (c *mqttConn) closeConn(cause string, session bool) {
-	log.Println("mqtt conn closed:", cause)
 	c.deadl.Lock()
 	defer c.deadl.Unlock()
 	if c.dead {
 		return
 	}
-	go listener.OnDisconnected()
+	logger.Info("connection closed", c.fields("cause", cause)...)
+	go c.listener.OnDisconnected()
 	c.dead = true
 	c.cnn.Close()
 	close(c.exitch)
 	close(c.pingch)
+	c.acks.stop()
+	c.window.close()
 	if session {
-		c.session.Save(KeySession, ClientId, persister)
+		c.session.Save(c.key, c.clientId, c.persister)
 	}
 }
 
@@ -127,31 +163,26 @@ func (c *mqttConn) initConn(clearSession bool) error {
 		if c.initSession() {
 			c.publishOld(clearSession)
 		}
-		go c.keepalive()
+		c.spawn(c.keepalive)
+		logger.Info("connected", c.fields("session_present", p.AckFlags&0x01 == 1)...)
 	}
 	return nil
 }
 func (c *mqttConn) initSession() bool {
-	data, err := persister.Read(KeySession, ClientId)
+	s, err := mqtt.LoadSession(c.key, c.clientId, c.persister)
 	if err != nil {
-		log.Printf("get session by '%s' fail: %v", ClientId, err)
+		logger.Error("load session fail", c.fields("err", err)...)
 	}
-
-	if len(data) == 0 {
-		c.session = mqtt.NewSession()
-		return false
+	if s != nil {
+		c.session = s
+		return true
 	}
 
-	s := new(mqtt.Session)
-	err = json.Unmarshal(data, s)
-	if err != nil {
-		log.Printf("'%s' session data invalid", string(data))
-		c.session = mqtt.NewSession()
-		return false
+	c.session = mqtt.NewSession()
+	if err = c.session.Bind(c.key, c.clientId, c.persister); err != nil {
+		logger.Error("persist session fail", c.fields("err", err)...)
 	}
-	s.MustInit()
-	c.session = s
-	return true
+	return false
 }
 
 func (c *mqttConn) keepalive() {
@@ -177,31 +208,55 @@ func (c *mqttConn) keepalive() {
 	}
 	tm1.Stop()
 	tm2.Stop()
-	log.Printf("keepalive no leak")
+	logger.Debug("keepalive exit", c.fields()...)
 }
 
 // Publish send packet from client to server.
-func (c *mqttConn) Publish(p packet.PublishPacket) {
+// A QoS 1/2 packet takes a slot of the in-flight window, see SetMaxInflight.
+// Once accepted, a QoS 1/2 packet is kept in the session till acknowledged,
+// and resent on reconnecting. ErrClosed means it was not accepted, and is
+// not resent.
+func (c *mqttConn) Publish(p packet.PublishPacket) error {
 	if c.IsDead() {
-		return
+		return mqtt.ErrClosed
+	}
+	if p.Qos != packet.QoS0 {
+		if err := c.window.acquire(); err != nil {
+			return err
+		}
 	}
 	p.PacketId = packet.Integer(atomic.AddUint32(&PacketId, 1))
+	if p.Qos != packet.QoS0 {
+		//saved before sending, in case the acknowledgement comes first
+		p.Dup = true
+		c.session.AddPubOut(p.PacketId, p)
+	}
 	p.Dup = false
-	c.writech <- &p
-	if p.Qos == packet.QoS0 {
-		return
+	select {
+	case c.writech <- &p:
+	case <-c.exitch:
+		if p.Qos != packet.QoS0 {
+			c.acknowledged(p.PacketId)
+		}
+		return mqtt.ErrClosed
 	}
+	return nil
+}
 
-	p.Dup = true
-	c.session.AddPubOut(p.PacketId, p)
+// acknowledged removes the packet acknowledged by server from session, and
+// frees its slot of the in-flight window.
+func (c *mqttConn) acknowledged(packetId packet.Integer) {
+	if c.session.RemovePubOut(packetId) {
+		c.window.release()
+	}
 }
 
 // publishOld extract unacknowledged packets from session and resend them to the peer.
 func (c *mqttConn) publishOld(clearSession bool) {
 	old := c.session.ResetPubOut()
 	if clearSession {
-		persister.Delete(KeySession, ClientId)
 		c.session = mqtt.NewSession()
+		c.session.Bind(c.key, c.clientId, c.persister)
 	}
 	max := packet.Integer(0)
 	for _, v := range old {
@@ -210,6 +265,7 @@ func (c *mqttConn) publishOld(clearSession bool) {
 		}
 		c.writech <- &v
 		c.session.AddPubOut(v.PacketId, v)
+		c.window.force()
 	}
 	atomic.AddUint32(&PacketId, uint32(max)+1) //keep unique
 }
@@ -234,26 +290,81 @@ func (c *mqttConn) publishOld(clearSession bool) {
 // Subscribe send topic filters to server. When a suback received from server,
 // the subject subscribed successfully will be saved at session.
 func (c *mqttConn) Subscribe(filters []packet.TopicFilter) {
+	c.subscribe(packet.Integer(atomic.AddUint32(&PacketId, 1)), filters)
+}
+
+func (c *mqttConn) subscribe(packetId packet.Integer, filters []packet.TopicFilter) {
 	if c.IsDead() {
 		return
 	}
 	p := &packet.SubscribePacket{
-		PacketId:     packet.Integer(atomic.AddUint32(&PacketId, 1)),
+		PacketId:     packetId,
 		TopicFilters: filters,
 	}
 	TopicFilterRegistry.AddSubs(uint16(p.PacketId), filters)
 	c.writech <- p
 }
 
+// receiveManual handles a QoS 1/2 publish packet in manual acknowledgement mode.
+func (c *mqttConn) receiveManual(p packet.PublishPacket) {
+	if p.Qos == packet.QoS2 {
+		if bool(p.Dup) && c.session.GetPubIn(p.PacketId) {
+			//the acknowledgement of the original one may have been lost
+			if !c.acks.pending(p.PacketId) {
+				c.respondPublish(p.PacketId, p.Qos)
+			}
+			return
+		}
+		c.session.AddPubIn(p.PacketId)
+	}
+	ack, ok := c.acks.add(c, p)
+	if !ok {
+		//still with the application, acknowledged once
+		return
+	}
+	m := Message{
+		PublishPacket: p,
+		ack:           ack,
+	}
+	if l, ok := c.listener.(AckListener); ok {
+		go l.OnMessage(m)
+		c.dispatch(m)
+		return
+	}
+	go c.listener.OnPublishReceived(p)
+	if !c.dispatch(m) && !c.IsDead() {
+		//never handed to the application to acknowledge
+		ack()
+	}
+}
+
+// respondPublish sends PUBACK or PUBREC for a received publish packet.
+func (c *mqttConn) respondPublish(packetId packet.Integer, qos packet.Bit2) {
+	var p packet.ControlPacketer
+	switch qos {
+	case packet.QoS1:
+		p = &packet.PubackPacket{PacketId: packetId}
+	case packet.QoS2:
+		p = &packet.PubrecPacket{PacketId: packetId}
+	default:
+		return
+	}
+	select {
+	case c.writech <- p:
+	case <-c.exitch:
+	}
+}
+
 func (c *mqttConn) handleSuback(p *packet.SubackPacket) {
 	subs, ok := TopicFilterRegistry.GetRemoveSubs(uint16(p.PacketId))
 	if !ok {
 		return
 	}
+	c.chans.subscribed(p.PacketId, p.Code)
 	if len(subs) != len(p.Code) {
 		return
 	}
-	go listener.OnSubscribeSuccess(subs)
+	go c.listener.OnSubscribeSuccess(subs)
 	tem := make([]packet.TopicFilter, len(subs))
 	n := 0
 	for i := 0; i < len(p.Code); i++ {
@@ -284,7 +395,7 @@ func (c *mqttConn) handleUnsuback(pid uint16) {
 	if !ok {
 		return
 	}
-	go listener.OnUnsubscribeSuccess(unsbs)
+	go c.listener.OnUnsubscribeSuccess(unsbs)
 	c.session.Unsubscription(unsbs)
 }
 
@@ -298,6 +409,11 @@ func (c *mqttConn) Disconnect() {
 	c.closeConn("disconnect", true)
 }
 
+// Done returns a channel closed once the connection is closed.
+func (c *mqttConn) Done() <-chan struct{} {
+	return c.exitch
+}
+
 // IsDead reports the connection is closed or not
 func (c *mqttConn) IsDead() bool {
 	c.deadl.Lock()
@@ -4,7 +4,6 @@ import (
 	"hilldan/mqtt"
 	"hilldan/mqtt/connection"
 	"hilldan/mqtt/packet"
-	"log"
 	"time"
 )
 
@@ -17,6 +16,13 @@ var (
 	ClientId  string
 	PacketId  uint32 //convert into packet.Integer
 	listener  mqtt.EventListener
+	logger    mqtt.Logger = mqtt.NopLogger{}
+
+	manualAck        bool
+	ackTimeout       time.Duration
+	ackTimeoutPolicy AckTimeout
+
+	endpoints *connection.MultiClient
 )
 
 func SetPersister(p mqtt.Persister) {
@@ -27,6 +33,49 @@ func SetEventListener(l mqtt.EventListener) {
 	listener = l
 }
 
+// SetLogger assigns the logger of the client, of the session persisted and of
+// the connection, see mqtt.SetLogger. The logs are discarded by default.
+func SetLogger(l mqtt.Logger) {
+	if l == nil {
+		l = mqtt.NopLogger{}
+	}
+	logger = l
+	mqtt.SetLogger(l)
+	connection.SetLogger(l)
+}
+
+// SetManualAck turns the manual acknowledgement mode on or off. In this mode
+// the PUBACK/PUBREC of an inbound QoS 1/2 message is not sent until the
+// application calls Message.Ack, see AckListener. The messages handed to no
+// AckListener nor channel subscriber are acknowledged on receipt. A message
+// not acknowledged within timeout is handled by policy. The timeout is
+// required, since a message never acknowledged holds back all the later
+// acknowledgements: the mode stays off without it.
+func SetManualAck(enable bool, timeout time.Duration, policy AckTimeout) {
+	if enable && timeout <= 0 {
+		logger.Warn("manual acknowledgement without timeout, messages acknowledged on receipt")
+		enable = false
+	}
+	manualAck = enable
+	ackTimeout = timeout
+	ackTimeoutPolicy = policy
+}
+
+// SetEndpoints makes RunMQTT fail over across endpoints, such as primary TLS,
+// secondary TLS and fallback websocket, instead of dialing its client. The
+// endpoints are dialed in the order of strategy, their health is kept across
+// the calls of RunMQTT, so that a broker down is skipped on reconnecting.
+// The MultiClient returned is used for its backoff and health, see
+// connection.MultiClient. No endpoint turns it off.
+func SetEndpoints(strategy connection.Strategy, clients ...connection.Clienter) *connection.MultiClient {
+	if len(clients) == 0 {
+		endpoints = nil
+		return nil
+	}
+	endpoints = connection.NewMultiClient(strategy, clients...)
+	return endpoints
+}
+
 // TCP ports 8883 and 1883 are registered with IANA for MQTT TLS and non TLS communication
 // respectively.
 
@@ -37,44 +86,90 @@ func SetEventListener(l mqtt.EventListener) {
 // Subscribe to request Application Messages that it is interested in receiving.
 // Unsubscribe to remove a request for Application Messages.
 // Disconnect from the Server.
+//
+// client is not used once the endpoints to fail over across are set, see
+// SetEndpoints.
+// A nil persist keeps the session in memory only.
 func RunMQTT(client connection.Clienter, persist mqtt.Persister, p *packet.ConnectPacket) (cnn *mqttConn, err error) {
 	persister = persist
 	if persister == nil {
-		panic("persister is nil")
+		persister = mqtt.NewMemPersist()
 	}
-	conn, err := client.Dial()
-	if err != nil {
-		return
+	if endpoints != nil {
+		client = endpoints
 	}
 	ClientId = string(p.ClientId)
 	if listener == nil {
 		listener = mqtt.DefaultListener{}
 	}
+	return connect(client, Config{Persister: persister, Key: KeySession, Listener: listener}, manualAck, p)
+}
+
+// Config is the state of a connection run by Connect.
+type Config struct {
+	Persister mqtt.Persister     //nil keeps the session in memory only
+	Key       string             //of the session persisted, KeySession by default
+	Listener  mqtt.EventListener //DefaultListener by default
+}
+
+// Connect connects to the server dialed by client, as RunMQTT does, but with
+// the persister, session key and listener of cfg instead of the ones assigned
+// to the package, so that it can run beside the connection of RunMQTT, such
+// as a broker bridge. The endpoints of SetEndpoints are not used, and the
+// messages are acknowledged on receipt.
+func Connect(client connection.Clienter, cfg Config, p *packet.ConnectPacket) (*mqttConn, error) {
+	if cfg.Persister == nil {
+		cfg.Persister = mqtt.NewMemPersist()
+	}
+	if cfg.Key == "" {
+		cfg.Key = KeySession
+	}
+	if cfg.Listener == nil {
+		cfg.Listener = mqtt.DefaultListener{}
+	}
+	return connect(client, cfg, false, p)
+}
+
+func connect(client connection.Clienter, cfg Config, manual bool, p *packet.ConnectPacket) (cnn *mqttConn, err error) {
+	if err = mqtt.UpgradeSessions(cfg.Key, cfg.Persister); err != nil {
+		return
+	}
+	conn, err := client.Dial()
+	if err != nil {
+		return
+	}
 
 	const N = 10
 	cnn = &mqttConn{
-		cnn:      conn,
-		readch:   make(chan mqtt.PacketReaded, N),
-		writech:  make(chan packet.ControlPacketer, N),
-		exitch:   make(chan struct{}),
-		pingch:   make(chan struct{}, N),
-		deadline: time.Second * time.Duration(p.KeepAlive),
+		clientId:  string(p.ClientId),
+		key:       cfg.Key,
+		persister: cfg.Persister,
+		listener:  cfg.Listener,
+		manualAck: manual,
+		cnn:       conn,
+		readch:    make(chan mqtt.PacketReaded, N),
+		writech:   make(chan packet.ControlPacketer, N),
+		exitch:    make(chan struct{}),
+		pingch:    make(chan struct{}, N),
+		deadline:  time.Second * time.Duration(p.KeepAlive),
+		window:    newWindow(maxInflight, inflightFailFast),
 	}
-	go cnn.write()
-	go cnn.read()
+	cnn.spawn(cnn.write)
+	cnn.spawn(cnn.read)
 
-	cnn.writech <- p
+	sent := *p //its length is computed by the writing
+	cnn.writech <- &sent
 	err = cnn.initConn(bool(p.CleanSession))
 	if err != nil {
 		return
 	}
-	go func() {
-		if err2 := listener.OnConnected(*p); err2 != nil {
+	cnn.spawn(func() {
+		if err2 := cnn.listener.OnConnected(*p); err2 != nil {
 			time.Sleep(1e6)
 			cnn.closeConn(err2.Error(), false)
 		}
-	}()
-	go readPacket(cnn)
+	})
+	cnn.spawn(func() { readPacket(cnn) })
 
 	return
 }
@@ -90,11 +185,22 @@ func readPacket(c *mqttConn) {
 			c.closeConn("connect fail", true)
 			break
 		}
+		//publish packets are handled in order, so that a slow channel
+		//subscriber can hold the reading back
+		if pr.P.ControlType() == packet.TypePUBLISH {
+			handlePacket(pr.P, c)
+			continue
+		}
 		go handlePacket(pr.P, c)
 	}
-	log.Printf("handler no leak")
+	//the connection closed by the server ends the reading too
+	c.closeConn("connection lost", true)
+	logger.Debug("handler exit", c.fields()...)
 }
 func handlePacket(p packet.ControlPacketer, c *mqttConn) {
+	if mqtt.DebugEnabled(logger) {
+		logger.Debug("packet received", c.fields(mqtt.PacketFields(p)...)...)
+	}
 	if c.deadline > 0 {
 		c.pingch <- struct{}{}
 	}
@@ -103,6 +209,10 @@ func handlePacket(p packet.ControlPacketer, c *mqttConn) {
 	// case packet.TypeCONNACK:
 	case packet.TypePUBLISH:
 		pk := p.(*packet.PublishPacket)
+		if c.manualAck && pk.Qos != packet.QoS0 {
+			c.receiveManual(*pk)
+			return
+		}
 		//response
 		switch pk.Qos {
 		case packet.QoS0:
@@ -115,16 +225,17 @@ func handlePacket(p packet.ControlPacketer, c *mqttConn) {
 			}
 			c.session.AddPubIn(pk.PacketId)
 		}
-		go listener.OnPublishReceived(*pk)
+		go c.listener.OnPublishReceived(*pk)
+		c.dispatch(Message{PublishPacket: *pk})
 
 	case packet.TypePUBACK:
 		pk := p.(*packet.PubackPacket)
-		c.session.RemovePubOut(pk.PacketId)
+		c.acknowledged(pk.PacketId)
 
 	case packet.TypePUBREC:
 		pk := p.(*packet.PubrecPacket)
 		c.writech <- &packet.PubrelPacket{PacketId: pk.PacketId}
-		c.session.RemovePubOut(pk.PacketId)
+		c.acknowledged(pk.PacketId)
 
 	case packet.TypePUBREL:
 		pk := p.(*packet.PubrelPacket)
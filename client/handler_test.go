@@ -0,0 +1,58 @@
+package client
+
+import (
+	"errors"
+	"hilldan/mqtt"
+	"hilldan/mqtt/connection"
+	"hilldan/mqtt/packet"
+	"io"
+	"net"
+	"testing"
+)
+
+// brokerClient dials a broker accepting the connection, or fails with err.
+type brokerClient struct {
+	err   error
+	dials int
+}
+
+func (b *brokerClient) Dial() (net.Conn, error) {
+	b.dials++
+	if b.err != nil {
+		return nil, b.err
+	}
+	cnn, peer := net.Pipe()
+	go func() {
+		if _, err := packet.ParsePacket(peer); err != nil {
+			return
+		}
+		(&packet.ConnackPacket{Code: packet.CodeConnackAccepted}).WriteTo(peer)
+		io.Copy(io.Discard, peer)
+	}()
+	return cnn, nil
+}
+
+func TestRunMQTTEndpoints(t *testing.T) {
+	old := listener
+	listener = mqtt.DefaultListener{}
+	defer func() {
+		listener = old
+		SetEndpoints(connection.StrategyOrder)
+	}()
+
+	down, up := &brokerClient{err: errors.New("refused")}, &brokerClient{}
+	SetEndpoints(connection.StrategyOrder, down, up)
+	unused := &brokerClient{}
+	cnn, err := RunMQTT(unused, mqtt.NewMemPersist(), &packet.ConnectPacket{ClientId: "c1", CleanSession: true})
+	if err != nil {
+		t.Fatalf("connect fail: %v", err)
+	}
+	cnn.closeConn("test", false)
+	cnn.wait()
+	if down.dials != 1 || up.dials != 1 || unused.dials != 0 {
+		t.Errorf("want failed over to the second endpoint, dials %d %d %d", down.dials, up.dials, unused.dials)
+	}
+	if h := endpoints.Health(); h[0].Healthy() || !h[1].Healthy() {
+		t.Errorf("health err: %+v", h)
+	}
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"errors"
+	"hilldan/mqtt"
+	"sync"
+)
+
+var ErrInflightFull = errors.New("Too many messages in flight")
+
+var (
+	maxInflight      int
+	inflightFailFast bool
+)
+
+// SetMaxInflight limits the number of QoS 1/2 messages published but not
+// acknowledged yet. Once the limit is reached, Publish blocks until an
+// acknowledgement frees a slot, or returns ErrInflightFull when failFast is
+// true. A max of zero means no limit.
+func SetMaxInflight(max int, failFast bool) {
+	maxInflight = max
+	inflightFailFast = failFast
+}
+
+// InflightStats is a snapshot of the in-flight window.
+type InflightStats struct {
+	Inflight int //messages waiting for acknowledgement
+	Max      int //zero means no limit
+	Waiting  int //publishers blocked for a free slot now
+	Blocked  uint64
+	Rejected uint64
+}
+
+// window counts the QoS 1/2 messages in flight.
+type window struct {
+	sync.Mutex
+	cond     *sync.Cond
+	n        int
+	max      int
+	failFast bool
+	closed   bool
+
+	waiting  int
+	blocked  uint64
+	rejected uint64
+}
+
+func newWindow(max int, failFast bool) *window {
+	w := &window{
+		max:      max,
+		failFast: failFast,
+	}
+	w.cond = sync.NewCond(&w.Mutex)
+	return w
+}
+
+// acquire takes a slot, waiting for one if needed.
+func (w *window) acquire() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.max > 0 && w.n >= w.max && !w.closed {
+		if w.failFast {
+			w.rejected++
+			return ErrInflightFull
+		}
+		w.blocked++
+		w.waiting++
+		for w.n >= w.max && !w.closed {
+			w.cond.Wait()
+		}
+		w.waiting--
+	}
+	if w.closed {
+		return mqtt.ErrClosed
+	}
+	w.n++
+	return nil
+}
+
+// force takes a slot even if the window is full, for the messages resent
+// from the session.
+func (w *window) force() {
+	w.Lock()
+	w.n++
+	w.Unlock()
+}
+
+func (w *window) release() {
+	w.Lock()
+	if w.n > 0 {
+		w.n--
+	}
+	w.Unlock()
+	w.cond.Signal()
+}
+
+// close wakes up all the blocked publishers.
+func (w *window) close() {
+	w.Lock()
+	w.closed = true
+	w.Unlock()
+	w.cond.Broadcast()
+}
+
+func (w *window) stats() InflightStats {
+	w.Lock()
+	defer w.Unlock()
+	return InflightStats{
+		Inflight: w.n,
+		Max:      w.max,
+		Waiting:  w.waiting,
+		Blocked:  w.blocked,
+		Rejected: w.rejected,
+	}
+}
+
+// Inflight returns the current state of the in-flight window.
+func (c *mqttConn) Inflight() InflightStats {
+	return c.window.stats()
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	w := newWindow(2, true)
+	w.acquire()
+	w.acquire()
+	if err := w.acquire(); err != ErrInflightFull {
+		t.Errorf("want ErrInflightFull actual %v", err)
+	}
+
+	w.failFast = false
+	done := make(chan error)
+	go func() { done <- w.acquire() }()
+	select {
+	case <-done:
+		t.Fatalf("acquire should block when the window is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+	w.release()
+	if err := <-done; err != nil {
+		t.Errorf("acquire err: %v", err)
+	}
+
+	go func() { done <- w.acquire() }()
+	time.Sleep(10 * time.Millisecond)
+	w.close()
+	if err := <-done; err == nil {
+		t.Errorf("acquire should fail after closed")
+	}
+
+	s := w.stats()
+	if s.Inflight != 2 || s.Max != 2 || s.Rejected != 1 || s.Blocked != 2 || s.Waiting != 0 {
+		t.Errorf("stats err: %+v", s)
+	}
+}
+
+func TestPublishClosed(t *testing.T) {
+	c := &mqttConn{
+		writech: make(chan packet.ControlPacketer),
+		exitch:  make(chan struct{}),
+		session: mqtt.NewSession(),
+		window:  newWindow(1, true),
+	}
+	close(c.exitch)
+	if err := c.Publish(packet.PublishPacket{Qos: packet.QoS1, TopicName: "a"}); err != mqtt.ErrClosed {
+		t.Fatalf("want ErrClosed actual %v", err)
+	}
+	if n := len(c.session.ResetPubOut()); n != 0 || c.Inflight().Inflight != 0 {
+		t.Errorf("kept %d in the session, %d in flight", n, c.Inflight().Inflight)
+	}
+}
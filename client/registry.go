@@ -1,6 +1,7 @@
 package client
 
 import (
+	"hilldan/mqtt"
 	"hilldan/mqtt/packet"
 	"sync"
 )
@@ -70,3 +71,59 @@ func (r *topicFilterRegistry) RemoveUnsubs(pid uint16) {
 	delete(r.unsubs, pid)
 	r.Unlock()
 }
+
+// chanRegistry manages the subscriptions delivered through channels.
+type chanRegistry struct {
+	sync.RWMutex
+	subs []*chanSub
+}
+
+func (r *chanRegistry) Add(s *chanSub) {
+	r.Lock()
+	r.subs = append(r.subs, s)
+	r.Unlock()
+}
+
+// Remove removes s, and reports whether its filter is no longer used by any
+// other channel subscriber.
+func (r *chanRegistry) Remove(s *chanSub) (last bool) {
+	r.Lock()
+	defer r.Unlock()
+	last = true
+	for i := 0; i < len(r.subs); i++ {
+		if r.subs[i] == s {
+			r.subs = append(r.subs[:i], r.subs[i+1:]...)
+			i--
+			continue
+		}
+		if r.subs[i].filter == s.filter {
+			last = false
+		}
+	}
+	return
+}
+
+// subscribed marks the subscribers of the SUBSCRIBE of packetId subscribed,
+// or refused by the return codes of the SUBACK.
+func (r *chanRegistry) subscribed(packetId packet.Integer, codes []byte) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, s := range r.subs {
+		if s.packetId == packetId {
+			s.refused = len(codes) != 1 || codes[0] == packet.CodeSubackFailure
+			close(s.subscribed)
+		}
+	}
+}
+
+// Match returns the subscribers whose filter matches topic.
+func (r *chanRegistry) Match(topic string) (subs []*chanSub) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, s := range r.subs {
+		if mqtt.MatchTopic(s.filter, topic) {
+			subs = append(subs, s)
+		}
+	}
+	return
+}
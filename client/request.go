@@ -0,0 +1,191 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const replyBufSize = 16
+
+// ErrReplyRefused is returned by Request when the server refuses the
+// subscription of the reply topic.
+var ErrReplyRefused = errors.New("reply topic subscription refused")
+
+var (
+	replyTopic string
+	requestId  uint64
+)
+
+// envelope wraps the payload of a request or a response, so that a response
+// can be correlated with its request.
+type envelope struct {
+	Id      string `json:"id"`
+	Reply   string `json:"reply,omitempty"` //topic the response is published to
+	Payload []byte `json:"payload"`
+}
+
+// replyRegistry manages the requests waiting for response.
+type replyRegistry struct {
+	sync.Mutex
+	once    sync.Once
+	sub     *chanSub               //of the reply topic
+	pending map[string]chan []byte //correlation id->response
+}
+
+func (r *replyRegistry) add(id string) chan []byte {
+	ch := make(chan []byte, 1)
+	r.Lock()
+	if r.pending == nil {
+		r.pending = make(map[string]chan []byte)
+	}
+	r.pending[id] = ch
+	r.Unlock()
+	return ch
+}
+
+func (r *replyRegistry) remove(id string) {
+	r.Lock()
+	delete(r.pending, id)
+	r.Unlock()
+}
+
+func (r *replyRegistry) resolve(id string, payload []byte) {
+	r.Lock()
+	ch, ok := r.pending[id]
+	delete(r.pending, id)
+	r.Unlock()
+	if ok {
+		ch <- payload
+	}
+}
+
+// SetReplyTopic assigns the topic the responses of Request are published to,
+// "reply/<client id>" by default.
+func SetReplyTopic(topic string) {
+	replyTopic = topic
+}
+
+func (c *mqttConn) replyTopic() string {
+	if replyTopic != "" {
+		return replyTopic
+	}
+	return "reply/" + c.clientId
+}
+
+// Request publishes payload to topic and waits for the response sent by
+// HandleRequests on the other side, until ctx is done. The reply topic is
+// subscribed on the first call, and the requests are published once it is
+// acknowledged by the server, ErrReplyRefused returned if it is refused.
+func (c *mqttConn) Request(ctx context.Context, topic string, payload []byte) (resp []byte, err error) {
+	if c.IsDead() {
+		err = mqtt.ErrClosed
+		return
+	}
+	reply := c.replyTopic()
+	c.replies.once.Do(func() {
+		s, _ := c.subscribeChan(reply, packet.QoS1, replyBufSize, OverflowBlock)
+		c.replies.sub = s
+		go c.receiveReplies(s.ch)
+	})
+	select {
+	case <-c.replies.sub.subscribed:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case <-c.exitch:
+		err = mqtt.ErrClosed
+		return
+	}
+	if c.replies.sub.refused {
+		err = ErrReplyRefused
+		return
+	}
+
+	id := c.clientId + "-" + strconv.FormatUint(atomic.AddUint64(&requestId, 1), 36)
+	data, err := json.Marshal(envelope{Id: id, Reply: reply, Payload: payload})
+	if err != nil {
+		return
+	}
+	ch := c.replies.add(id)
+	defer c.replies.remove(id)
+	err = c.Publish(packet.PublishPacket{
+		Qos:                packet.QoS1,
+		TopicName:          packet.String(topic),
+		ApplicationMessage: packet.String(data),
+	})
+	if err != nil {
+		return
+	}
+
+	select {
+	case resp = <-ch:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-c.exitch:
+		err = mqtt.ErrClosed
+	}
+	return
+}
+
+func (c *mqttConn) receiveReplies(ch <-chan Message) {
+	for {
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			m.Ack()
+			var env envelope
+			if json.Unmarshal([]byte(m.ApplicationMessage), &env) != nil {
+				continue
+			}
+			c.replies.resolve(env.Id, env.Payload)
+		case <-c.exitch:
+			return
+		}
+	}
+}
+
+// HandleRequests subscribes topic and answers every request sent by Request
+// with the result of f, in the order they are received.
+// Calling cancel unsubscribes topic.
+func (c *mqttConn) HandleRequests(topic string, f func(req []byte) (resp []byte)) (cancel func()) {
+	ch, cancel := c.SubscribeChan(topic, packet.QoS1, replyBufSize, OverflowBlock)
+	go func() {
+		for {
+			select {
+			case m, ok := <-ch:
+				if !ok {
+					return
+				}
+				c.respond(m, f)
+			case <-c.exitch:
+				return
+			}
+		}
+	}()
+	return
+}
+
+func (c *mqttConn) respond(m Message, f func(req []byte) (resp []byte)) {
+	defer m.Ack()
+	var env envelope
+	if json.Unmarshal([]byte(m.ApplicationMessage), &env) != nil || env.Reply == "" {
+		return
+	}
+	data, err := json.Marshal(envelope{Id: env.Id, Payload: f(env.Payload)})
+	if err != nil {
+		return
+	}
+	c.Publish(packet.PublishPacket{
+		Qos:                packet.QoS1,
+		TopicName:          packet.String(env.Reply),
+		ApplicationMessage: packet.String(data),
+	})
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"testing"
+	"time"
+)
+
+func TestRespond(t *testing.T) {
+	c := &mqttConn{
+		writech: make(chan packet.ControlPacketer, 10),
+		exitch:  make(chan struct{}),
+		session: mqtt.NewSession(),
+		window:  newWindow(0, false),
+	}
+	req, _ := json.Marshal(envelope{Id: "x-1", Reply: "reply/x", Payload: []byte("ping")})
+	c.respond(Message{PublishPacket: packet.PublishPacket{
+		TopicName:          "rpc",
+		ApplicationMessage: packet.String(req),
+	}}, func(req []byte) []byte {
+		return append(req, " pong"...)
+	})
+
+	p := (<-c.writech).(*packet.PublishPacket)
+	if p.TopicName != "reply/x" {
+		t.Errorf("want reply topic 'reply/x' actual '%s'", p.TopicName)
+	}
+	var env envelope
+	if err := json.Unmarshal([]byte(p.ApplicationMessage), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Id != "x-1" || string(env.Payload) != "ping pong" {
+		t.Errorf("response err: %+v", env)
+	}
+
+	ch := c.replies.add(env.Id)
+	c.replies.resolve("x-2", nil)
+	c.replies.resolve(env.Id, env.Payload)
+	if resp := <-ch; string(resp) != "ping pong" {
+		t.Errorf("want 'ping pong' actual '%s'", resp)
+	}
+}
+
+func TestRequestSubscribed(t *testing.T) {
+	c := &mqttConn{
+		listener: mqtt.DefaultListener{},
+		writech:  make(chan packet.ControlPacketer, 10),
+		exitch:   make(chan struct{}),
+		session:  mqtt.NewSession(),
+		window:   newWindow(0, false),
+	}
+	type result struct {
+		resp []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := c.Request(context.Background(), "rpc", []byte("ping"))
+		done <- result{resp, err}
+	}()
+
+	sub := (<-c.writech).(*packet.SubscribePacket)
+	select {
+	case p := <-c.writech:
+		t.Fatalf("%v sent before SUBACK", p.ControlType())
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.handleSuback(&packet.SubackPacket{PacketId: sub.PacketId, Code: []byte{byte(packet.QoS1)}})
+	p := (<-c.writech).(*packet.PublishPacket)
+	var env envelope
+	json.Unmarshal([]byte(p.ApplicationMessage), &env)
+	resp, _ := json.Marshal(envelope{Id: env.Id, Payload: []byte("pong")})
+	c.dispatch(Message{PublishPacket: packet.PublishPacket{
+		TopicName:          packet.String(env.Reply),
+		ApplicationMessage: packet.String(resp),
+	}})
+	if r := <-done; r.err != nil || string(r.resp) != "pong" {
+		t.Errorf("response %s %v", r.resp, r.err)
+	}
+}
+
+func TestRequestRefused(t *testing.T) {
+	c := &mqttConn{
+		listener: mqtt.DefaultListener{},
+		writech:  make(chan packet.ControlPacketer, 10),
+		exitch:   make(chan struct{}),
+		session:  mqtt.NewSession(),
+		window:   newWindow(0, false),
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Request(context.Background(), "rpc", []byte("ping"))
+		done <- err
+	}()
+	sub := (<-c.writech).(*packet.SubscribePacket)
+	c.handleSuback(&packet.SubackPacket{PacketId: sub.PacketId, Code: []byte{packet.CodeSubackFailure}})
+	if err := <-done; err != ErrReplyRefused {
+		t.Errorf("want ErrReplyRefused actual %v", err)
+	}
+	if _, err := c.Request(context.Background(), "rpc", nil); err != ErrReplyRefused {
+		t.Errorf("want ErrReplyRefused actual %v", err)
+	}
+	if len(c.writech) != 0 {
+		t.Errorf("request published")
+	}
+}
@@ -0,0 +1,104 @@
+// Command mqttdump exports the sessions and the retained packets persisted by
+// a broker to JSON lines, and imports them into another one.
+//
+//	mqttdump -store broker.db -export state.jsonl -client c1,c2 -topic 'dev/#'
+//	mqttdump -store other.db -import state.jsonl
+//	mqttdump -backend redis -store 127.0.0.1:6379 -db 1 -export -
+//
+// The broker ought not to run meanwhile.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hilldan/db/redis"
+	"hilldan/mqtt"
+	"hilldan/mqtt/server"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	backend   = flag.String("backend", "file", "persister of the broker, file or redis")
+	store     = flag.String("store", "", "path of the file, or address of redis")
+	password  = flag.String("password", "", "password of redis")
+	db        = flag.Int("db", 0, "database of redis")
+	export    = flag.String("export", "", "export the state to this file, - for stdout")
+	importf   = flag.String("import", "", "import the state from this file, - for stdin")
+	clientIds = flag.String("client", "", "comma separated client ids of the sessions, empty for all")
+	topic     = flag.String("topic", "", "topic filter of the retained packets, empty for all")
+	noSession = flag.Bool("nosession", false, "leave out the sessions")
+	noRetain  = flag.Bool("noretain", false, "leave out the retained packets")
+)
+
+func main() {
+	flag.Parse()
+	if *store == "" || (*export == "") == (*importf == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "mqttdump:", err)
+		os.Exit(1)
+	}
+}
+
+// openStore returns the persister of the backend, and the function closing it.
+func openStore() (mqtt.Persister, func() error, error) {
+	switch *backend {
+	case "file":
+		p, err := mqtt.NewFilePersist(*store, mqtt.SyncNever)
+		if err != nil {
+			return nil, nil, err
+		}
+		return p, p.Close, nil
+	case "redis":
+		p := mqtt.NewRedisPersist(redis.NewClient(*store, *password, *db, 1))
+		return p, func() error { return nil }, nil
+	}
+	return nil, nil, fmt.Errorf("unknown backend %q", *backend)
+}
+
+func run() error {
+	p, closeStore, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	f := server.StateFilter{Topic: *topic, NoSession: *noSession, NoRetain: *noRetain}
+	if *clientIds != "" {
+		f.ClientIds = strings.Split(*clientIds, ",")
+	}
+
+	var n int
+	if *export != "" {
+		var w io.Writer = os.Stdout
+		if *export != "-" {
+			file, err := os.Create(*export)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+		}
+		n, err = server.Export(w, p, f)
+	} else {
+		var r io.Reader = os.Stdin
+		if *importf != "-" {
+			file, err := os.Open(*importf)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+		n, err = server.Import(r, p, f)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d records\n", n)
+	return nil
+}
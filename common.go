@@ -10,6 +10,8 @@ var (
 	ErrTimeout = errors.New("Timeout")
 	ErrConnect = errors.New("Connect refused")
 	ErrAuth    = errors.New("Auth fail")
+	ErrClosed  = errors.New("Connection closed")
+	ErrVersion = errors.New("Data version incompatible")
 )
 
 type PacketReaded struct {
@@ -1,7 +1,7 @@
 package connection
 
 import (
-	"log"
+	"hilldan/mqtt"
 	"net"
 	"sync"
 	"time"
@@ -24,6 +24,17 @@ func (st Stat) String() string {
 	return "invalid status"
 }
 
+var logger mqtt.Logger = mqtt.NopLogger{}
+
+// SetLogger assigns the logger of the connections. server.SetLogger and
+// client.SetLogger assign it as well.
+func SetLogger(l mqtt.Logger) {
+	if l == nil {
+		l = mqtt.NopLogger{}
+	}
+	logger = l
+}
+
 type Conn struct {
 	net.Conn //underlying conn
 	sendch   chan []byte
@@ -55,12 +66,12 @@ func (c *Conn) read() {
 		//当对方意外断线，读取会一直堵塞.解决办法是Send with read deadline，超时关闭
 		n, err := c.Read(buf)
 		if err != nil {
-			log.Println(err)
+			logger.Debug("read fail", "remote_addr", c.name, "err", err)
 			break
 		}
 		err = c.SetReadDeadline(time.Time{}) //clear timeout
 		if err != nil {
-			log.Println(err)
+			logger.Debug("clear read deadline fail", "remote_addr", c.name, "err", err)
 			break
 		}
 		if c.handler != nil && n > 0 {
@@ -70,7 +81,7 @@ func (c *Conn) read() {
 	c.Close()
 	c.SetStatus(StatDisconn)
 	close(c.closech)
-	log.Println("read end")
+	logger.Debug("read exit", "remote_addr", c.name)
 }
 func (c *Conn) write() {
 exit:
@@ -80,13 +91,13 @@ exit:
 			break exit
 		case msg := <-c.sendch:
 			if _, err := c.Write(msg); err != nil {
-				log.Println(err)
+				logger.Debug("write fail", "remote_addr", c.name, "err", err)
 				c.Close()
 				break exit
 			}
 		}
 	}
-	log.Println("write end")
+	logger.Debug("write exit", "remote_addr", c.name)
 }
 
 // Send send data to peer,  will block. for expect the response from client,
@@ -0,0 +1,146 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrNoEndpoint = errors.New("no endpoint to dial")
+
+// Strategy decides the order the endpoints of a MultiClient are tried.
+type Strategy uint8
+
+const (
+	// StrategyOrder always starts from the first endpoint, the later ones are
+	// fallbacks.
+	StrategyOrder = Strategy(iota)
+	// StrategyRoundRobin starts from the endpoint next to the one connected
+	// last time.
+	StrategyRoundRobin
+)
+
+// Health is the dialing record of an endpoint.
+type Health struct {
+	Failures    int //consecutive failures
+	LastErr     error
+	LastFail    time.Time
+	LastSuccess time.Time
+}
+
+// Healthy reports whether the last dialing succeeded, an endpoint never dialed is healthy.
+func (h Health) Healthy() bool {
+	return h.Failures == 0
+}
+
+// MultiClient dials a list of endpoints, such as primary TLS, secondary TLS
+// and fallback websocket, until one of them succeeds. It keeps the health of
+// every endpoint across dialings, so it is reused on reconnecting.
+type MultiClient struct {
+	Endpoints []Clienter
+	Strategy  Strategy
+	// An endpoint failed is skipped for Backoff, doubled on every consecutive
+	// failure up to MaxBackoff, as long as another endpoint can be tried.
+	// Zero Backoff never skips.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	sync.Mutex
+	health []Health
+	next   int //the endpoint round robin starts from
+}
+
+func NewMultiClient(strategy Strategy, endpoints ...Clienter) *MultiClient {
+	return &MultiClient{
+		Endpoints: endpoints,
+		Strategy:  strategy,
+	}
+}
+
+func (c *MultiClient) Dial() (cnn net.Conn, err error) {
+	order, skipped := c.order()
+	if len(order) == 0 && len(skipped) == 0 {
+		err = ErrNoEndpoint
+		return
+	}
+	//the endpoints backing off are the last resort
+	for _, i := range append(order, skipped...) {
+		cnn, err = c.Endpoints[i].Dial()
+		c.record(i, err)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// order returns the indexes of the endpoints to dial, and the ones backing off.
+func (c *MultiClient) order() (order, skipped []int) {
+	c.Lock()
+	defer c.Unlock()
+	l := len(c.Endpoints)
+	if len(c.health) != l {
+		h := make([]Health, l)
+		copy(h, c.health)
+		c.health = h
+	}
+	start := 0
+	if c.Strategy == StrategyRoundRobin && l > 0 {
+		start = c.next % l
+	}
+	now := time.Now()
+	for k := 0; k < l; k++ {
+		i := (start + k) % l
+		if now.Before(c.health[i].LastFail.Add(c.backoff(c.health[i].Failures))) {
+			skipped = append(skipped, i)
+			continue
+		}
+		order = append(order, i)
+	}
+	return
+}
+
+func (c *MultiClient) backoff(failures int) time.Duration {
+	if failures == 0 || c.Backoff <= 0 {
+		return 0
+	}
+	d := c.Backoff
+	for i := 1; i < failures; i++ {
+		d *= 2
+		if c.MaxBackoff > 0 && d >= c.MaxBackoff {
+			return c.MaxBackoff
+		}
+	}
+	return d
+}
+
+func (c *MultiClient) record(i int, err error) {
+	c.Lock()
+	defer c.Unlock()
+	if i >= len(c.health) {
+		return
+	}
+	h := &c.health[i]
+	if err != nil {
+		h.Failures++
+		h.LastErr = err
+		h.LastFail = time.Now()
+		return
+	}
+	h.Failures = 0
+	h.LastErr = nil
+	h.LastSuccess = time.Now()
+	if c.Strategy == StrategyRoundRobin {
+		c.next = i + 1
+	}
+}
+
+// Health returns the health of every endpoint, in the order of Endpoints.
+func (c *MultiClient) Health() []Health {
+	c.Lock()
+	defer c.Unlock()
+	h := make([]Health, len(c.Endpoints))
+	copy(h, c.health)
+	return h
+}
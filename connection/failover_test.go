@@ -0,0 +1,87 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeClient struct {
+	err   error
+	dials int
+}
+
+func (c *fakeClient) Dial() (net.Conn, error) {
+	c.dials++
+	if c.err != nil {
+		return nil, c.err
+	}
+	cnn, _ := net.Pipe()
+	return cnn, nil
+}
+
+func TestMultiClientOrder(t *testing.T) {
+	down := &fakeClient{err: errors.New("refused")}
+	up := &fakeClient{}
+	c := NewMultiClient(StrategyOrder, down, up)
+	c.Backoff = time.Hour
+
+	for i := 0; i < 2; i++ {
+		cnn, err := c.Dial()
+		if err != nil {
+			t.Fatalf("dial err: %v", err)
+		}
+		cnn.Close()
+	}
+	if down.dials != 1 || up.dials != 2 {
+		t.Errorf("the failed endpoint should back off, dials %d %d", down.dials, up.dials)
+	}
+	h := c.Health()
+	if h[0].Healthy() || h[0].Failures != 1 || !h[1].Healthy() || h[1].LastSuccess.IsZero() {
+		t.Errorf("health err: %+v", h)
+	}
+
+	//every endpoint backing off is still tried
+	up.err = errors.New("refused")
+	if _, err := c.Dial(); err == nil {
+		t.Errorf("dial should fail")
+	}
+	if down.dials != 2 || up.dials != 3 {
+		t.Errorf("all endpoints should be tried, dials %d %d", down.dials, up.dials)
+	}
+}
+
+func TestMultiClientRoundRobin(t *testing.T) {
+	a, b := &fakeClient{}, &fakeClient{}
+	c := NewMultiClient(StrategyRoundRobin, a, b)
+	for i := 0; i < 4; i++ {
+		cnn, err := c.Dial()
+		if err != nil {
+			t.Fatalf("dial err: %v", err)
+		}
+		cnn.Close()
+	}
+	if a.dials != 2 || b.dials != 2 {
+		t.Errorf("dials should be balanced, %d %d", a.dials, b.dials)
+	}
+
+	//next to the one connected, not to the one tried first
+	down := &fakeClient{err: errors.New("refused")}
+	a, b = &fakeClient{}, &fakeClient{}
+	c = NewMultiClient(StrategyRoundRobin, down, a, b)
+	for i := 0; i < 2; i++ {
+		cnn, err := c.Dial()
+		if err != nil {
+			t.Fatalf("dial err: %v", err)
+		}
+		cnn.Close()
+	}
+	if a.dials != 1 || b.dials != 1 {
+		t.Errorf("want the endpoint next to the one connected, dials %d %d", a.dials, b.dials)
+	}
+
+	if _, err := NewMultiClient(StrategyOrder).Dial(); err != ErrNoEndpoint {
+		t.Errorf("want ErrNoEndpoint actual %v", err)
+	}
+}
@@ -33,7 +33,7 @@ func (s *NormalServer) Run(handler ServeConn) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println(err)
+			logger.Warn("accept fail", "addr", s.Addr, "err", err)
 			continue
 		}
 		go handler(conn)
@@ -62,7 +62,7 @@ func (s *TlsServer) Run(handler ServeConn) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println(err)
+			logger.Warn("accept fail", "addr", s.Addr, "err", err)
 			continue
 		}
 		go handler(conn)
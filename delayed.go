@@ -0,0 +1,29 @@
+package mqtt
+
+import (
+	"time"
+
+	"hilldan/mqtt/packet"
+)
+
+// EncodeDelayed encodes a message scheduled with the time it is due:
+//
+//	due(8 bytes unix nano) | packet in MQTT wire format
+func EncodeDelayed(p packet.PublishPacket, due time.Time) ([]byte, error) {
+	data, err := EncodePublish(p)
+	if err != nil {
+		return nil, err
+	}
+	return append(encodeTime(due), data...), nil
+}
+
+// DecodeDelayed decodes a message scheduled encoded by EncodeDelayed.
+func DecodeDelayed(data []byte) (p packet.PublishPacket, due time.Time, err error) {
+	if len(data) < 8 {
+		err = ErrCorrupt
+		return
+	}
+	due, _ = decodeTime(data[:8])
+	p, err = DecodePublish(data[8:])
+	return
+}
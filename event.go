@@ -20,3 +20,9 @@ func (e DefaultListener) OnPublishReceived(p packet.PublishPacket)    {}
 func (e DefaultListener) OnSubscribeSuccess(tfs []packet.TopicFilter) {}
 func (e DefaultListener) OnUnsubscribeSuccess(tfs []packet.String)    {}
 func (e DefaultListener) OnDisconnected()                             {}
+
+// SessionExpiredListener is implemented by the EventListener which wants to
+// know the persistent sessions purged for expiry.
+type SessionExpiredListener interface {
+	OnSessionExpired(clientId string)
+}
@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"context"
+	"hilldan/mqtt/packet"
+	"log/slog"
+)
+
+// Logger writes the logs of the broker and the client. args are key-value
+// pairs of the structured fields. It has the methods of *slog.Logger, so
+// that one can be used directly.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// NopLogger discards all the logs, it is the default.
+type NopLogger struct{}
+
+func (NopLogger) Debug(msg string, args ...any) {}
+func (NopLogger) Info(msg string, args ...any)  {}
+func (NopLogger) Warn(msg string, args ...any)  {}
+func (NopLogger) Error(msg string, args ...any) {}
+
+// Enabled reports false for any level.
+func (NopLogger) Enabled(ctx context.Context, level slog.Level) bool { return false }
+
+// DebugEnabled reports whether l writes the debug logs, so that the fields
+// of every packet are not built for nothing. l is asked by its Enabled
+// method, as the one of *slog.Logger, if any.
+func DebugEnabled(l Logger) bool {
+	if e, ok := l.(interface {
+		Enabled(ctx context.Context, level slog.Level) bool
+	}); ok {
+		return e.Enabled(context.Background(), slog.LevelDebug)
+	}
+	return true
+}
+
+var logger Logger = NopLogger{}
+
+// SetLogger assigns the logger of the sessions persisted. server.SetLogger
+// and client.SetLogger assign it as well.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = NopLogger{}
+	}
+	logger = l
+}
+
+// PacketFields returns the fields logged of p, its type and packet id.
+func PacketFields(p packet.ControlPacketer) []any {
+	fields := []any{"packet_type", p.ControlType().Name()}
+	var id packet.Integer
+	switch pk := p.(type) {
+	case *packet.PublishPacket:
+		if pk.Qos == packet.QoS0 {
+			return fields
+		}
+		id = pk.PacketId
+	case *packet.PubackPacket:
+		id = pk.PacketId
+	case *packet.PubrecPacket:
+		id = pk.PacketId
+	case *packet.PubrelPacket:
+		id = pk.PacketId
+	case *packet.PubcompPacket:
+		id = pk.PacketId
+	case *packet.SubscribePacket:
+		id = pk.PacketId
+	case *packet.SubackPacket:
+		id = pk.PacketId
+	case *packet.UnsubscribePacket:
+		id = pk.PacketId
+	case *packet.UnsubackPacket:
+		id = pk.PacketId
+	default:
+		return fields
+	}
+	return append(fields, "packet_id", int(id))
+}
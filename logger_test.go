@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"hilldan/mqtt/packet"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var l Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	st := &sessionStore{clientId: "c1"}
+	st.logErr(ErrClosed)
+	if s := buf.String(); !strings.Contains(s, "level=ERROR") || !strings.Contains(s, "client_id=c1") {
+		t.Errorf("unexpected log: %s", s)
+	}
+}
+
+func TestPacketFields(t *testing.T) {
+	for _, v := range []struct {
+		p    packet.ControlPacketer
+		want string
+	}{
+		{&packet.PublishPacket{Qos: 1, PacketId: 3}, "[packet_type publish packet_id 3]"},
+		{&packet.PublishPacket{PacketId: 3}, "[packet_type publish]"},
+		{&packet.PubrelPacket{PacketId: 9}, "[packet_type pubrel packet_id 9]"},
+		{&packet.PingreqPacket{}, "[packet_type pingreq]"},
+	} {
+		if s := fmt.Sprint(PacketFields(v.p)); s != v.want {
+			t.Errorf("want %s actual %s", v.want, s)
+		}
+	}
+}
+
+func TestDebugEnabled(t *testing.T) {
+	debug := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	for _, v := range []struct {
+		l    Logger
+		want bool
+	}{
+		{NopLogger{}, false},
+		{slog.New(slog.NewTextHandler(io.Discard, nil)), false},
+		{debug, true},
+		{struct{ Logger }{debug}, true}, //without Enabled
+	} {
+		if DebugEnabled(v.l) != v.want {
+			t.Errorf("%T want %v", v.l, v.want)
+		}
+	}
+}
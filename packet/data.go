@@ -105,6 +105,32 @@ func (bit4 Bit4) String() string {
 	return "Invalid type"
 }
 
+var typeNames = map[Bit4]string{
+	TypeCONNECT:     "connect",
+	TypeCONNACK:     "connack",
+	TypePUBLISH:     "publish",
+	TypePUBACK:      "puback",
+	TypePUBREC:      "pubrec",
+	TypePUBREL:      "pubrel",
+	TypePUBCOMP:     "pubcomp",
+	TypeSUBSCRIBE:   "subscribe",
+	TypeSUBACK:      "suback",
+	TypeUNSUBSCRIBE: "unsubscribe",
+	TypeUNSUBACK:    "unsuback",
+	TypePINGREQ:     "pingreq",
+	TypePINGRESP:    "pingresp",
+	TypeDISCONNECT:  "disconnect",
+}
+
+// Name returns the name of the control type in lower case, such as
+// "publish", for logs and metrics.
+func (bit4 Bit4) Name() string {
+	if s, ok := typeNames[bit4]; ok {
+		return s
+	}
+	return "unknown"
+}
+
 var (
 	ErrLessData         = errors.New("Data is not enough")
 	ErrControlType      = errors.New("Control type unmatched")
@@ -3,7 +3,7 @@ package mqtt
 import "hilldan/db/redis"
 
 // Persister manages sessions, retained packets, support persistance, delete
-// the data must be json format
+// the data is wrapped in a versioned envelope, see Wrap
 type Persister interface {
 	Save(key, field string, data []byte) error
 	Read(key, field string) (data []byte, err error)
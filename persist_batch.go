@@ -0,0 +1,226 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingWrite is a write not flushed to the underlying persister yet.
+type pendingWrite struct {
+	data []byte
+	del  bool
+}
+
+// batchPersist is a write-behind Persister wrapping another one. The writes
+// are staged in memory, repeated writes to the same key/field are coalesced,
+// and flushed in batch every interval or once size writes are staged.
+// Reads see the staged writes.
+type batchPersist struct {
+	p        Persister
+	interval time.Duration
+	size     int
+	onError  func(key, field string, err error)
+
+	sync.Mutex
+	pending  map[string]map[string]pendingWrite //key->field->write
+	flushing map[string]map[string]pendingWrite //the batch being flushed
+	n        int
+	closed   bool
+
+	flushl sync.Mutex //one flush at a time
+	kickch chan struct{}
+	exitch chan struct{}
+	donech chan struct{}
+}
+
+// NewBatchPersist wraps p with a write-behind layer, flushing every interval
+// or once size writes are staged. The errors of flushing are reported to
+// onError, which may be nil.
+// Flush or Close ought to be called on shutdown, otherwise the staged writes
+// are lost.
+func NewBatchPersist(p Persister, interval time.Duration, size int, onError func(key, field string, err error)) *batchPersist {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	bp := &batchPersist{
+		p:        p,
+		interval: interval,
+		size:     size,
+		onError:  onError,
+		pending:  make(map[string]map[string]pendingWrite),
+		kickch:   make(chan struct{}, 1),
+		exitch:   make(chan struct{}),
+		donech:   make(chan struct{}),
+	}
+	go bp.loop()
+	return bp
+}
+
+func (bp *batchPersist) loop() {
+	tk := time.NewTicker(bp.interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+		case <-bp.kickch:
+		case <-bp.exitch:
+			close(bp.donech)
+			return
+		}
+		bp.Flush()
+	}
+}
+
+func (bp *batchPersist) stage(key, field string, w pendingWrite) error {
+	bp.Lock()
+	if bp.closed {
+		bp.Unlock()
+		return ErrClosed
+	}
+	m := bp.pending[key]
+	if m == nil {
+		m = make(map[string]pendingWrite)
+		bp.pending[key] = m
+	}
+	if _, ok := m[field]; !ok {
+		bp.n++
+	}
+	m[field] = w
+	full := bp.size > 0 && bp.n >= bp.size
+	bp.Unlock()
+
+	if full {
+		select {
+		case bp.kickch <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// lookup returns the staged write of key/field.
+func (bp *batchPersist) lookup(key, field string) (w pendingWrite, ok bool) {
+	if w, ok = bp.pending[key][field]; ok {
+		return
+	}
+	w, ok = bp.flushing[key][field]
+	return
+}
+
+func (bp *batchPersist) Save(key, field string, data []byte) error {
+	b := make([]byte, len(data))
+	copy(b, data)
+	return bp.stage(key, field, pendingWrite{data: b})
+}
+func (bp *batchPersist) Read(key, field string) (data []byte, err error) {
+	bp.Lock()
+	w, ok := bp.lookup(key, field)
+	bp.Unlock()
+	if ok {
+		if !w.del {
+			data = make([]byte, len(w.data))
+			copy(data, w.data)
+		}
+		return
+	}
+	return bp.p.Read(key, field)
+}
+func (bp *batchPersist) Delete(key, field string) error {
+	return bp.stage(key, field, pendingWrite{del: true})
+}
+func (bp *batchPersist) LoadAll(key string) (datas map[string][]byte, err error) {
+	//no batch flushed between loading and overlaying the staged writes
+	bp.flushl.Lock()
+	defer bp.flushl.Unlock()
+	datas, err = bp.p.LoadAll(key)
+	if err != nil {
+		return
+	}
+	if datas == nil {
+		datas = make(map[string][]byte)
+	}
+	bp.Lock()
+	defer bp.Unlock()
+	for _, m := range []map[string]pendingWrite{bp.flushing[key], bp.pending[key]} {
+		for field, w := range m {
+			if w.del {
+				delete(datas, field)
+				continue
+			}
+			b := make([]byte, len(w.data))
+			copy(b, w.data)
+			datas[field] = b
+		}
+	}
+	return
+}
+
+// Flush writes all the staged writes to the underlying persister, and
+// returns the first error met. The writes failed are staged again, unless
+// written again meanwhile, to be retried by the next flush.
+func (bp *batchPersist) Flush() (err error) {
+	bp.flushl.Lock()
+	defer bp.flushl.Unlock()
+
+	bp.Lock()
+	batch := bp.pending
+	bp.flushing = batch
+	bp.pending = make(map[string]map[string]pendingWrite)
+	bp.n = 0
+	bp.Unlock()
+
+	failed := make(map[string]map[string]pendingWrite)
+	for key, m := range batch {
+		for field, w := range m {
+			var e error
+			if w.del {
+				e = bp.p.Delete(key, field)
+			} else {
+				e = bp.p.Save(key, field, w.data)
+			}
+			if e == nil {
+				continue
+			}
+			if err == nil {
+				err = e
+			}
+			if failed[key] == nil {
+				failed[key] = make(map[string]pendingWrite)
+			}
+			failed[key][field] = w
+			if bp.onError != nil {
+				bp.onError(key, field, e)
+			}
+		}
+	}
+
+	bp.Lock()
+	for key, m := range failed {
+		if bp.pending[key] == nil {
+			bp.pending[key] = make(map[string]pendingWrite)
+		}
+		for field, w := range m {
+			if _, ok := bp.pending[key][field]; !ok {
+				bp.pending[key][field] = w
+				bp.n++
+			}
+		}
+	}
+	bp.flushing = nil
+	bp.Unlock()
+	return
+}
+
+// Close stops flushing in background and flushes the staged writes.
+func (bp *batchPersist) Close() error {
+	bp.Lock()
+	if bp.closed {
+		bp.Unlock()
+		return nil
+	}
+	bp.closed = true
+	bp.Unlock()
+	close(bp.exitch)
+	<-bp.donech
+	return bp.Flush()
+}
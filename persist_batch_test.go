@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type countPersist struct {
+	*memPersist
+	saves int
+	err   error
+}
+
+func (cp *countPersist) Save(key, field string, data []byte) error {
+	cp.saves++
+	if cp.err != nil {
+		return cp.err
+	}
+	return cp.memPersist.Save(key, field, data)
+}
+
+func TestBatchPersist(t *testing.T) {
+	under := &countPersist{memPersist: NewMemPersist()}
+	under.memPersist.Save("k", "old", []byte("0"))
+	var failed []string
+	bp := NewBatchPersist(under, time.Hour, 0, func(key, field string, err error) {
+		failed = append(failed, key+"/"+field)
+	})
+	defer bp.Close()
+
+	for i := 0; i < 10; i++ {
+		bp.Save("k", "a", []byte{byte('0' + i)})
+	}
+	bp.Delete("k", "old")
+	if data, _ := bp.Read("k", "a"); string(data) != "9" {
+		t.Errorf("want staged '9' actual '%s'", data)
+	}
+	if datas, _ := bp.LoadAll("k"); len(datas) != 1 || string(datas["a"]) != "9" {
+		t.Errorf("load all err: %v", datas)
+	}
+	if under.saves != 0 {
+		t.Errorf("nothing should be written before flushing")
+	}
+
+	if err := bp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if under.saves != 1 {
+		t.Errorf("writes should be coalesced, saves %d", under.saves)
+	}
+	if data, _ := under.Read("k", "old"); data != nil {
+		t.Errorf("delete not flushed")
+	}
+
+	under.err = errors.New("disk full")
+	bp.Save("k", "b", nil)
+	if err := bp.Flush(); err != under.err || len(failed) != 1 || failed[0] != "k/b" {
+		t.Errorf("error should be reported, %v %v", err, failed)
+	}
+	//retried, unless written again
+	bp.Save("k", "c", nil)
+	bp.Flush()
+	bp.Save("k", "c", []byte("new"))
+	under.err = nil
+	if err := bp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if datas, _ := under.LoadAll("k"); len(datas) != 3 || datas["b"] == nil || string(datas["c"]) != "new" {
+		t.Errorf("failed writes not retried: %q", datas)
+	}
+}
+
+func TestBatchPersistSize(t *testing.T) {
+	under := &countPersist{memPersist: NewMemPersist()}
+	bp := NewBatchPersist(under, time.Hour, 2, nil)
+	bp.Save("k", "a", nil)
+	bp.Save("k", "b", nil)
+	for i := 0; i < 100; i++ {
+		if datas, _ := under.LoadAll("k"); len(datas) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bp.Save("k", "c", nil)
+	bp.Close()
+	if datas, _ := under.LoadAll("k"); len(datas) != 3 {
+		t.Errorf("want 3 flushed actual %d", len(datas))
+	}
+	if err := bp.Save("k", "d", nil); err != ErrClosed {
+		t.Errorf("want ErrClosed actual %v", err)
+	}
+}
@@ -0,0 +1,434 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrCorrupt = errors.New("Persisted data corrupt")
+
+// errTorn is returned by readRecord for a record cut by the end of the file.
+var errTorn = errors.New("record torn")
+
+const (
+	opSave   = byte(1)
+	opDelete = byte(2)
+
+	compactMinSize = 1 << 20
+	tornTailMax    = 1 << 20 //of a record broken by a crash, dropped on loading
+)
+
+// SyncPolicy decides when the writes of the file persister are flushed to disk.
+type SyncPolicy time.Duration
+
+const (
+	// SyncAlways flushes on every write, nothing acknowledged is lost on crash.
+	SyncAlways = SyncPolicy(0)
+	// SyncNever leaves flushing to the operating system.
+	SyncNever = SyncPolicy(-1)
+)
+
+// SyncEvery flushes at most once every d, a crash loses the writes of the
+// last d at most.
+func SyncEvery(d time.Duration) SyncPolicy {
+	if d <= 0 {
+		return SyncAlways
+	}
+	return SyncPolicy(d)
+}
+
+// filePersist is a Persister keeping the data in an append-only log file,
+// which is compacted when the obsolete records take more than half of it.
+// The whole data is also held in memory for reading.
+type filePersist struct {
+	sync.Mutex
+	path   string
+	policy SyncPolicy
+	f      *os.File
+	w      *bufio.Writer
+	size   int64 //size of the log file
+	live   int64 //size of the records still valid
+	dirty  bool  //written but not flushed to disk
+	closed bool
+	exitch chan struct{}
+
+	data map[string]map[string][]byte //key->field->data
+}
+
+// NewFilePersist opens the log file at path, creating it if not exist, and
+// loads all the data. A record broken by a crash at the end of the file, in
+// its last tornTailMax bytes, is dropped, while a broken one followed by
+// others fails with ErrCorrupt, so that the valid records after it are not
+// lost.
+func NewFilePersist(path string, policy SyncPolicy) (*filePersist, error) {
+	fp := &filePersist{
+		path:   path,
+		policy: policy,
+		exitch: make(chan struct{}),
+		data:   make(map[string]map[string][]byte),
+	}
+	if err := fp.load(); err != nil {
+		return nil, err
+	}
+	if policy > 0 {
+		go fp.syncLoop(time.Duration(policy))
+	}
+	return fp, nil
+}
+
+func (fp *filePersist) load() error {
+	f, err := os.OpenFile(fp.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r := bufio.NewReader(f)
+	var off int64
+	for {
+		op, key, field, data, n, err := readRecord(r, st.Size()-off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !tornTail(f, err, r, off, st.Size()) {
+				f.Close()
+				return fmt.Errorf("%w: %s at offset %d", ErrCorrupt, fp.path, off)
+			}
+			//the tail was not written completely
+			if err = f.Truncate(off); err != nil {
+				f.Close()
+				return err
+			}
+			break
+		}
+		off += n
+		fp.apply(op, key, field, data, n)
+	}
+	if _, err = f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	fp.f = f
+	fp.w = bufio.NewWriter(f)
+	fp.size = off
+	return nil
+}
+
+// tornTail reports whether the record failed to be read at off by err is the
+// last one, not written completely: cut by the end of the file, or with the
+// end of the file right after it, in the last tornTailMax bytes, and no valid
+// record after its start.
+func tornTail(f *os.File, err error, r *bufio.Reader, off, size int64) bool {
+	if size-off > tornTailMax {
+		return false
+	}
+	if err != errTorn {
+		if _, err = r.Peek(1); err != io.EOF {
+			return false
+		}
+	}
+	tail := make([]byte, size-off)
+	if _, err = f.ReadAt(tail, off); err != nil {
+		return false
+	}
+	for i := 1; i < len(tail); i++ {
+		if _, _, _, _, _, err = readRecord(bufio.NewReader(bytes.NewReader(tail[i:])), int64(len(tail)-i)); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// apply updates the data in memory with a record of n bytes.
+func (fp *filePersist) apply(op byte, key, field string, data []byte, n int64) {
+	m := fp.data[key]
+	if old, ok := m[field]; ok {
+		fp.live -= recordSize(key, field, old)
+	}
+	switch op {
+	case opSave:
+		if m == nil {
+			m = make(map[string][]byte)
+			fp.data[key] = m
+		}
+		m[field] = data
+		fp.live += n
+	case opDelete:
+		delete(m, field)
+		if len(m) == 0 {
+			delete(fp.data, key)
+		}
+	}
+}
+
+func (fp *filePersist) Save(key, field string, data []byte) error {
+	b := make([]byte, len(data))
+	copy(b, data)
+	return fp.write(opSave, key, field, b)
+}
+func (fp *filePersist) Read(key, field string) (data []byte, err error) {
+	fp.Lock()
+	defer fp.Unlock()
+	if b, ok := fp.data[key][field]; ok {
+		data = make([]byte, len(b))
+		copy(data, b)
+	}
+	return
+}
+func (fp *filePersist) Delete(key, field string) error {
+	fp.Lock()
+	_, ok := fp.data[key][field]
+	fp.Unlock()
+	if !ok {
+		return nil
+	}
+	return fp.write(opDelete, key, field, nil)
+}
+func (fp *filePersist) LoadAll(key string) (datas map[string][]byte, err error) {
+	fp.Lock()
+	defer fp.Unlock()
+	datas = make(map[string][]byte)
+	for k, v := range fp.data[key] {
+		b := make([]byte, len(v))
+		copy(b, v)
+		datas[k] = b
+	}
+	return
+}
+
+func (fp *filePersist) write(op byte, key, field string, data []byte) error {
+	fp.Lock()
+	defer fp.Unlock()
+	if fp.closed {
+		return ErrClosed
+	}
+	n, err := writeRecord(fp.w, op, key, field, data)
+	if err == nil {
+		err = fp.w.Flush()
+	}
+	if err == nil && fp.policy == SyncAlways {
+		fp.dirty = true
+		err = fp.sync()
+	}
+	if err != nil {
+		//applied to the data once written only
+		fp.rollback()
+		return err
+	}
+	fp.dirty = fp.policy != SyncAlways
+	fp.size += n
+	fp.apply(op, key, field, data, n)
+	if fp.size > compactMinSize && fp.size > fp.live*2 {
+		//saved already, compacted on a later write
+		if err = fp.compact(); err != nil {
+			logger.Error("file persist compact fail", "path", fp.path, "err", err)
+		}
+	}
+	return nil
+}
+
+// rollback drops the record written partly, if any, after the last one
+// applied.
+func (fp *filePersist) rollback() {
+	if err := fp.f.Truncate(fp.size); err != nil {
+		logger.Error("file persist rollback fail", "path", fp.path, "err", err)
+	}
+	fp.f.Seek(fp.size, io.SeekStart)
+	fp.w = bufio.NewWriter(fp.f)
+}
+
+func (fp *filePersist) sync() error {
+	if !fp.dirty {
+		return nil
+	}
+	fp.dirty = false
+	return fp.f.Sync()
+}
+
+func (fp *filePersist) syncLoop(d time.Duration) {
+	tk := time.NewTicker(d)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			fp.Lock()
+			if !fp.closed {
+				fp.sync()
+			}
+			fp.Unlock()
+		case <-fp.exitch:
+			return
+		}
+	}
+}
+
+// Compact rewrites the log file with the valid records only.
+func (fp *filePersist) Compact() error {
+	fp.Lock()
+	defer fp.Unlock()
+	if fp.closed {
+		return ErrClosed
+	}
+	return fp.compact()
+}
+
+func (fp *filePersist) compact() error {
+	tmp := fp.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var size int64
+	for key, m := range fp.data {
+		for field, data := range m {
+			n, err := writeRecord(w, opSave, key, field, data)
+			if err != nil {
+				f.Close()
+				os.Remove(tmp)
+				return err
+			}
+			size += n
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, fp.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(fp.path))
+
+	fp.f.Close()
+	fp.f = f
+	fp.w = bufio.NewWriter(f)
+	fp.size = size
+	fp.live = size
+	fp.dirty = false
+	return nil
+}
+
+// Close flushes the data to disk and closes the log file.
+func (fp *filePersist) Close() error {
+	fp.Lock()
+	defer fp.Unlock()
+	if fp.closed {
+		return nil
+	}
+	fp.closed = true
+	close(fp.exitch)
+	fp.dirty = true
+	err := fp.sync()
+	if err2 := fp.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// A record is laid out as:
+//
+//	op(1) | key length | field length | data length | key | field | data | crc32(4)
+//
+// the lengths are encoded as uvarint, the crc32 covers all the bytes before it.
+func writeRecord(w io.Writer, op byte, key, field string, data []byte) (n int64, err error) {
+	b := make([]byte, 1, 1+3*binary.MaxVarintLen64+len(key)+len(field)+len(data)+4)
+	b[0] = op
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = binary.AppendUvarint(b, uint64(len(field)))
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	b = append(b, key...)
+	b = append(b, field...)
+	b = append(b, data...)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	m, err := w.Write(b)
+	return int64(m), err
+}
+
+// readRecord reads a record of r, whose bytes left are left, unknown if
+// negative.
+func readRecord(r *bufio.Reader, left int64) (op byte, key, field string, data []byte, n int64, err error) {
+	op, err = r.ReadByte()
+	if err != nil {
+		return //io.EOF, between the records
+	}
+	if op != opSave && op != opDelete {
+		err = ErrCorrupt
+		return
+	}
+	head := []byte{op}
+	var l [3]uint64
+	for i := range l {
+		l[i], err = binary.ReadUvarint(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errTorn
+			return
+		}
+		if err != nil {
+			err = ErrCorrupt
+			return
+		}
+		head = binary.AppendUvarint(head, l[i])
+	}
+	if l[0]+l[1]+l[2] > 1<<31 {
+		err = ErrCorrupt
+		return
+	}
+	if left >= 0 && uint64(len(head))+l[0]+l[1]+l[2]+4 > uint64(left) {
+		err = errTorn
+		return
+	}
+	body := make([]byte, l[0]+l[1]+l[2]+4)
+	if _, err = io.ReadFull(r, body); err != nil {
+		err = errTorn
+		return
+	}
+	content := body[:len(body)-4]
+	sum := crc32.Update(crc32.ChecksumIEEE(head), crc32.IEEETable, content)
+	if sum != binary.BigEndian.Uint32(body[len(body)-4:]) {
+		err = ErrCorrupt
+		return
+	}
+	key = string(content[:l[0]])
+	field = string(content[l[0] : l[0]+l[1]])
+	if op == opSave {
+		data = content[l[0]+l[1]:]
+	}
+	n = int64(len(head) + len(body))
+	return
+}
+
+func recordSize(key, field string, data []byte) int64 {
+	var b [binary.MaxVarintLen64]byte
+	n := 1 + len(key) + len(field) + len(data) + 4
+	n += binary.PutUvarint(b[:], uint64(len(key)))
+	n += binary.PutUvarint(b[:], uint64(len(field)))
+	n += binary.PutUvarint(b[:], uint64(len(data)))
+	return int64(n)
+}
@@ -0,0 +1,104 @@
+package mqtt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilePersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.db")
+	fp, err := NewFilePersist(path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Save("k1", "a", []byte("1"))
+	fp.Save("k1", "b", []byte("2"))
+	fp.Save("k1", "a", []byte("3"))
+	fp.Save("k2", "a", []byte("4"))
+	fp.Delete("k2", "a")
+	fp.Close()
+
+	//a record broken at the tail
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{opSave, 2, 1, 5, 'k'})
+	f.Close()
+
+	fp, err = NewFilePersist(path, SyncEvery(1e9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	datas, _ := fp.LoadAll("k1")
+	if len(datas) != 2 || string(datas["a"]) != "3" || string(datas["b"]) != "2" {
+		t.Errorf("load all err: %v", datas)
+	}
+	if data, _ := fp.Read("k2", "a"); data != nil {
+		t.Errorf("want deleted actual %s", data)
+	}
+	if err = fp.Save("k2", "c", []byte("5")); err != nil {
+		t.Errorf("save after truncating err: %v", err)
+	}
+
+	if err = fp.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if fp.size != fp.live {
+		t.Errorf("compact err, size %d live %d", fp.size, fp.live)
+	}
+	fp.Save("k1", "d", []byte("6"))
+	fp.Close()
+
+	//a write failed not applied
+	fp, _ = NewFilePersist(path, SyncNever)
+	fp.f.Close()
+	if err = fp.Save("k1", "e", []byte("7")); err == nil {
+		t.Errorf("saved to a file closed")
+	}
+	if data, _ := fp.Read("k1", "e"); data != nil {
+		t.Errorf("write failed applied")
+	}
+	fp, _ = NewFilePersist(path, SyncNever)
+	defer fp.Close()
+	for _, v := range []struct{ key, field, want string }{
+		{"k1", "a", "3"}, {"k1", "b", "2"}, {"k1", "d", "6"}, {"k2", "c", "5"},
+	} {
+		if data, _ := fp.Read(v.key, v.field); string(data) != v.want {
+			t.Errorf("%s/%s want %s actual %s", v.key, v.field, v.want, data)
+		}
+	}
+}
+
+func TestFilePersistCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.db")
+	fp, err := NewFilePersist(path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Save("k", "a", []byte("1"))
+	fp.Save("k", "b", []byte("2"))
+	fp.Close()
+
+	//a record broken in the middle
+	b, _ := os.ReadFile(path)
+	b[len(b)/2-1] ^= 0xff
+	os.WriteFile(path, b, 0644)
+	if _, err = NewFilePersist(path, SyncNever); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("want ErrCorrupt actual %v", err)
+	}
+	if after, _ := os.ReadFile(path); len(after) != len(b) {
+		t.Errorf("truncated from %d to %d", len(b), len(after))
+	}
+
+	//a length broken in the middle, reaching past the end
+	b[len(b)/2-1] ^= 0xff
+	b[3] = 0x7f
+	os.WriteFile(path, b, 0644)
+	if _, err = NewFilePersist(path, SyncNever); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("want ErrCorrupt actual %v", err)
+	}
+	if after, _ := os.ReadFile(path); len(after) != len(b) {
+		t.Errorf("truncated from %d to %d", len(b), len(after))
+	}
+}
@@ -0,0 +1,140 @@
+package mqtt
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// memPersist is a Persister keeping the data in memory only, for tests and
+// brokers which need no durability. The data can be snapshotted to a file
+// and restored from it.
+type memPersist struct {
+	sync.RWMutex
+	data map[string]map[string][]byte //key->field->data
+}
+
+func NewMemPersist() *memPersist {
+	return &memPersist{
+		data: make(map[string]map[string][]byte),
+	}
+}
+
+func (mp *memPersist) Save(key, field string, data []byte) error {
+	b := make([]byte, len(data))
+	copy(b, data)
+	mp.Lock()
+	m := mp.data[key]
+	if m == nil {
+		m = make(map[string][]byte)
+		mp.data[key] = m
+	}
+	m[field] = b
+	mp.Unlock()
+	return nil
+}
+func (mp *memPersist) Read(key, field string) (data []byte, err error) {
+	mp.RLock()
+	defer mp.RUnlock()
+	if b, ok := mp.data[key][field]; ok {
+		data = make([]byte, len(b))
+		copy(data, b)
+	}
+	return
+}
+func (mp *memPersist) Delete(key, field string) error {
+	mp.Lock()
+	if m, ok := mp.data[key]; ok {
+		delete(m, field)
+		if len(m) == 0 {
+			delete(mp.data, key)
+		}
+	}
+	mp.Unlock()
+	return nil
+}
+func (mp *memPersist) LoadAll(key string) (datas map[string][]byte, err error) {
+	mp.RLock()
+	defer mp.RUnlock()
+	datas = make(map[string][]byte)
+	for k, v := range mp.data[key] {
+		b := make([]byte, len(v))
+		copy(b, v)
+		datas[k] = b
+	}
+	return
+}
+
+// Snapshot writes all the data to the file at path, replacing it atomically.
+// The file has the same format as the log of the file persister.
+func (mp *memPersist) Snapshot(path string) error {
+	tmp := path + ".snapshot"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	mp.RLock()
+	for key, m := range mp.data {
+		for field, data := range m {
+			if _, err = writeRecord(w, opSave, key, field, data); err != nil {
+				break
+			}
+		}
+	}
+	mp.RUnlock()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Restore replaces all the data with the snapshot at path.
+func (mp *memPersist) Restore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := make(map[string]map[string][]byte)
+	r := bufio.NewReader(f)
+	for {
+		op, key, field, b, _, err := readRecord(r, -1)
+		if err == io.EOF {
+			break
+		}
+		if err == errTorn {
+			return ErrCorrupt
+		}
+		if err != nil {
+			return err
+		}
+		if op != opSave {
+			continue
+		}
+		if data[key] == nil {
+			data[key] = make(map[string][]byte)
+		}
+		data[key][field] = b
+	}
+	mp.Lock()
+	mp.data = data
+	mp.Unlock()
+	return nil
+}
@@ -0,0 +1,31 @@
+package mqtt
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMemPersistSnapshot(t *testing.T) {
+	mp := NewMemPersist()
+	mp.Save("k1", "a", []byte("1"))
+	mp.Save("k1", "b", []byte("2"))
+	mp.Save("k2", "a", []byte("3"))
+	mp.Delete("k2", "a")
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := mp.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	mp.Save("k1", "c", []byte("4"))
+
+	if err := mp.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	datas, _ := mp.LoadAll("k1")
+	if len(datas) != 2 || string(datas["a"]) != "1" || string(datas["b"]) != "2" {
+		t.Errorf("restore err: %v", datas)
+	}
+	if datas, _ = mp.LoadAll("k2"); len(datas) != 0 {
+		t.Errorf("want empty actual %v", datas)
+	}
+}
@@ -0,0 +1,29 @@
+package mqtt
+
+import (
+	"time"
+
+	"hilldan/mqtt/packet"
+)
+
+// EncodeRetain encodes a retained packet with the time it is stored:
+//
+//	stored(8 bytes unix nano) | packet in MQTT wire format
+func EncodeRetain(p packet.PublishPacket, stored time.Time) ([]byte, error) {
+	data, err := EncodePublish(p)
+	if err != nil {
+		return nil, err
+	}
+	return append(encodeTime(stored), data...), nil
+}
+
+// DecodeRetain decodes a retained packet encoded by EncodeRetain.
+func DecodeRetain(data []byte) (p packet.PublishPacket, stored time.Time, err error) {
+	if len(data) < 8 {
+		err = ErrCorrupt
+		return
+	}
+	stored, _ = decodeTime(data[:8])
+	p, err = DecodePublish(data[8:])
+	return
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminHandler returns the HTTP/JSON API managing the broker, every request
+// of which has to carry the header "Authorization: Bearer <token>":
+//
+//	GET    /clients                         clients connected or with a session
+//	GET    /clients/{id}                    a client
+//	DELETE /clients/{id}                    kick a client connected
+//	GET    /clients/{id}/subscriptions      subscriptions of a client
+//	DELETE /clients/{id}/subscriptions?topic=a/b
+//	GET    /retained?filter=a/#             retained messages, all by default
+//	PUT    /retained                        retain an AdminMessage
+//	DELETE /retained?topic=a/b
+//	POST   /publish                         publish an AdminMessage
+//	GET    /scheduled                       messages scheduled, see ScheduleAt
+//	DELETE /scheduled/{id}                  cancel a message scheduled
+//	GET    /history?filter=a/#&since=seq:1  history kept, see SetHistoryFor
+func AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		route(w, r, map[string]http.HandlerFunc{"GET": adminClients})
+	})
+	mux.HandleFunc("/clients/", func(w http.ResponseWriter, r *http.Request) {
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/clients/"), "/")
+		r.SetPathValue("id", id)
+		switch sub {
+		case "":
+			route(w, r, map[string]http.HandlerFunc{"GET": adminClient, "DELETE": adminKick})
+		case "subscriptions":
+			route(w, r, map[string]http.HandlerFunc{"GET": adminSubscriptions, "DELETE": adminUnsubscribe})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/retained", func(w http.ResponseWriter, r *http.Request) {
+		route(w, r, map[string]http.HandlerFunc{"GET": adminRetained, "PUT": adminRetain, "DELETE": adminUnretain})
+	})
+	mux.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) {
+		route(w, r, map[string]http.HandlerFunc{"POST": adminPublish})
+	})
+	mux.HandleFunc("/scheduled", func(w http.ResponseWriter, r *http.Request) {
+		route(w, r, map[string]http.HandlerFunc{"GET": adminScheduled})
+	})
+	mux.HandleFunc("/scheduled/", func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("id", strings.TrimPrefix(r.URL.Path, "/scheduled/"))
+		route(w, r, map[string]http.HandlerFunc{"DELETE": adminCancel})
+	})
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		route(w, r, map[string]http.HandlerFunc{"GET": adminHistory})
+	})
+
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if token == "" || subtle.ConstantTimeCompare(got, want) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// route calls the handler of the method of r.
+func route(w http.ResponseWriter, r *http.Request, handlers map[string]http.HandlerFunc) {
+	h, ok := handlers[r.Method]
+	if !ok {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	h(w, r)
+}
+
+// AdminClient is a client in the admin API.
+type AdminClient struct {
+	ClientId      string               `json:"client_id"`
+	Connected     bool                 `json:"connected"`
+	RemoteAddr    string               `json:"remote_addr,omitempty"`
+	Saved         time.Time            `json:"saved,omitempty"` //when the session was saved last
+	Subscriptions []packet.TopicFilter `json:"subscriptions,omitempty"`
+	Inflight      int                  `json:"inflight"` //messages sent, not acknowledged
+	PendingIn     int                  `json:"pending_in"`
+}
+
+// AdminMessage is an application message in the admin API.
+type AdminMessage struct {
+	Topic   string      `json:"topic"`
+	Payload []byte      `json:"payload"` //base64 in json
+	Qos     packet.Bit2 `json:"qos"`
+	Retain  bool        `json:"retain,omitempty"`
+	Stored  *time.Time  `json:"stored,omitempty"` //of the retained one
+}
+
+// AdminScheduled is a message scheduled in the admin API.
+type AdminScheduled struct {
+	Id uint64    `json:"id"`
+	At time.Time `json:"at"`
+	AdminMessage
+}
+
+// AdminHistory is a message of the history in the admin API.
+type AdminHistory struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	AdminMessage
+}
+
+func newMessage(p packet.PublishPacket) AdminMessage {
+	return AdminMessage{
+		Topic:   string(p.TopicName),
+		Payload: []byte(p.ApplicationMessage),
+		Qos:     p.Qos,
+		Retain:  bool(p.Retain),
+	}
+}
+
+func (m AdminMessage) publishPacket() packet.PublishPacket {
+	return packet.PublishPacket{
+		Qos:                m.Qos,
+		Retain:             packet.Bool(m.Retain),
+		TopicName:          packet.String(m.Topic),
+		ApplicationMessage: packet.String(m.Payload),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func describe(clientId string, s *mqtt.Session) AdminClient {
+	a := AdminClient{ClientId: clientId}
+	if s == nil {
+		return a
+	}
+	a.Subscriptions = s.GetSubscription()
+	s.RLock()
+	a.Inflight = len(s.PubOut)
+	a.PendingIn = len(s.PubIn)
+	s.RUnlock()
+	return a
+}
+
+// findClient describes the client connected or persisted, of the times the
+// sessions were saved if loaded already, nil to read the one of clientId.
+func findClient(clientId string, saved map[string]time.Time) (a AdminClient, ok bool, err error) {
+	if c, ok := ConnRegistry.Get(clientId); ok {
+		a = describe(clientId, c.session)
+		a.Connected = true
+		if addr := c.cnn.RemoteAddr(); addr != nil {
+			a.RemoteAddr = addr.String()
+		}
+		return a, true, nil
+	}
+	s, err := mqtt.LoadSession(KeySession, clientId, persister)
+	if err != nil || s == nil {
+		return
+	}
+	a = describe(clientId, s)
+	if saved != nil {
+		a.Saved = saved[clientId]
+		return a, true, nil
+	}
+	raw, err := persister.Read(KeySession, clientId)
+	a.Saved, _ = mqtt.SessionSaved(KeySession, clientId, raw, persister)
+	return a, true, err
+}
+
+func adminClients(w http.ResponseWriter, r *http.Request) {
+	saved, err := mqtt.SessionsSaved(KeySession, persister)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ids := make(map[string]bool, len(saved))
+	for k := range saved {
+		ids[k] = true
+	}
+	ConnRegistry.RLock()
+	for k := range ConnRegistry.Conns {
+		ids[k] = true
+	}
+	ConnRegistry.RUnlock()
+
+	clients := make([]AdminClient, 0, len(ids))
+	for k := range ids {
+		a, ok, err := findClient(k, saved)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if ok {
+			clients = append(clients, a)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ClientId < clients[j].ClientId })
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func adminClient(w http.ResponseWriter, r *http.Request) {
+	a, ok, err := findClient(r.PathValue("id"), nil)
+	switch {
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	case !ok:
+		writeError(w, http.StatusNotFound, errors.New("client not found"))
+	default:
+		writeJSON(w, http.StatusOK, a)
+	}
+}
+
+func adminKick(w http.ResponseWriter, r *http.Request) {
+	c, ok := ConnRegistry.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("client not connected"))
+		return
+	}
+	c.Close("kicked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminSubscriptions(w http.ResponseWriter, r *http.Request) {
+	a, ok, err := findClient(r.PathValue("id"), nil)
+	switch {
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	case !ok:
+		writeError(w, http.StatusNotFound, errors.New("client not found"))
+	default:
+		if a.Subscriptions == nil {
+			a.Subscriptions = []packet.TopicFilter{}
+		}
+		writeJSON(w, http.StatusOK, a.Subscriptions)
+	}
+}
+
+func adminUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	clientId, topic := r.PathValue("id"), r.URL.Query().Get("topic")
+	if topic == "" {
+		writeError(w, http.StatusBadRequest, errors.New("topic required"))
+		return
+	}
+	filters := []packet.String{packet.String(topic)}
+	//not connecting meanwhile, nor its session expiring
+	unlock := clientLocks.lock(clientId)
+	defer unlock()
+	if c, ok := ConnRegistry.Get(clientId); ok {
+		c.unsubscribe(filters)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	s, err := mqtt.LoadSession(KeySession, clientId, persister)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if s == nil {
+		writeError(w, http.StatusNotFound, errors.New("client not found"))
+		return
+	}
+	s.Unsubscription(filters)
+	emit(Event{Type: EventUnsubscribed, ClientId: clientId, Filters: []string{topic}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminRetained(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+	if _, err := WildcardRegistry.Get(filter); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, retainedMessages(filter))
+}
+
+// retainedMessages returns the retained messages matched by filter, not
+// expired, sorted by topic.
+func retainedMessages(filter string) []AdminMessage {
+	now := time.Now()
+	msgs := make([]AdminMessage, 0)
+	RetainRegistry.RLock()
+	for _, k := range RetainRegistry.tree.Match(filter) {
+		m := RetainRegistry.meta[k]
+		if m.expired(k, now) {
+			continue
+		}
+		msg := newMessage(RetainRegistry.PubRetain[k])
+		msg.Topic, msg.Retain = k, true
+		stored := m.stored
+		msg.Stored = &stored
+		msgs = append(msgs, msg)
+	}
+	RetainRegistry.RUnlock()
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Topic < msgs[j].Topic })
+	return msgs
+}
+
+// readMessage reads the AdminMessage in the body of r.
+func readMessage(r *http.Request) (p packet.PublishPacket, err error) {
+	var m AdminMessage
+	if err = json.NewDecoder(r.Body).Decode(&m); err != nil {
+		return
+	}
+	if m.Qos > packet.QoS2 {
+		err = errors.New("invalid qos")
+		return
+	}
+	if ok, _ := check(m.Topic); !ok || strings.ContainsAny(m.Topic, "+#") {
+		err = errors.New("invalid topic: " + m.Topic)
+		return
+	}
+	p = m.publishPacket()
+	return
+}
+
+func adminRetain(w http.ResponseWriter, r *http.Request) {
+	p, err := readMessage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p.Retain = true
+	if err = RetainRegistry.Add(string(p.TopicName), p); err != nil {
+		writeError(w, publishStatus(err), err)
+		return
+	}
+	cluster.retain(newMessage(p))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminUnretain(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if _, ok := RetainRegistry.Get(topic); !ok {
+		writeError(w, http.StatusNotFound, errors.New("retained message not found"))
+		return
+	}
+	RetainRegistry.Remove(topic)
+	cluster.retain(AdminMessage{Topic: topic})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminPublish(w http.ResponseWriter, r *http.Request) {
+	p, err := readMessage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = inject(p, AdminPublisher); err != nil {
+		writeError(w, publishStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publishStatus returns the status of the error of publishing or retaining.
+func publishStatus(err error) int {
+	if err == ErrRetainFull {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+func adminScheduled(w http.ResponseWriter, r *http.Request) {
+	msgs := make([]AdminScheduled, 0)
+	for _, m := range Scheduled() {
+		msgs = append(msgs, AdminScheduled{m.Id, m.At, newMessage(m.Packet)})
+	}
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+func adminCancel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+		return
+	}
+	switch err = CancelScheduled(id); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrNotScheduled:
+		writeError(w, http.StatusNotFound, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func adminHistory(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+	if _, err := WildcardRegistry.Get(filter); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var seq uint64
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if seq, since, err = parseSince(s); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid since"))
+			return
+		}
+	}
+	msgs := make([]AdminHistory, 0)
+	for _, m := range History(filter, seq, since) {
+		msgs = append(msgs, AdminHistory{m.Seq, m.Time, newMessage(m.Packet)})
+	}
+	writeJSON(w, http.StatusOK, msgs)
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConn registers a connection of clientId, whose peer is discarded.
+func testConn(t *testing.T, clientId string) *mqttConn {
+	cnn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	c := &mqttConn{
+		clientId: clientId,
+		cnn:      cnn,
+		writech:  make(chan packet.ControlPacketer, 10),
+		exitch:   make(chan struct{}),
+		pingch:   make(chan struct{}, 10),
+		session:  mqtt.NewSession(),
+	}
+	c.session.Bind(KeySession, clientId, persister)
+	ConnRegistry.Add(clientId, c)
+	t.Cleanup(func() { c.closeConn("test", false) })
+	return c
+}
+
+func adminDo(t *testing.T, h http.Handler, method, url, body string, v interface{}) int {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v %s", method, url, err, w.Body)
+		}
+	}
+	return w.Code
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := AdminHandler("secret")
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		r := httptest.NewRequest("GET", "/clients", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("'%s' want 401 actual %d", auth, w.Code)
+		}
+	}
+}
+
+func TestAdminClients(t *testing.T) {
+	initPersister()
+	h := AdminHandler("secret")
+
+	c := testConn(t, "online")
+	c.session.AddSubscription([]packet.TopicFilter{{Topic: "a/#", Qos: 1}, {Topic: "b", Qos: 0}})
+	c.session.AddPubOut(1, packet.PublishPacket{Qos: 1, TopicName: "a", PacketId: 1})
+	s := mqtt.NewSession()
+	s.AddSubscription([]packet.TopicFilter{{Topic: "x", Qos: 2}})
+	s.Bind(KeySession, "offline", persister)
+
+	var clients []AdminClient
+	if code := adminDo(t, h, "GET", "/clients", "", &clients); code != 200 || len(clients) != 2 {
+		t.Fatalf("%d %+v", code, clients)
+	}
+	if !clients[1].Connected || clients[1].Inflight != 1 || clients[0].Connected || clients[0].Saved.IsZero() {
+		t.Errorf("clients %+v", clients)
+	}
+
+	var a AdminClient
+	if code := adminDo(t, h, "GET", "/clients/missing", "", nil); code != 404 {
+		t.Errorf("want 404 actual %d", code)
+	}
+	var subs []packet.TopicFilter
+	adminDo(t, h, "GET", "/clients/online/subscriptions", "", &subs)
+	if len(subs) != 2 {
+		t.Errorf("subscriptions %v", subs)
+	}
+
+	es := make(chanSink, 10)
+	old := sinks
+	sinks = []EventSink{es}
+	defer func() { sinks = old }()
+	if code := adminDo(t, h, "DELETE", "/clients/online/subscriptions?topic=b", "", nil); code != 204 {
+		t.Errorf("want 204 actual %d", code)
+	}
+	if code := adminDo(t, h, "DELETE", "/clients/offline/subscriptions?topic=x", "", nil); code != 204 {
+		t.Errorf("want 204 actual %d", code)
+	}
+	for _, id := range []string{"online", "offline"} {
+		if e := <-es; e.Type != EventUnsubscribed || e.ClientId != id || len(e.Filters) != 1 {
+			t.Errorf("emitted %+v", e)
+		}
+	}
+	adminDo(t, h, "GET", "/clients/online", "", &a)
+	if len(a.Subscriptions) != 1 {
+		t.Errorf("not unsubscribed: %+v", a)
+	}
+	if s, _ := mqtt.LoadSession(KeySession, "offline", persister); len(s.Subscript) != 0 {
+		t.Errorf("offline session not unsubscribed: %v", s.Subscript)
+	}
+
+	if code := adminDo(t, h, "DELETE", "/clients/online", "", nil); code != 204 {
+		t.Errorf("kick want 204 actual %d", code)
+	}
+	if _, ok := ConnRegistry.Get("online"); ok {
+		t.Errorf("client not kicked")
+	}
+}
+
+func TestAdminRetained(t *testing.T) {
+	initPersister()
+	h := AdminHandler("secret")
+
+	for _, topic := range []string{"a/1", "a/2", "b"} {
+		body := `{"topic":"` + topic + `","payload":"aGVsbG8=","qos":1}`
+		if code := adminDo(t, h, "PUT", "/retained", body, nil); code != 204 {
+			t.Errorf("want 204 actual %d", code)
+		}
+	}
+	if code := adminDo(t, h, "PUT", "/retained", `{"topic":"a/+","payload":"eA=="}`, nil); code != 400 {
+		t.Errorf("wildcard topic want 400 actual %d", code)
+	}
+
+	var msgs []AdminMessage
+	adminDo(t, h, "GET", "/retained?filter=a/%2B", "", &msgs)
+	if len(msgs) != 2 || msgs[0].Topic != "a/1" || string(msgs[0].Payload) != "hello" || msgs[0].Qos != 1 || msgs[0].Stored == nil {
+		t.Errorf("retained %+v", msgs)
+	}
+
+	if code := adminDo(t, h, "DELETE", "/retained?topic=b", "", nil); code != 204 {
+		t.Errorf("want 204 actual %d", code)
+	}
+	if code := adminDo(t, h, "DELETE", "/retained?topic=b", "", nil); code != 404 {
+		t.Errorf("want 404 actual %d", code)
+	}
+
+	c := testConn(t, "sub")
+	c.session.AddSubscription([]packet.TopicFilter{{Topic: "c", Qos: 1}})
+	if code := adminDo(t, h, "POST", "/publish", `{"topic":"c","payload":"eA==","qos":1,"retain":true}`, nil); code != 204 {
+		t.Errorf("want 204 actual %d", code)
+	}
+	select {
+	case p := <-c.writech:
+		if pp := p.(*packet.PublishPacket); pp.TopicName != "c" || pp.ApplicationMessage != "x" {
+			t.Errorf("published %+v", pp)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("not published")
+	}
+	if _, ok := RetainRegistry.Get("c"); !ok {
+		t.Errorf("not retained")
+	}
+
+	//full, the same by retaining or publishing
+	SetRetainLimits(1, 0, EvictRejectNew)
+	defer SetRetainLimits(0, 0, EvictOldest)
+	for _, v := range []struct{ method, url string }{{"PUT", "/retained"}, {"POST", "/publish"}} {
+		if code := adminDo(t, h, v.method, v.url, `{"topic":"d","payload":"eA==","retain":true}`, nil); code != 507 {
+			t.Errorf("%s want 507 actual %d", v.url, code)
+		}
+	}
+}
+
+func TestAdminPublish(t *testing.T) {
+	initPersister()
+	h := AdminHandler("secret")
+	s := make(chanSink, 10)
+	old := sinks
+	sinks = []EventSink{s}
+	defer func() { sinks = old }()
+	b := &Bridge{Out: []BridgeRule{{Filter: "c", Qos: 1}}}
+	if err := AddBridge(b); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := testConn(t, "sub")
+	c.session.AddSubscription([]packet.TopicFilter{{Topic: "c", Qos: 1}})
+	if code := adminDo(t, h, "POST", "/publish", `{"topic":"c","payload":"eA==","qos":1}`, nil); code != 204 {
+		t.Fatalf("want 204 actual %d", code)
+	}
+	var pp *packet.PublishPacket
+	select {
+	case p := <-c.writech:
+		pp = p.(*packet.PublishPacket)
+	case <-time.After(time.Second):
+		t.Fatal("not published")
+	}
+	select {
+	case e := <-s:
+		if e.Type != EventPublished || e.ClientId != AdminPublisher || e.Topic != "c" {
+			t.Errorf("emitted %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("not emitted")
+	}
+	if len(b.queue) != 1 {
+		t.Errorf("not forwarded by the bridge")
+	}
+	if msgLog.Len() != 1 {
+		t.Fatalf("want 1 logged actual %d", msgLog.Len())
+	}
+	handlePacket(&packet.PubackPacket{PacketId: pp.PacketId}, c, nil)
+	if msgLog.Len() != 0 {
+		t.Errorf("not acknowledged in the log")
+	}
+}
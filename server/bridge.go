@@ -0,0 +1,252 @@
+package server
+
+import (
+	"errors"
+	"hilldan/mqtt"
+	"hilldan/mqtt/client"
+	"hilldan/mqtt/connection"
+	"hilldan/mqtt/packet"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBridgeExists is returned by AddBridge for the second bridge.
+var ErrBridgeExists = errors.New("bridge exists")
+
+// BridgeRule selects the messages forwarded by a bridge.
+type BridgeRule struct {
+	Filter string      //topic filter of the messages
+	Qos    packet.Bit2 //the highest QoS on the other side
+	Prefix string      //removed from the topic, if it starts with
+	Remap  string      //prepended to the topic, after Prefix removed
+}
+
+// topic returns the topic forwarded of topic.
+func (r BridgeRule) topic(topic string) string {
+	if r.Prefix != "" && strings.HasPrefix(topic, r.Prefix) {
+		topic = topic[len(r.Prefix):]
+	}
+	return r.Remap + topic
+}
+
+// Bridge connects the broker to a remote one as a client. The messages
+// published to the broker by its clients matched by Out are forwarded to the
+// remote broker, and the messages of the remote broker matched by In are
+// published to the broker. The messages coming in are never forwarded out,
+// nor the ones published by the bridge of another broker, see BridgePrefix,
+// so that two brokers can bridge each other.
+type Bridge struct {
+	Remote     connection.Clienter
+	Connect    packet.ConnectPacket //ClientId, KeepAlive, CleanSession and credentials of the bridge, see BridgePrefix
+	Out, In    []BridgeRule
+	Backoff    time.Duration //delay of the first reconnecting, doubled on every failure
+	MaxBackoff time.Duration
+	QueueSize  int //messages waiting to be forwarded out, dropped once full
+
+	queue  chan packet.PublishPacket
+	exitch chan struct{}
+	conn   bridgeConn
+	connl  sync.RWMutex
+}
+
+// BridgePrefix starts the client id of a bridge, prepended by AddBridge if
+// missing. The messages published by such a client are not forwarded by the
+// bridge of the broker receiving them, so that they do not come back.
+const BridgePrefix = "bridge-"
+
+// bridgeConn is the client connection of the bridge.
+type bridgeConn interface {
+	Publish(p packet.PublishPacket) error
+	SubscribeChan(filter string, qos packet.Bit2, bufSize int, policy client.Overflow) (<-chan client.Message, func())
+	Done() <-chan struct{}
+	Close(cause string)
+}
+
+var (
+	bridge  *Bridge
+	bridgel sync.RWMutex
+)
+
+// AddBridge configures b, started by RunMQTT. Only one bridge can be added.
+func AddBridge(b *Bridge) error {
+	bridgel.Lock()
+	defer bridgel.Unlock()
+	if bridge != nil {
+		return ErrBridgeExists
+	}
+	if b.Backoff <= 0 {
+		b.Backoff = time.Second
+	}
+	if b.MaxBackoff < b.Backoff {
+		b.MaxBackoff = time.Minute
+	}
+	if !strings.HasPrefix(string(b.Connect.ClientId), BridgePrefix) {
+		b.Connect.ClientId = BridgePrefix + b.Connect.ClientId
+	}
+	if b.QueueSize <= 0 {
+		b.QueueSize = 1000
+	}
+	b.queue = make(chan packet.PublishPacket, b.QueueSize)
+	b.exitch = make(chan struct{})
+	bridge = b
+	return nil
+}
+
+func getBridge() *Bridge {
+	bridgel.RLock()
+	defer bridgel.RUnlock()
+	return bridge
+}
+
+// startBridge runs the bridge added.
+func startBridge() {
+	b := getBridge()
+	if b == nil {
+		return
+	}
+	go b.run()
+	go b.forward()
+}
+
+// Close disconnects the bridge, and stops reconnecting. Another one can be
+// added then.
+func (b *Bridge) Close() {
+	bridgel.Lock()
+	if bridge == b {
+		bridge = nil
+	}
+	bridgel.Unlock()
+	select {
+	case <-b.exitch:
+		return
+	default:
+	}
+	close(b.exitch)
+	if c := b.getConn(); c != nil {
+		c.Close("bridge closed")
+	}
+}
+
+func (b *Bridge) getConn() bridgeConn {
+	b.connl.RLock()
+	defer b.connl.RUnlock()
+	return b.conn
+}
+
+func (b *Bridge) setConn(c bridgeConn) {
+	b.connl.Lock()
+	b.conn = c
+	b.connl.Unlock()
+}
+
+// run keeps the bridge connected. It waits for the backoff before
+// reconnecting, after a failure as after a disconnection, and the backoff is
+// reset only once a connection stayed up for MaxBackoff, so that a remote
+// dropping the bridge once connected is not redialed in a loop.
+func (b *Bridge) run() {
+	backoff := b.Backoff
+	for {
+		connect := b.Connect
+		c, err := client.Connect(b.Remote, client.Config{Persister: persister, Key: KeyBridge}, &connect)
+		if err != nil {
+			logger.Warn("bridge connect fail", "client_id", string(b.Connect.ClientId), "err", err, "retry", backoff)
+		} else {
+			logger.Info("bridge connected", "client_id", string(b.Connect.ClientId))
+			start := time.Now()
+			b.serve(c)
+			if time.Since(start) >= b.MaxBackoff {
+				backoff = b.Backoff
+			}
+		}
+		select {
+		case <-time.After(backoff):
+		case <-b.exitch:
+			return
+		}
+		if backoff *= 2; backoff > b.MaxBackoff {
+			backoff = b.MaxBackoff
+		}
+	}
+}
+
+// serve receives the messages coming in, till the connection is closed.
+func (b *Bridge) serve(c bridgeConn) {
+	b.setConn(c)
+	defer b.setConn(nil)
+	var cancels []func()
+	for _, r := range b.In {
+		ch, cancel := c.SubscribeChan(r.Filter, r.Qos, b.QueueSize, client.OverflowBlock)
+		cancels = append(cancels, cancel)
+		go b.receive(r, ch)
+	}
+	select {
+	case <-c.Done():
+	case <-b.exitch:
+		c.Close("bridge closed")
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	logger.Info("bridge disconnected", "client_id", string(b.Connect.ClientId))
+}
+
+func (b *Bridge) receive(r BridgeRule, ch <-chan client.Message) {
+	for m := range ch {
+		p := m.PublishPacket
+		p.TopicName = packet.String(r.topic(string(p.TopicName)))
+		if p.Qos > r.Qos {
+			p.Qos = r.Qos
+		}
+		p.Dup = false
+		p.PacketId = 0
+		if err := inject(p, string(b.Connect.ClientId)); err != nil {
+			logger.Warn("bridge publish fail", "topic", string(p.TopicName), "err", err)
+		}
+	}
+}
+
+// out queues p published by the client from to be forwarded, if matched and
+// not published by a bridge.
+func (b *Bridge) out(p packet.PublishPacket, from string) {
+	if b == nil || strings.HasPrefix(from, BridgePrefix) {
+		return
+	}
+	for _, r := range b.Out {
+		if !mqtt.MatchTopic(r.Filter, string(p.TopicName)) {
+			continue
+		}
+		p.TopicName = packet.String(r.topic(string(p.TopicName)))
+		if p.Qos > r.Qos {
+			p.Qos = r.Qos
+		}
+		p.Dup = false
+		p.PacketId = 0
+		select {
+		case b.queue <- p:
+		default:
+			metrics.drop("bridge_full")
+		}
+		return
+	}
+}
+
+// forward publishes the messages queued to the remote broker.
+func (b *Bridge) forward() {
+	for {
+		select {
+		case p := <-b.queue:
+			c := b.getConn()
+			if c == nil {
+				metrics.drop("bridge_offline")
+				continue
+			}
+			if err := c.Publish(p); err != nil {
+				metrics.drop("bridge_offline")
+				logger.Warn("bridge forward fail", "topic", string(p.TopicName), "err", err)
+			}
+		case <-b.exitch:
+			return
+		}
+	}
+}
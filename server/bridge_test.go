@@ -0,0 +1,169 @@
+package server
+
+import (
+	"hilldan/mqtt/connection"
+	"hilldan/mqtt/packet"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBridgeRule(t *testing.T) {
+	r := BridgeRule{Filter: "site/#", Prefix: "site/", Remap: "central/s1/"}
+	for topic, want := range map[string]string{
+		"site/temp":  "central/s1/temp",
+		"site/a/b":   "central/s1/a/b",
+		"other/temp": "central/s1/other/temp",
+	} {
+		if got := r.topic(topic); got != want {
+			t.Errorf("'%s' want %s actual %s", topic, want, got)
+		}
+	}
+}
+
+func TestBridgeOut(t *testing.T) {
+	b := &Bridge{Out: []BridgeRule{{Filter: "a/#", Qos: 1, Remap: "x/"}}, QueueSize: 1}
+	b.queue = make(chan packet.PublishPacket, b.QueueSize)
+
+	b.out(packet.PublishPacket{Qos: 2, TopicName: "b", PacketId: 3}, "c1")
+	b.out(packet.PublishPacket{Qos: 2, TopicName: "a/b", PacketId: 3, Dup: true}, BridgePrefix+"other")
+	b.out(packet.PublishPacket{Qos: 2, TopicName: "a/b", PacketId: 3, Dup: true}, "c1")
+	b.out(packet.PublishPacket{Qos: 2, TopicName: "a/c"}, "c1")
+	if len(b.queue) != 1 {
+		t.Fatalf("want 1 queued actual %d", len(b.queue))
+	}
+	p := <-b.queue
+	if p.TopicName != "x/a/b" || p.Qos != 1 || p.PacketId != 0 || p.Dup {
+		t.Errorf("forwarded %+v", p)
+	}
+}
+
+// droppingRemote accepts the connection, and drops it once connected.
+type droppingRemote struct{ dials int32 }
+
+func (r *droppingRemote) Dial() (net.Conn, error) {
+	atomic.AddInt32(&r.dials, 1)
+	cnn, remote := net.Pipe()
+	go func() {
+		go io.Copy(io.Discard, remote)
+		remote.Write([]byte{0x20, 0x02, 0x00, 0x00}) //CONNACK accepted
+		remote.Close()
+	}()
+	return cnn, nil
+}
+
+func TestBridgeReconnectBackoff(t *testing.T) {
+	initPersister()
+	r := &droppingRemote{}
+	b := &Bridge{
+		Remote:     r,
+		Connect:    packet.ConnectPacket{ClientId: "bridge", CleanSession: true},
+		Backoff:    50 * time.Millisecond,
+		MaxBackoff: time.Second,
+		exitch:     make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		b.run()
+		close(done)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	close(b.exitch)
+	<-done
+	//dialed at 0, 50, 150 then 350ms
+	if n := atomic.LoadInt32(&r.dials); n < 2 || n > 4 {
+		t.Errorf("dialed %d times", n)
+	}
+}
+
+func TestBridgeLoopback(t *testing.T) {
+	initPersister()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cnns []net.Conn
+	var cnnl sync.Mutex
+	defer func() {
+		ln.Close()
+		cnnl.Lock()
+		for _, cnn := range cnns {
+			cnn.Close()
+		}
+		cnnl.Unlock()
+	}()
+	go func() {
+		for {
+			cnn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			cnnl.Lock()
+			cnns = append(cnns, cnn)
+			cnnl.Unlock()
+			go handler(cnn)
+		}
+	}()
+
+	//bridged to itself
+	b := &Bridge{
+		Remote:  &connection.NormalClient{Network: "tcp", Addr: ln.Addr().String()},
+		Connect: packet.ConnectPacket{ClientId: "bridge-1", CleanSession: true},
+		Out:     []BridgeRule{{Filter: "site/#", Qos: 1, Prefix: "site/", Remap: "central/s1/"}},
+		In:      []BridgeRule{{Filter: "central/cmd/#", Qos: 1, Prefix: "central/cmd/", Remap: "site/cmd/"}},
+	}
+	if err = AddBridge(b); err != nil {
+		t.Fatal(err)
+	}
+	if AddBridge(&Bridge{}) != ErrBridgeExists {
+		t.Errorf("second bridge should be refused")
+	}
+	defer func() {
+		b.Close()
+		for i := 0; i < 100; i++ {
+			if _, ok := ConnRegistry.Get("bridge-1"); !ok {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	startBridge()
+	for i := 0; ; i++ {
+		//the connection of a previous run may be registered still
+		if c, ok := ConnRegistry.Get("bridge-1"); ok && b.getConn() != nil && len(c.session.GetSubscription()) == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("bridge not connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	obs := testConn(t, "obs")
+	obs.session.AddSubscription([]packet.TopicFilter{{Topic: "central/s1/#", Qos: 1}, {Topic: "site/cmd/#", Qos: 1}})
+	pub := testConn(t, "pub")
+	receive := func(want string) {
+		select {
+		case p := <-obs.writech:
+			if pp := p.(*packet.PublishPacket); string(pp.TopicName) != want {
+				t.Errorf("want %s actual %s", want, pp.TopicName)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s not received", want)
+		}
+	}
+
+	handlePacket(&packet.PublishPacket{Qos: 1, TopicName: "site/temp", PacketId: 1, ApplicationMessage: "20"}, pub, nil)
+	receive("central/s1/temp")
+
+	handlePacket(&packet.PublishPacket{Qos: 1, TopicName: "central/cmd/reboot", PacketId: 2, ApplicationMessage: "now"}, pub, nil)
+	receive("site/cmd/reboot")
+	select {
+	case p := <-obs.writech:
+		t.Errorf("message coming in forwarded out: %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,607 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrClusterExists is returned by SetCluster for the second cluster.
+var ErrClusterExists = errors.New("cluster exists")
+
+// ClusterBroker is the broker of a cluster node, that the messages of the
+// other nodes are delivered to. The broker of the package is used by default.
+type ClusterBroker interface {
+	Publish(m AdminMessage) //to the clients connected, not routed again
+	Retain(m AdminMessage)  //removed by an empty payload
+	Kick(clientId string)   //connected to another node
+	SetSession(clientId string, recs []Record) error
+	Session(clientId string) ([]Record, error)
+	Sessions() ([]string, error) //client ids of the sessions persisted
+	Retained() []AdminMessage
+}
+
+// Cluster is a node of brokers connected to each other. The subscriptions of
+// the clients connected to a node are propagated to the others, so that the
+// messages published to it are routed to the nodes having subscribers only.
+// The retained messages, and the sessions saved on disconnecting, are
+// replicated to every node, so that a client can reconnect to any node and
+// resume its session, while connecting to a node kicks it off the others.
+//
+// The nodes exchange JSON lines over TCP. Every node dials each of its Peers,
+// and sends its state whenever connected: all the retained messages and
+// every session persisted, on every reconnection too, so that a node is
+// resynchronized after an outage at the cost of traffic growing with the
+// sessions. The nodes are not authenticated: any one connecting can replace
+// the sessions and kick the clients, so Addr must be reachable by the nodes
+// of the cluster only, in a private network or behind a firewall.
+type Cluster struct {
+	Node string //unique name of the node, Advertise by default, of the host name if unspecified
+	Addr string //listened for the other nodes, the actual one once started
+	// Advertise is the address the other nodes dial back, Addr by default.
+	// If its host is unspecified, as of ":7000", the nodes dial the IP the
+	// node connected from.
+	Advertise string
+	Peers     []string //addresses of the other nodes
+	Broker    ClusterBroker
+	Backoff   time.Duration //delay of redialing a node, doubled on every failure up to a minute
+	// QueueSize is the messages waiting to be sent to a node, dropped once full.
+	QueueSize int
+
+	ln     net.Listener
+	exitch chan struct{}
+	mu     sync.RWMutex
+	links  map[string]*clusterLink //address->link dialed
+	local  map[string][]string     //clientId->filters of the clients connected
+	remote map[string]*clusterPeer //Node->state of the nodes connected
+	cnns   map[net.Conn]bool
+}
+
+// clusterLink sends the messages to a node.
+type clusterLink struct {
+	addr  string
+	node  string //Node of the node dialed, once connected
+	queue chan clusterMessage
+}
+
+// clusterHelloTimeout is the time a node dialed has to say hello.
+const clusterHelloTimeout = 10 * time.Second
+
+// clusterPeer is a node sending messages.
+type clusterPeer struct {
+	cnn     net.Conn
+	node    string
+	filters []string
+}
+
+// the types of clusterMessage
+const (
+	clusterHello         = "hello"         //Node, From, sent by both ends
+	clusterSubscriptions = "subscriptions" //Filters of all the clients connected
+	clusterPublish       = "publish"       //Message
+	clusterRetain        = "retain"        //Message
+	clusterSession       = "session"       //ClientId, Records of its session, none deleted
+	clusterConnect       = "connect"       //ClientId
+)
+
+type clusterMessage struct {
+	Type     string        `json:"type"`
+	Node     string        `json:"node,omitempty"`
+	From     string        `json:"from,omitempty"`
+	Filters  []string      `json:"filters,omitempty"`
+	Message  *AdminMessage `json:"message,omitempty"`
+	ClientId string        `json:"client_id,omitempty"`
+	Records  []Record      `json:"records,omitempty"`
+}
+
+var cluster *Cluster
+
+// SetCluster configures c of the broker, started by RunMQTT. Only one cluster
+// can be set.
+func SetCluster(c *Cluster) error {
+	if cluster != nil {
+		return ErrClusterExists
+	}
+	cluster = c
+	return nil
+}
+
+// Start listens on Addr, and dials the Peers.
+func (c *Cluster) Start() error {
+	if c.Broker == nil {
+		c.Broker = localBroker{}
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = time.Second
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1000
+	}
+	ln, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	c.ln = ln
+	c.Addr = ln.Addr().String()
+	if c.Advertise == "" {
+		c.Advertise = c.Addr
+	}
+	if c.Node == "" {
+		c.Node = c.Advertise
+		if port, ok := unspecifiedHost(c.Advertise); ok {
+			if host, err := os.Hostname(); err == nil {
+				c.Node = net.JoinHostPort(host, port)
+			}
+		}
+	}
+	c.exitch = make(chan struct{})
+	c.links = make(map[string]*clusterLink)
+	c.local = make(map[string][]string)
+	c.remote = make(map[string]*clusterPeer)
+	c.cnns = make(map[net.Conn]bool)
+	go c.accept()
+	for _, addr := range c.Peers {
+		c.Join(addr)
+	}
+	return nil
+}
+
+// Join dials the node listening on addr, if not yet.
+func (c *Cluster) Join(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.links[addr]; ok || addr == c.Addr || addr == c.Advertise {
+		return
+	}
+	l := &clusterLink{addr: addr, queue: make(chan clusterMessage, c.QueueSize)}
+	c.links[addr] = l
+	go c.dial(l)
+}
+
+// Close disconnects the node from the others.
+func (c *Cluster) Close() {
+	select {
+	case <-c.exitch:
+		return
+	default:
+	}
+	close(c.exitch)
+	c.ln.Close()
+	c.mu.Lock()
+	for cnn := range c.cnns {
+		cnn.Close()
+	}
+	c.mu.Unlock()
+}
+
+func (c *Cluster) track(cnn net.Conn, add bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if add {
+		c.cnns[cnn] = true
+	} else {
+		delete(c.cnns, cnn)
+	}
+}
+
+// dial keeps the link connected.
+func (c *Cluster) dial(l *clusterLink) {
+	backoff := c.Backoff
+	for {
+		cnn, err := net.Dial("tcp", l.addr)
+		if err != nil {
+			logger.Warn("cluster dial fail", "node", c.Node, "peer", l.addr, "err", err, "retry", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-c.exitch:
+				return
+			}
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+			continue
+		}
+		backoff = c.Backoff
+		c.track(cnn, true)
+		if err = c.hello(l, cnn); err == nil {
+			err = c.send(l, cnn)
+		}
+		c.track(cnn, false)
+		cnn.Close()
+		select {
+		case <-c.exitch:
+			return
+		default:
+		}
+		if err == errClusterSelf {
+			logger.Info("cluster link to itself dropped", "node", c.Node, "peer", l.addr)
+			c.mu.Lock()
+			delete(c.links, l.addr)
+			c.mu.Unlock()
+			return
+		}
+		logger.Warn("cluster link lost", "node", c.Node, "peer", l.addr, "err", err)
+	}
+}
+
+var errClusterSelf = errors.New("cluster node dialed itself")
+
+// hello reads the hello of the node dialed by l, that the link is of.
+func (c *Cluster) hello(l *clusterLink, cnn net.Conn) error {
+	var m clusterMessage
+	cnn.SetReadDeadline(time.Now().Add(clusterHelloTimeout))
+	if err := json.NewDecoder(cnn).Decode(&m); err != nil {
+		return err
+	}
+	cnn.SetReadDeadline(time.Time{})
+	if m.Type != clusterHello {
+		return errors.New("cluster hello expected")
+	}
+	if m.Node == c.Node {
+		return errClusterSelf
+	}
+	c.mu.Lock()
+	l.node = m.Node
+	c.mu.Unlock()
+	return nil
+}
+
+// send sends the state of the node, then the messages queued, till failed.
+func (c *Cluster) send(l *clusterLink, cnn net.Conn) error {
+	enc := json.NewEncoder(cnn)
+	state, err := c.state()
+	if err != nil {
+		return err
+	}
+	for _, m := range state {
+		if err = enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case m := <-l.queue:
+			if err = enc.Encode(m); err != nil {
+				return err
+			}
+		case <-c.exitch:
+			return nil
+		}
+	}
+}
+
+// state returns the messages making a node connected up to date.
+func (c *Cluster) state() (msgs []clusterMessage, err error) {
+	msgs = append(msgs,
+		clusterMessage{Type: clusterHello, Node: c.Node, From: c.Advertise},
+		clusterMessage{Type: clusterSubscriptions, Filters: c.filters()},
+	)
+	for _, m := range c.Broker.Retained() {
+		m := m
+		msgs = append(msgs, clusterMessage{Type: clusterRetain, Message: &m})
+	}
+	ids, err := c.Broker.Sessions()
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		var recs []Record
+		if recs, err = c.Broker.Session(id); err != nil {
+			return
+		}
+		msgs = append(msgs, clusterMessage{Type: clusterSession, ClientId: id, Records: recs})
+	}
+	return
+}
+
+func (c *Cluster) accept() {
+	for {
+		cnn, err := c.ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.receive(cnn)
+	}
+}
+
+// receive handles the messages sent by a node.
+func (c *Cluster) receive(cnn net.Conn) {
+	c.track(cnn, true)
+	defer c.track(cnn, false)
+	defer cnn.Close()
+	if err := json.NewEncoder(cnn).Encode(clusterMessage{Type: clusterHello, Node: c.Node, From: c.Advertise}); err != nil {
+		return
+	}
+	dec := json.NewDecoder(cnn)
+	var peer *clusterPeer
+	for {
+		var m clusterMessage
+		if err := dec.Decode(&m); err != nil {
+			break
+		}
+		if peer == nil && m.Type != clusterHello {
+			logger.Warn("cluster message before hello", "node", c.Node, "type", m.Type)
+			break
+		}
+		switch m.Type {
+		case clusterHello:
+			if peer != nil || m.Node == c.Node {
+				logger.Warn("cluster hello unexpected", "node", c.Node, "peer", m.Node)
+				return
+			}
+			peer = &clusterPeer{cnn: cnn, node: m.Node}
+			c.mu.Lock()
+			c.remote[m.Node] = peer
+			linked := c.linked(m.Node)
+			c.mu.Unlock()
+			logger.Info("cluster node connected", "node", c.Node, "peer", m.Node)
+			if !linked {
+				c.Join(dialBack(m.From, cnn.RemoteAddr()))
+			}
+		case clusterSubscriptions:
+			c.mu.Lock()
+			peer.filters = m.Filters
+			c.mu.Unlock()
+		case clusterPublish:
+			if m.Message != nil {
+				c.Broker.Publish(*m.Message)
+			}
+		case clusterRetain:
+			if m.Message != nil {
+				c.Broker.Retain(*m.Message)
+			}
+		case clusterSession:
+			if err := c.Broker.SetSession(m.ClientId, m.Records); err != nil {
+				logger.Error("cluster session fail", "node", c.Node, "client_id", m.ClientId, "err", err)
+			}
+		case clusterConnect:
+			c.Broker.Kick(m.ClientId)
+		}
+	}
+	if peer == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.remote[peer.node] == peer {
+		delete(c.remote, peer.node)
+	}
+	c.mu.Unlock()
+	logger.Info("cluster node disconnected", "node", c.Node, "peer", peer.node)
+}
+
+// linked reports whether a link connected to node.
+func (c *Cluster) linked(node string) bool {
+	for _, l := range c.links {
+		if l.node == node {
+			return true
+		}
+	}
+	return false
+}
+
+// dialBack returns the address advertised by a node connected from remote,
+// of the IP of remote if its host is unspecified.
+func dialBack(advertised string, remote net.Addr) string {
+	port, ok := unspecifiedHost(advertised)
+	if tcp, isTCP := remote.(*net.TCPAddr); ok && isTCP {
+		return net.JoinHostPort(tcp.IP.String(), port)
+	}
+	return advertised
+}
+
+// unspecifiedHost returns the port of addr if its host is unspecified.
+func unspecifiedHost(addr string) (port string, ok bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	return port, host == "" || ip != nil && ip.IsUnspecified()
+}
+
+// enqueue queues m to the node of l.
+func (c *Cluster) enqueue(l *clusterLink, m clusterMessage) {
+	select {
+	case l.queue <- m:
+	default:
+		metrics.drop("cluster_full")
+	}
+}
+
+// broadcast queues m to every node, once if dialed by several links.
+func (c *Cluster) broadcast(m clusterMessage) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sent := make(map[string]bool, len(c.links))
+	for _, l := range c.links {
+		if l.node != "" {
+			if sent[l.node] {
+				continue
+			}
+			sent[l.node] = true
+		}
+		c.enqueue(l, m)
+	}
+}
+
+// filters returns the filters subscribed by the clients connected, sorted.
+func (c *Cluster) filters() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.filtersLocked()
+}
+
+func (c *Cluster) filtersLocked() []string {
+	set := make(map[string]bool)
+	for _, fs := range c.local {
+		for _, f := range fs {
+			set[f] = true
+		}
+	}
+	filters := make([]string, 0, len(set))
+	for f := range set {
+		filters = append(filters, f)
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// subscribed records the subscriptions of a client connected, nil once
+// disconnected, propagated if the filters of the node changed.
+func (c *Cluster) subscribed(clientId string, subs []packet.TopicFilter) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	old := c.filtersLocked()
+	if len(subs) == 0 {
+		delete(c.local, clientId)
+	} else {
+		c.local[clientId] = topicsOf(subs)
+	}
+	now := c.filtersLocked()
+	c.mu.Unlock()
+	if equalStrings(old, now) {
+		return
+	}
+	c.broadcast(clusterMessage{Type: clusterSubscriptions, Filters: now})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// connected kicks the client connected off the other nodes.
+func (c *Cluster) connected(clientId string, subs []packet.TopicFilter) {
+	if c == nil {
+		return
+	}
+	c.broadcast(clusterMessage{Type: clusterConnect, ClientId: clientId})
+	c.subscribed(clientId, subs)
+}
+
+// disconnected forgets the subscriptions of a client disconnected, and
+// replicates its session if saved.
+func (c *Cluster) disconnected(clientId string, saved bool) {
+	if c == nil || clientId == "" {
+		return
+	}
+	c.subscribed(clientId, nil)
+	if !saved {
+		return
+	}
+	recs, err := c.Broker.Session(clientId)
+	if err != nil {
+		logger.Error("cluster session fail", "node", c.Node, "client_id", clientId, "err", err)
+		return
+	}
+	c.broadcast(clusterMessage{Type: clusterSession, ClientId: clientId, Records: recs})
+}
+
+// publish routes p published to the node to the nodes having subscribers,
+// and replicates it if retained.
+func (c *Cluster) publish(p packet.PublishPacket) {
+	if c == nil {
+		return
+	}
+	m := newMessage(p)
+	if p.Retain {
+		c.retain(m)
+	}
+	m.Retain = false
+	topic := string(p.TopicName)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sent := make(map[string]bool, len(c.links))
+	for _, l := range c.links {
+		peer, ok := c.remote[l.node]
+		if l.node == "" || !ok || sent[l.node] {
+			continue
+		}
+		sent[l.node] = true
+		for _, f := range peer.filters {
+			if mqtt.MatchTopic(f, topic) {
+				c.enqueue(l, clusterMessage{Type: clusterPublish, Message: &m})
+				break
+			}
+		}
+	}
+}
+
+// retain replicates the retained message m, removed by an empty payload.
+func (c *Cluster) retain(m AdminMessage) {
+	if c == nil {
+		return
+	}
+	m.Retain, m.Stored = true, nil
+	c.broadcast(clusterMessage{Type: clusterRetain, Message: &m})
+}
+
+// localBroker is the broker of the package as a ClusterBroker.
+type localBroker struct{}
+
+func (localBroker) Publish(m AdminMessage) {
+	ConnRegistry.Publish(m.publishPacket(), "")
+}
+
+func (localBroker) Retain(m AdminMessage) {
+	if err := RetainRegistry.Add(m.Topic, m.publishPacket()); err != nil {
+		logger.Warn("cluster retain fail", "topic", m.Topic, "err", err)
+	}
+}
+
+func (localBroker) Kick(clientId string) {
+	if c, ok := ConnRegistry.Get(clientId); ok {
+		c.Close("taken over")
+	}
+}
+
+// SetSession replaces the session persisted, unless the client is connected
+// or the one persisted is newer.
+func (localBroker) SetSession(clientId string, recs []Record) error {
+	if _, ok := ConnRegistry.Get(clientId); ok {
+		return nil
+	}
+	if len(recs) > 0 && recs[0].Key == KeySession {
+		old, err := persister.Read(KeySession, clientId)
+		if err != nil {
+			return err
+		}
+		t, _ := mqtt.SessionSaved(KeySession, clientId, recs[0].Data, persister)
+		if saved, ok := mqtt.SessionSaved(KeySession, clientId, old, persister); ok && !saved.Before(t) {
+			return nil
+		}
+	}
+	return importSession(persister, clientId, recs)
+}
+
+func (localBroker) Session(clientId string) ([]Record, error) {
+	return sessionRecords(persister, clientId)
+}
+
+func (localBroker) Sessions() ([]string, error) {
+	metas, err := persister.LoadAll(KeySession)
+	ids := make([]string, 0, len(metas))
+	for k := range metas {
+		ids = append(ids, k)
+	}
+	return ids, err
+}
+
+func (localBroker) Retained() []AdminMessage {
+	return retainedMessages("#")
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memBroker is a broker of a node in the tests.
+type memBroker struct {
+	sync.Mutex
+	published []AdminMessage
+	retained  map[string]AdminMessage
+	sessions  map[string][]Record
+	kicked    []string
+}
+
+func newMemBroker() *memBroker {
+	return &memBroker{retained: make(map[string]AdminMessage), sessions: make(map[string][]Record)}
+}
+
+func (b *memBroker) Publish(m AdminMessage) {
+	b.Lock()
+	b.published = append(b.published, m)
+	b.Unlock()
+}
+
+func (b *memBroker) Retain(m AdminMessage) {
+	b.Lock()
+	if len(m.Payload) == 0 {
+		delete(b.retained, m.Topic)
+	} else {
+		b.retained[m.Topic] = m
+	}
+	b.Unlock()
+}
+
+func (b *memBroker) Kick(clientId string) {
+	b.Lock()
+	b.kicked = append(b.kicked, clientId)
+	b.Unlock()
+}
+
+func (b *memBroker) SetSession(clientId string, recs []Record) error {
+	b.Lock()
+	b.sessions[clientId] = recs
+	b.Unlock()
+	return nil
+}
+
+func (b *memBroker) Session(clientId string) ([]Record, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.sessions[clientId], nil
+}
+
+func (b *memBroker) Sessions() (ids []string, err error) {
+	b.Lock()
+	defer b.Unlock()
+	for k := range b.sessions {
+		ids = append(ids, k)
+	}
+	return
+}
+
+func (b *memBroker) Retained() (msgs []AdminMessage) {
+	b.Lock()
+	defer b.Unlock()
+	for _, m := range b.retained {
+		msgs = append(msgs, m)
+	}
+	return
+}
+
+func (b *memBroker) check(f func(b *memBroker) bool) bool {
+	b.Lock()
+	defer b.Unlock()
+	return f(b)
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	for i := 0; !f(); i++ {
+		if i == 200 {
+			t.Fatalf("%s timeout", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func peerFilters(c *Cluster, node string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if p, ok := c.remote[node]; ok {
+		return p.filters
+	}
+	return nil
+}
+
+func peers(c *Cluster) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.remote)
+}
+
+func startNode(t *testing.T, name string, b ClusterBroker) *Cluster {
+	c := &Cluster{Node: name, Addr: "127.0.0.1:0", Broker: b, Backoff: 10 * time.Millisecond}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestCluster(t *testing.T) {
+	b1, b2, b3 := newMemBroker(), newMemBroker(), newMemBroker()
+	n1, n2, n3 := startNode(t, "n1", b1), startNode(t, "n2", b2), startNode(t, "n3", b3)
+	//joined back by the nodes joined
+	n2.Join(n1.Addr)
+	n3.Join(n1.Addr)
+	n3.Join(n2.Addr)
+	waitFor(t, "mesh", func() bool { return peers(n1) == 2 && peers(n2) == 2 && peers(n3) == 2 })
+
+	n1.subscribed("a", []packet.TopicFilter{{Topic: "x/#", Qos: 1}})
+	waitFor(t, "subscriptions", func() bool {
+		return len(peerFilters(n2, n1.Node)) == 1 && len(peerFilters(n3, n1.Node)) == 1
+	})
+
+	n2.publish(packet.PublishPacket{Qos: 1, TopicName: "x/1", ApplicationMessage: "p"})
+	n2.publish(packet.PublishPacket{Qos: 1, TopicName: "y", ApplicationMessage: "r", Retain: true})
+	waitFor(t, "routed", func() bool {
+		return b1.check(func(b *memBroker) bool { return len(b.published) == 1 })
+	})
+	waitFor(t, "retained", func() bool {
+		return b1.check(func(b *memBroker) bool { return len(b.retained) == 1 }) &&
+			b3.check(func(b *memBroker) bool { return len(b.retained) == 1 })
+	})
+	if m := b1.published[0]; m.Topic != "x/1" || string(m.Payload) != "p" || m.Qos != 1 {
+		t.Errorf("routed %+v", m)
+	}
+	if len(b3.published) != 0 {
+		t.Errorf("routed without subscriber %+v", b3.published)
+	}
+
+	//resumed on another node
+	b1.SetSession("a", []Record{{KeySession, "a", "a", []byte("meta")}})
+	n1.disconnected("a", true)
+	waitFor(t, "session", func() bool {
+		return b2.check(func(b *memBroker) bool { return len(b.sessions["a"]) == 1 }) &&
+			len(peerFilters(n2, n1.Node)) == 0
+	})
+	n3.connected("a", nil)
+	waitFor(t, "kicked", func() bool {
+		return b1.check(func(b *memBroker) bool { return len(b.kicked) == 1 && b.kicked[0] == "a" })
+	})
+
+	//synchronized once joined
+	b4 := newMemBroker()
+	n4 := startNode(t, "n4", b4)
+	n4.Join(n1.Addr)
+	waitFor(t, "state", func() bool {
+		return b4.check(func(b *memBroker) bool { return len(b.retained) == 1 && len(b.sessions["a"]) == 1 })
+	})
+}
+
+func TestClusterUnspecifiedAddr(t *testing.T) {
+	b1, b2 := newMemBroker(), newMemBroker()
+	n1 := &Cluster{Addr: ":0", Broker: b1, Backoff: 10 * time.Millisecond}
+	n2 := &Cluster{Addr: ":0", Broker: b2, Backoff: 10 * time.Millisecond}
+	for _, n := range []*Cluster{n1, n2} {
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(n.Close)
+	}
+	if n1.Node == n2.Node {
+		t.Fatalf("same node %s", n1.Node)
+	}
+	//dialed back on the IP connected from
+	_, port, _ := net.SplitHostPort(n1.Addr)
+	n2.Join(net.JoinHostPort("127.0.0.1", port))
+	waitFor(t, "joined back", func() bool { return peers(n1) == 1 && peers(n2) == 1 })
+
+	n1.subscribed("a", []packet.TopicFilter{{Topic: "x"}})
+	n2.subscribed("b", []packet.TopicFilter{{Topic: "y"}})
+	waitFor(t, "subscriptions", func() bool {
+		return len(peerFilters(n1, n2.Node)) == 1 && len(peerFilters(n2, n1.Node)) == 1
+	})
+	n1.publish(packet.PublishPacket{TopicName: "y"})
+	n2.publish(packet.PublishPacket{TopicName: "x"})
+	waitFor(t, "routed", func() bool {
+		return b1.check(func(b *memBroker) bool { return len(b.published) == 1 }) &&
+			b2.check(func(b *memBroker) bool { return len(b.published) == 1 })
+	})
+
+	if a := dialBack("[::]:7000", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}); a != "10.0.0.1:7000" {
+		t.Errorf("dial back %s", a)
+	}
+	if a := dialBack("n1:7000", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}); a != "n1:7000" {
+		t.Errorf("dial back %s", a)
+	}
+}
+
+func TestLocalBrokerSession(t *testing.T) {
+	initPersister()
+	s := mqtt.NewSession()
+	s.Bind(KeySession, "c", persister)
+	old, _ := sessionRecords(persister, "c")
+	time.Sleep(time.Millisecond)
+	s.AddSubscription([]packet.TopicFilter{{Topic: "a", Qos: 1}})
+	s.Save(KeySession, "c", persister)
+	now, _ := sessionRecords(persister, "c")
+
+	b := localBroker{}
+	if err := b.SetSession("c", old); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := mqtt.LoadSession(KeySession, "c", persister); s == nil || len(s.Subscript) != 1 {
+		t.Errorf("replaced by an older session")
+	}
+	mqtt.DeleteSession(KeySession, "c", persister)
+	if err := b.SetSession("c", now); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := mqtt.LoadSession(KeySession, "c", persister); s == nil || len(s.Subscript) != 1 {
+		t.Errorf("session not set")
+	}
+	if err := b.SetSession("c", []Record{{Key: KeyRetain, Field: "x"}}); err == nil {
+		t.Errorf("record of another session set")
+	}
+}
@@ -1,11 +1,9 @@
 package server
 
 import (
-	"encoding/json"
 	"hilldan/mqtt"
 	"hilldan/mqtt/packet"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -29,6 +27,12 @@ type mqttConn struct {
 	//session management
 	session *mqtt.Session
 
+	//replay, see subscribeReplay
+	replayl       sync.RWMutex
+	replayedSeq   uint64
+	replayFilters []string
+	replayDone    chan struct{} //closed once the replay in progress is sent
+
 	//keepalive
 	deadline time.Duration
 	pingch   chan struct{} //chan to indicate something come from client
@@ -39,15 +43,33 @@ type mqttConn struct {
 }
 
 func (c *mqttConn) read() {
+	r := &countReader{r: c.cnn}
+	lim := newClientLimiter()
 	for {
 		select {
 		case <-c.exitch:
 			goto exit
 		default:
-			p, err := packet.ParsePacket(c.cnn)
+			r.n = 0
+			p, err := packet.ParsePacket(r)
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				goto exit
 			}
+			if p != nil {
+				metrics.packetIn(p.ControlType(), r.n)
+				wait, lerr := lim.limit(p, r.n)
+				if lerr != nil {
+					err = lerr
+				} else if wait > 0 {
+					t := time.NewTimer(wait)
+					select {
+					case <-c.exitch:
+						t.Stop()
+						goto exit
+					case <-t.C:
+					}
+				}
+			}
 			c.readch <- mqtt.PacketReaded{
 				P:   p,
 				Err: err,
@@ -56,7 +78,7 @@ func (c *mqttConn) read() {
 	}
 exit:
 	close(c.readch)
-	log.Printf("read no leak")
+	logger.Debug("read exit", c.fields()...)
 }
 
 func (c *mqttConn) write() {
@@ -65,15 +87,28 @@ func (c *mqttConn) write() {
 		case <-c.exitch:
 			goto exit
 		case p := <-c.writech:
-			_, err := p.WriteTo(c.cnn)
+			n, err := p.WriteTo(c.cnn)
 			if err != nil {
 				c.cnn.Close()
 				goto exit
 			}
+			metrics.packetOut(p.ControlType(), n)
+			if mqtt.DebugEnabled(logger) {
+				logger.Debug("packet sent", c.fields(mqtt.PacketFields(p)...)...)
+			}
 		}
 	}
 exit:
-	log.Printf("write no leak")
+	logger.Debug("write exit", c.fields()...)
+}
+
+// fields returns the fields logged of the connection, followed by args.
+func (c *mqttConn) fields(args ...any) []any {
+	fields := []any{"client_id", c.clientId}
+	if addr := c.cnn.RemoteAddr(); addr != nil {
+		fields = append(fields, "remote_addr", addr.String())
+	}
+	return append(fields, args...)
 }
 
 func (c *mqttConn) Close(cause string) {
@@ -81,13 +116,14 @@ func (c *mqttConn) Close(cause string) {
 }
 
 func (c *mqttConn) closeConn(cause string, session bool) {
-	log.Println("mqtt conn closed:", cause)
 	c.deadl.Lock()
 	defer c.deadl.Unlock()
 	if c.dead {
 		return
 	}
+	logger.Info("connection closed", c.fields("cause", cause)...)
 	go listener.OnDisconnected()
+	metrics.disconnect(cause)
 	c.dead = true
 	c.cnn.Close()
 	close(c.exitch)
@@ -95,7 +131,19 @@ func (c *mqttConn) closeConn(cause string, session bool) {
 	if session {
 		c.session.Save(KeySession, c.clientId, persister)
 	}
-	ConnRegistry.Remove(c.clientId)
+	ConnRegistry.removeConn(c)
+	cluster.disconnected(c.clientId, session)
+	if c.clientId != "" {
+		e := c.event(EventDisconnected)
+		e.Cause = cause
+		emit(e)
+	}
+}
+
+func (c *mqttConn) isDead() bool {
+	c.deadl.Lock()
+	defer c.deadl.Unlock()
+	return c.dead
 }
 
 //initConn wait for the first connect packet coming, handle it.
@@ -139,6 +187,8 @@ func (c *mqttConn) initConn() (p *packet.ConnectPacket) {
 		go c.write()
 		go c.keepalive()
 
+		//the session not expired till registered
+		unlock := clientLocks.lock(c.clientId)
 		if c.initSession() {
 			c.publishOld(bool(p.CleanSession))
 		}
@@ -148,42 +198,53 @@ func (c *mqttConn) initConn() (p *packet.ConnectPacket) {
 		}
 		ack.Code = packet.CodeConnackAccepted
 		c.writech <- ack
+		atomic.AddUint64(&metrics.connects, 1)
+		logger.Info("connection accepted", c.fields("clean_session", bool(p.CleanSession))...)
 
 		ConnRegistry.Add(c.clientId, c)
+		unlock()
+		cluster.connected(c.clientId, c.session.GetSubscription())
+		emit(c.event(EventConnected))
 
 	}
 	return
 }
 func (c *mqttConn) initSession() bool {
-	data, err := persister.Read(KeySession, c.clientId)
+	s, err := mqtt.LoadSession(KeySession, c.clientId, persister)
 	if err != nil {
-		log.Printf("get session by '%s' fail: %v", c.clientId, err)
+		logger.Error("load session fail", c.fields("err", err)...)
 	}
-
-	if len(data) == 0 {
-		c.session = mqtt.NewSession()
-		return false
+	if s != nil {
+		c.session = s
+		return true
 	}
 
-	s := new(mqtt.Session)
-	err = json.Unmarshal(data, s)
-	if err != nil {
-		log.Printf("'%s' session data invalid", string(data))
-		c.session = mqtt.NewSession()
-		return false
+	c.session = mqtt.NewSession()
+	if err = c.session.Bind(KeySession, c.clientId, persister); err != nil {
+		logger.Error("persist session fail", c.fields("err", err)...)
 	}
-	s.MustInit()
-	c.session = s
-	return true
+	return false
 }
 
-// publish send packet from server to client
-func (c *mqttConn) publish(p packet.PublishPacket) {
+// publish send packet from server to client, and returns the packet id
+// assigned.
+func (c *mqttConn) publish(p packet.PublishPacket) packet.Integer {
 	if p.Qos != packet.QoS0 {
-		p.PacketId = packet.Integer(atomic.AddUint32(&c.packetId, 1))
+		p.PacketId = c.nextPacketId()
 	}
+	c.send(p)
+	return p.PacketId
+}
+
+func (c *mqttConn) nextPacketId() packet.Integer {
+	return packet.Integer(atomic.AddUint32(&c.packetId, 1))
+}
+
+// send send packet with the packet id assigned.
+func (c *mqttConn) send(p packet.PublishPacket) {
 	p.Dup = false
-	c.writech <- &p
+	w := p //written by another goroutine
+	c.writech <- &w
 	if p.Qos == packet.QoS0 {
 		return
 	}
@@ -196,8 +257,9 @@ func (c *mqttConn) publish(p packet.PublishPacket) {
 func (c *mqttConn) publishOld(clearSession bool) {
 	old := c.session.ResetPubOut()
 	if clearSession {
-		persister.Delete(KeySession, c.clientId)
 		c.session = mqtt.NewSession()
+		c.session.Bind(KeySession, c.clientId, persister)
+		msgLog.forget(c.clientId)
 	}
 	max := packet.Integer(0)
 	for _, v := range old {
@@ -227,7 +289,7 @@ func (c *mqttConn) publishOld(clearSession bool) {
 // 	log.Printf("republish no leak")
 // }
 
-func (c *mqttConn) subscribe(p packet.SubscribePacket) {
+func (c *mqttConn) subscribe(p packet.SubscribePacket, rs []replay) {
 	l := len(p.TopicFilters)
 	ack := &packet.SubackPacket{
 		PacketId: p.PacketId,
@@ -262,7 +324,9 @@ func (c *mqttConn) subscribe(p packet.SubscribePacket) {
 			b[ll] = v
 			ll++
 		}
-		RetainRegistry.Publish(v, c)
+		if !replaying(rs, i) {
+			RetainRegistry.Publish(v, c)
+		}
 
 		ack.Code[i] = byte(v.Qos)
 	}
@@ -270,6 +334,18 @@ func (c *mqttConn) subscribe(p packet.SubscribePacket) {
 	c.writech <- ack
 }
 
+// unsubscribe removes the topic filters from the subscriptions, of an
+// UNSUBSCRIBE packet or of the admin API.
+func (c *mqttConn) unsubscribe(filters []packet.String) {
+	c.session.Unsubscription(filters)
+	cluster.subscribed(c.clientId, c.session.GetSubscription())
+	e := c.event(EventUnsubscribed)
+	for _, v := range filters {
+		e.Filters = append(e.Filters, string(v))
+	}
+	emit(e)
+}
+
 func (c *mqttConn) keepalive() {
 	//A Keep Alive value of zero (0) has the effect of turning off the keep alive mechanism
 	if c.deadline == 0 {
@@ -285,7 +361,7 @@ func (c *mqttConn) keepalive() {
 		tm = time.AfterFunc(time15, f)
 	}
 	tm.Stop()
-	log.Printf("keepalive no leak")
+	logger.Debug("keepalive exit", c.fields()...)
 }
 
 /*
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"container/heap"
+	"errors"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The messages scheduled are stored at KeyDelayed by id, see
+// mqtt.EncodeDelayed. They are deleted when due, and published then, see
+// inject, so a message due while the broker is down is published once
+// restarted.
+
+// DelayedPrefix prefixes the topics of the messages delayed: the message
+// published to "$delayed/60/cmd/reboot" is published to "cmd/reboot" 60
+// seconds later.
+const DelayedPrefix = "$delayed/"
+
+var (
+	ErrNotScheduled = errors.New("message not scheduled")
+	ErrNotRunning   = errors.New("broker not running")
+)
+
+// ScheduledMessage is a message scheduled.
+type ScheduledMessage struct {
+	Id     uint64
+	At     time.Time
+	Packet packet.PublishPacket
+}
+
+// scheduleQueue is a heap of the messages by time due.
+type scheduleQueue []ScheduledMessage
+
+func (q scheduleQueue) Len() int            { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool  { return q[i].At.Before(q[j].At) }
+func (q scheduleQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *scheduleQueue) Push(x interface{}) { *q = append(*q, x.(ScheduledMessage)) }
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+type scheduler struct {
+	sync.Mutex
+	seq   uint64
+	items map[uint64]ScheduledMessage
+	queue scheduleQueue //the ones cancelled are removed once due
+	wake  chan struct{}
+}
+
+var delayed *scheduler
+
+// newScheduler loads the messages scheduled.
+func newScheduler() *scheduler {
+	s := &scheduler{
+		items: make(map[uint64]ScheduledMessage),
+		wake:  make(chan struct{}, 1),
+	}
+	datas, err := persister.LoadAll(KeyDelayed)
+	if err != nil {
+		logger.Error("load scheduled messages fail", "err", err)
+	}
+	for k, v := range datas {
+		id, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			continue
+		}
+		data, _, err := mqtt.Unwrap(mqtt.KindDelayed, KeyDelayed, k, v, persister)
+		if err != nil {
+			logger.Warn("scheduled message invalid", "id", k, "err", err)
+			continue
+		}
+		p, at, err := mqtt.DecodeDelayed(data)
+		if err != nil {
+			logger.Warn("scheduled message invalid", "id", k, "err", err)
+			continue
+		}
+		if id > s.seq {
+			s.seq = id
+		}
+		m := ScheduledMessage{id, at, p}
+		s.items[id] = m
+		s.queue = append(s.queue, m)
+	}
+	heap.Init(&s.queue)
+	return s
+}
+
+// ScheduleAt schedules p to be published at, and returns the id of it. The
+// rules are applied to p when due, as published by DelayedPublisher.
+func ScheduleAt(at time.Time, p packet.PublishPacket) (id uint64, err error) {
+	if delayed == nil {
+		return 0, ErrNotRunning
+	}
+	return delayed.schedule(at, p)
+}
+
+// CancelScheduled cancels the message scheduled of id.
+func CancelScheduled(id uint64) error {
+	if delayed == nil {
+		return ErrNotRunning
+	}
+	return delayed.cancel(id)
+}
+
+// Scheduled returns the messages scheduled, by time due.
+func Scheduled() []ScheduledMessage {
+	if delayed == nil {
+		return nil
+	}
+	return delayed.list()
+}
+
+func (s *scheduler) schedule(at time.Time, p packet.PublishPacket) (id uint64, err error) {
+	p.PacketId, p.Dup = 0, false
+	data, err := mqtt.EncodeDelayed(p, at)
+	if err != nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	id = s.seq + 1
+	if err = persister.Save(KeyDelayed, strconv.FormatUint(id, 10), mqtt.Wrap(mqtt.KindDelayed, data)); err != nil {
+		return 0, err
+	}
+	s.seq = id
+	m := ScheduledMessage{id, at, p}
+	s.items[id] = m
+	heap.Push(&s.queue, m)
+	if s.queue[0].Id == id {
+		s.notify()
+	}
+	return
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) cancel(id uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.items[id]; !ok {
+		return ErrNotScheduled
+	}
+	if err := persister.Delete(KeyDelayed, strconv.FormatUint(id, 10)); err != nil {
+		return err
+	}
+	delete(s.items, id)
+	return nil
+}
+
+func (s *scheduler) list() []ScheduledMessage {
+	s.Lock()
+	msgs := make([]ScheduledMessage, 0, len(s.items))
+	for _, m := range s.items {
+		msgs = append(msgs, m)
+	}
+	s.Unlock()
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].At.Equal(msgs[j].At) {
+			return msgs[i].Id < msgs[j].Id
+		}
+		return msgs[i].At.Before(msgs[j].At)
+	})
+	return msgs
+}
+
+// due removes the messages due at now, and returns them with the time the
+// next one is due.
+func (s *scheduler) due(now time.Time) (msgs []ScheduledMessage, next time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for len(s.queue) > 0 {
+		m := s.queue[0]
+		if _, ok := s.items[m.Id]; !ok {
+			heap.Pop(&s.queue) //cancelled
+			continue
+		}
+		if m.At.After(now) {
+			return msgs, m.At
+		}
+		heap.Pop(&s.queue)
+		msgs = append(msgs, m)
+	}
+	return
+}
+
+// run publishes the messages when due.
+func (s *scheduler) run() {
+	for {
+		msgs, next := s.due(time.Now())
+		for _, m := range msgs {
+			s.publish(m)
+		}
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+		select {
+		case <-fire:
+		case <-s.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// publish deletes m, and publishes it unless cancelled before. A message
+// failed to be deleted is published still, again once restarted.
+func (s *scheduler) publish(m ScheduledMessage) {
+	switch err := s.cancel(m.Id); err {
+	case nil:
+	case ErrNotScheduled:
+		return
+	default:
+		logger.Error("delete scheduled message fail", "id", m.Id, "err", err)
+	}
+	if err := inject(m.Packet, DelayedPublisher); err != nil {
+		logger.Warn("scheduled message publish fail", "id", m.Id, "topic", string(m.Packet.TopicName), "err", err)
+	}
+}
+
+// delayedTopic returns the delay and the topic of the topic delaying, see
+// DelayedPrefix.
+func delayedTopic(topic string) (delay time.Duration, rest string, ok bool) {
+	if !strings.HasPrefix(topic, DelayedPrefix) {
+		return
+	}
+	secs, rest, found := strings.Cut(topic[len(DelayedPrefix):], "/")
+	n, err := strconv.ParseUint(secs, 10, 32)
+	if !found || err != nil || rest == "" || strings.HasPrefix(rest, "$") {
+		return 0, "", false
+	}
+	return time.Duration(n) * time.Second, rest, true
+}
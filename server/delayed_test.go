@@ -0,0 +1,124 @@
+package server
+
+import (
+	"hilldan/mqtt/packet"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDelayedTopic(t *testing.T) {
+	for topic, want := range map[string]string{
+		"$delayed/60/cmd/reboot": "cmd/reboot",
+		"$delayed/0/a":           "a",
+		"$delayed/60":            "",
+		"$delayed/60/":           "",
+		"$delayed/-1/a":          "",
+		"$delayed/x/a":           "",
+		"$delayed/1/$SYS/a":      "",
+		"cmd/reboot":             "",
+	} {
+		_, got, ok := delayedTopic(topic)
+		if got != want || ok != (want != "") {
+			t.Errorf("'%s' want %s actual %s", topic, want, got)
+		}
+	}
+	if d, _, _ := delayedTopic("$delayed/60/a"); d != time.Minute {
+		t.Errorf("delay %v", d)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	initPersister()
+	defer func() {
+		for _, m := range Scheduled() {
+			CancelScheduled(m.Id)
+		}
+	}()
+
+	c := testConn(t, "scheduled")
+	c.session.AddSubscription([]packet.TopicFilter{{Topic: "cmd/#", Qos: 1}})
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case p := <-c.writech:
+			if pp := p.(*packet.PublishPacket); string(pp.TopicName) != want {
+				t.Errorf("want %s actual %s", want, pp.TopicName)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not received", want)
+		}
+	}
+	pub := testConn(t, "device")
+	handlePacket(&packet.PublishPacket{Qos: 1, PacketId: 1, TopicName: "$delayed/0/cmd/now"}, pub, nil)
+	if p := <-pub.writech; p.ControlType() != packet.TypePUBACK {
+		t.Errorf("not acknowledged %v", p)
+	}
+	receive("cmd/now")
+
+	at := time.Now().Add(time.Hour)
+	ScheduleAt(at, packet.PublishPacket{Qos: 1, TopicName: "cmd/later"})
+	id, _ := ScheduleAt(at, packet.PublishPacket{Qos: 1, TopicName: "cmd/cancelled"})
+	h := AdminHandler("secret")
+	var msgs []AdminScheduled
+	adminDo(t, h, "GET", "/scheduled", "", &msgs)
+	if len(msgs) != 2 || msgs[0].Topic != "cmd/later" || !msgs[0].At.Equal(at) {
+		t.Errorf("scheduled %+v", msgs)
+	}
+	url := "/scheduled/" + strconv.FormatUint(id, 10)
+	if code := adminDo(t, h, "DELETE", url, "", nil); code != 204 {
+		t.Errorf("want 204 actual %d", code)
+	}
+	if code := adminDo(t, h, "DELETE", url, "", nil); code != 404 {
+		t.Errorf("want 404 actual %d", code)
+	}
+	//cancelled once taken as due
+	delayed.publish(ScheduledMessage{Id: id, At: at, Packet: packet.PublishPacket{Qos: 1, TopicName: "cmd/cancelled"}})
+	select {
+	case p := <-c.writech:
+		t.Errorf("cancelled published %v", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if code := adminDo(t, h, "DELETE", "/scheduled/x", "", nil); code != 400 {
+		t.Errorf("want 400 actual %d", code)
+	}
+
+	//restarted
+	if msgs := newScheduler().list(); len(msgs) != 1 || msgs[0].Packet.TopicName != "cmd/later" || !msgs[0].At.Equal(at) {
+		t.Fatalf("reloaded %+v", msgs)
+	}
+	ScheduleAt(time.Now().Add(50*time.Millisecond), packet.PublishPacket{TopicName: "cmd/soon"})
+	receive("cmd/soon")
+	waitFor(t, "deleted", func() bool { return len(Scheduled()) == 1 })
+	if datas, _ := persister.LoadAll(KeyDelayed); len(datas) != 1 {
+		t.Errorf("persisted %d", len(datas))
+	}
+}
+
+func TestDelayedRules(t *testing.T) {
+	defer RemoveRule("all")
+	defer RemoveRule("cmd")
+	topics := make(chan string, 2)
+	RegisterRuleFunc("delayed", func(fields map[string]interface{}, p packet.PublishPacket) error {
+		topics <- string(p.TopicName)
+		return nil
+	})
+	AddRule(Rule{Name: "cmd", SQL: `SELECT * FROM "cmd/#"`, Actions: []RuleAction{{Call: "delayed"}}})
+	AddRule(Rule{Name: "all", SQL: `SELECT * FROM "$delayed/#"`, Actions: []RuleAction{{Call: "delayed"}}})
+
+	pub := testConn(t, "delayer")
+	handlePacket(&packet.PublishPacket{TopicName: "$delayed/0/cmd/later"}, pub, nil)
+	select {
+	case topic := <-topics:
+		if topic != "cmd/later" {
+			t.Errorf("rule applied to %s", topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rule not applied")
+	}
+	select {
+	case topic := <-topics:
+		t.Errorf("rule applied to %s", topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
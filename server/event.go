@@ -0,0 +1,74 @@
+package server
+
+import (
+	"hilldan/mqtt/packet"
+	"time"
+)
+
+// the types of Event
+const (
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected"
+	EventSubscribed   = "subscribed"
+	EventUnsubscribed = "unsubscribed"
+	EventPublished    = "published"
+)
+
+// Event is what happened to a client of the broker, sent to the sinks added.
+// Unlike mqtt.EventListener, it tells the client.
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	ClientId   string    `json:"client_id"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Cause      string    `json:"cause,omitempty"`   //of disconnected
+	Filters    []string  `json:"filters,omitempty"` //of subscribed and unsubscribed
+
+	//of published
+	Topic   string      `json:"topic,omitempty"`
+	Qos     packet.Bit2 `json:"qos,omitempty"`
+	Retain  bool        `json:"retain,omitempty"`
+	Payload []byte      `json:"-"` //encoded by the sink
+}
+
+// EventSink receives the events of the broker. Send is called by the
+// goroutine of the client, so it ought not to block.
+type EventSink interface {
+	Send(e Event)
+}
+
+var sinks []EventSink
+
+// AddEventSink adds s receiving the events, before RunMQTT.
+func AddEventSink(s EventSink) {
+	sinks = append(sinks, s)
+}
+
+func emit(e Event) {
+	if len(sinks) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, s := range sinks {
+		s.Send(e)
+	}
+}
+
+// event returns the event of typ of the connection.
+func (c *mqttConn) event(typ string) Event {
+	e := Event{Type: typ, ClientId: c.clientId}
+	if addr := c.cnn.RemoteAddr(); addr != nil {
+		e.RemoteAddr = addr.String()
+	}
+	return e
+}
+
+func topicsOf(tfs []packet.TopicFilter) []string {
+	topics := make([]string, len(tfs))
+	for i, v := range tfs {
+		topics[i] = string(v.Topic)
+	}
+	return topics
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"hilldan/mqtt"
+	"sync"
+	"time"
+)
+
+const maxSweepInterval = time.Minute
+
+var (
+	sessionExpiry     time.Duration
+	sessionExpiryFunc func(clientId string, def time.Duration) time.Duration
+)
+
+// SetSessionExpiry assigns how long the session of a client disconnected is
+// kept. After that, the session and the packets queued in it are purged.
+// Zero keeps the sessions forever.
+func SetSessionExpiry(d time.Duration) {
+	sessionExpiry = d
+}
+
+// SetSessionExpiryFunc overrides the session expiry of every client by f,
+// which is given the default one assigned by SetSessionExpiry. f returning
+// zero keeps the session forever.
+func SetSessionExpiryFunc(f func(clientId string, def time.Duration) time.Duration) {
+	sessionExpiryFunc = f
+}
+
+func expiryOf(clientId string) time.Duration {
+	if sessionExpiryFunc != nil {
+		return sessionExpiryFunc(clientId, sessionExpiry)
+	}
+	return sessionExpiry
+}
+
+// sweep purges the sessions and the retained packets expired in background.
+func sweep() {
+	for {
+		d := maxSweepInterval
+		ttl, rules := getRetainTTLs()
+		ds := []time.Duration{sessionExpiry / 2, ttl / 2}
+		for _, v := range rules {
+			ds = append(ds, v.ttl/2)
+		}
+		for _, v := range getHistoryRules() {
+			ds = append(ds, v.maxAge/2)
+		}
+		for _, v := range ds {
+			if v > 0 && v < d {
+				d = v
+			}
+		}
+		time.Sleep(d)
+		expireSessions()
+		RetainRegistry.Expire()
+		histories.Expire()
+		connectLimits.Expire()
+	}
+}
+
+// expireSessions purges the sessions of the clients disconnected longer
+// than their expiry.
+func expireSessions() {
+	if sessionExpiry <= 0 && sessionExpiryFunc == nil {
+		return
+	}
+	saved, err := mqtt.SessionsSaved(KeySession, persister)
+	if err != nil {
+		logger.Error("load sessions fail", "err", err)
+		return
+	}
+	now := time.Now()
+	for clientId, t := range saved {
+		if d := expiryOf(clientId); d <= 0 || now.Sub(t) < d {
+			continue
+		}
+		expired, err := expireSession(clientId, now)
+		if err != nil {
+			logger.Error("purge session fail", "client_id", clientId, "err", err)
+			continue
+		}
+		if !expired {
+			continue
+		}
+		msgLog.forget(clientId)
+		if l, ok := listener.(mqtt.SessionExpiredListener); ok {
+			go l.OnSessionExpired(clientId)
+		}
+	}
+}
+
+// expireSession deletes the session of clientId if still expired at now,
+// the client not connecting meanwhile.
+func expireSession(clientId string, now time.Time) (bool, error) {
+	unlock := clientLocks.lock(clientId)
+	defer unlock()
+	if _, ok := ConnRegistry.Get(clientId); ok {
+		return false, nil
+	}
+	raw, err := persister.Read(KeySession, clientId)
+	if err != nil || raw == nil {
+		return false, err
+	}
+	t, ok := mqtt.SessionSaved(KeySession, clientId, raw, persister)
+	if d := expiryOf(clientId); !ok || d <= 0 || now.Sub(t) < d {
+		return false, nil
+	}
+	return true, mqtt.DeleteSession(KeySession, clientId, persister)
+}
+
+// clientLocker serializes the connecting of a client, from loading its
+// session to registering the connection, and the expiry of its session.
+type clientLocker struct {
+	sync.Mutex
+	m map[string]*clientLock
+}
+
+type clientLock struct {
+	sync.Mutex
+	n int //holding or waiting
+}
+
+var clientLocks = &clientLocker{m: make(map[string]*clientLock)}
+
+// lock locks clientId, and returns the function unlocking it.
+func (cl *clientLocker) lock(clientId string) (unlock func()) {
+	cl.Lock()
+	l, ok := cl.m[clientId]
+	if !ok {
+		l = &clientLock{}
+		cl.m[clientId] = l
+	}
+	l.n++
+	cl.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		cl.Lock()
+		if l.n--; l.n == 0 {
+			delete(cl.m, clientId)
+		}
+		cl.Unlock()
+	}
+}
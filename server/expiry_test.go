@@ -0,0 +1,58 @@
+package server
+
+import (
+	"hilldan/mqtt"
+	"testing"
+	"time"
+)
+
+// expired receives the sessions expired, from the listener of TestMain.
+var expired = make(chan string, 10)
+
+func (testListener) OnSessionExpired(clientId string) {
+	select {
+	case expired <- clientId:
+	default:
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	initPersister()
+	SetSessionExpiry(time.Hour)
+	SetSessionExpiryFunc(func(clientId string, def time.Duration) time.Duration {
+		if clientId == "short" {
+			return time.Nanosecond
+		}
+		return def
+	})
+	defer SetSessionExpiry(0)
+	defer SetSessionExpiryFunc(nil)
+
+	for _, id := range []string{"short", "long"} {
+		if err := mqtt.NewSession().Save(KeySession, id, persister); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	expireSessions()
+
+	if id := <-expired; id != "short" {
+		t.Errorf("want 'short' expired actual '%s'", id)
+	}
+	if s, _ := mqtt.LoadSession(KeySession, "short", persister); s != nil {
+		t.Errorf("session 'short' should be purged")
+	}
+	if s, _ := mqtt.LoadSession(KeySession, "long", persister); s == nil {
+		t.Errorf("session 'long' should be kept")
+	}
+
+	//connected, or saved again, since listed
+	testConn(t, "short")
+	mqtt.NewSession().Save(KeySession, "short", persister)
+	if ok, err := expireSession("short", time.Now().Add(time.Hour)); ok || err != nil {
+		t.Errorf("session of a client connected expired %v", err)
+	}
+	if ok, _ := expireSession("long", time.Now()); ok {
+		t.Errorf("session saved lately expired")
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hilldan/mqtt"
+	"io"
+	"strings"
+)
+
+// Record is a line of the state exported, in JSON. Data is stored as is,
+// in the envelope of its version, so it is upgraded when loaded, see
+// mqtt.Unwrap.
+type Record struct {
+	Key      string `json:"key"`
+	Field    string `json:"field"`
+	ClientId string `json:"client_id,omitempty"` //of the session records
+	Data     []byte `json:"data"`
+}
+
+// StateFilter selects the state exported or imported. The zero value
+// selects everything.
+type StateFilter struct {
+	ClientIds []string //sessions of these clients only
+	Topic     string   //retained packets matched by this topic filter only
+	NoSession bool
+	NoRetain  bool
+}
+
+func (f StateFilter) session(clientId string) bool {
+	if f.NoSession {
+		return false
+	}
+	if len(f.ClientIds) == 0 {
+		return true
+	}
+	for _, v := range f.ClientIds {
+		if v == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+func (f StateFilter) retain(topic string) bool {
+	if f.NoRetain {
+		return false
+	}
+	if f.Topic == "" {
+		return true
+	}
+	return mqtt.MatchTopic(f.Topic, topic)
+}
+
+// Export writes the sessions and the retained packets in p selected by f to
+// w, as JSON lines of Record. It returns the number of records written.
+func Export(w io.Writer, p mqtt.Persister, f StateFilter) (n int, err error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	metas, err := p.LoadAll(KeySession)
+	if err != nil {
+		return
+	}
+	for clientId := range metas {
+		if !f.session(clientId) {
+			continue
+		}
+		var recs []Record
+		if recs, err = sessionRecords(p, clientId); err != nil {
+			return
+		}
+		for _, rec := range recs {
+			if err = enc.Encode(rec); err != nil {
+				return
+			}
+			n++
+		}
+	}
+
+	retains, err := p.LoadAll(KeyRetain)
+	if err != nil {
+		return
+	}
+	for topic, data := range retains {
+		if !f.retain(topic) {
+			continue
+		}
+		if err = enc.Encode(Record{Key: KeyRetain, Field: topic, Data: data}); err != nil {
+			return
+		}
+		n++
+	}
+	err = bw.Flush()
+	return
+}
+
+// sessionRecords returns the records of the session of clientId in p, none
+// if not persisted.
+func sessionRecords(p mqtt.Persister, clientId string) (recs []Record, err error) {
+	meta, err := p.Read(KeySession, clientId)
+	if err != nil || meta == nil {
+		return
+	}
+	recs = append(recs, Record{KeySession, clientId, clientId, meta})
+	for _, key := range mqtt.SessionKeys(KeySession, clientId) {
+		var datas map[string][]byte
+		if datas, err = p.LoadAll(key); err != nil {
+			return
+		}
+		for field, data := range datas {
+			recs = append(recs, Record{key, field, clientId, data})
+		}
+	}
+	return
+}
+
+// importSession replaces the session of clientId in p with recs, deleted if
+// none.
+func importSession(p mqtt.Persister, clientId string, recs []Record) error {
+	for _, rec := range recs {
+		if err := checkRecord(rec); err != nil {
+			return err
+		}
+		if rec.Key == KeyRetain || rec.ClientId != clientId {
+			return errors.New("record of another session " + rec.Key + "/" + rec.Field)
+		}
+	}
+	if err := mqtt.DeleteSession(KeySession, clientId, p); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if err := p.Save(rec.Key, rec.Field, rec.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import saves the records in r written by Export, selected by f, to p. The
+// sessions imported replace the ones of the same client id in p. It returns
+// the number of records saved.
+// The broker using p ought not to run meanwhile, since the state loaded by
+// it is not reloaded.
+func Import(r io.Reader, p mqtt.Persister, f StateFilter) (n int, err error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	replaced := make(map[string]bool) //clientId->session deleted
+	for line := 1; ; line++ {
+		var rec Record
+		if err = dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if err = checkRecord(rec); err != nil {
+			err = fmt.Errorf("record %d: %w", line, err)
+			return
+		}
+
+		if rec.Key == KeyRetain {
+			if !f.retain(rec.Field) {
+				continue
+			}
+		} else {
+			if !f.session(rec.ClientId) {
+				continue
+			}
+			if !replaced[rec.ClientId] {
+				if err = mqtt.DeleteSession(KeySession, rec.ClientId, p); err != nil {
+					return
+				}
+				replaced[rec.ClientId] = true
+			}
+		}
+		if err = p.Save(rec.Key, rec.Field, rec.Data); err != nil {
+			return
+		}
+		n++
+	}
+}
+
+// checkRecord refuses the record out of the state of the broker.
+func checkRecord(rec Record) error {
+	switch {
+	case rec.Key == KeyRetain:
+		return nil
+	case rec.Key == KeySession:
+		if rec.Field == rec.ClientId {
+			return nil
+		}
+	case strings.HasPrefix(rec.Key, KeySession+":"):
+		for _, k := range mqtt.SessionKeys(KeySession, rec.ClientId) {
+			if rec.Key == k {
+				return nil
+			}
+		}
+	}
+	return errors.New("unknown record " + rec.Key + "/" + rec.Field)
+}
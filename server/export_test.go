@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src := mqtt.NewMemPersist()
+	for _, id := range []string{"c1", "c2"} {
+		s := mqtt.NewSession()
+		s.AddPubOut(1, packet.PublishPacket{Qos: 1, TopicName: "a", PacketId: 1, ApplicationMessage: "m"})
+		s.AddPubIn(2)
+		s.AddSubscription([]packet.TopicFilter{{Topic: "a/#", Qos: 1}})
+		if err := s.Bind(KeySession, id, src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, topic := range []string{"dev/1/state", "dev/2/state", "other"} {
+		data, _ := mqtt.EncodeRetain(packet.PublishPacket{TopicName: packet.String(topic), ApplicationMessage: "x"}, time.Now())
+		src.Save(KeyRetain, topic, mqtt.Wrap(mqtt.KindRetain, data))
+	}
+
+	var buf bytes.Buffer
+	n, err := Export(&buf, src, StateFilter{ClientIds: []string{"c1"}, Topic: "dev/+/state"})
+	if err != nil || n != 6 {
+		t.Fatalf("export %d records, err: %v", n, err)
+	}
+
+	dst := mqtt.NewMemPersist()
+	old := mqtt.NewSession()
+	old.AddPubIn(9)
+	old.Bind(KeySession, "c1", dst)
+	if n, err = Import(bytes.NewReader(buf.Bytes()), dst, StateFilter{}); err != nil || n != 6 {
+		t.Fatalf("import %d records, err: %v", n, err)
+	}
+	s, err := mqtt.LoadSession(KeySession, "c1", dst)
+	if err != nil || s == nil || len(s.PubOut) != 1 || len(s.PubIn) != 1 || !s.PubIn[2] || len(s.Subscript) != 1 {
+		t.Errorf("session not imported: %+v %v", s, err)
+	}
+	if s, _ := mqtt.LoadSession(KeySession, "c2", dst); s != nil {
+		t.Errorf("session c2 should be filtered")
+	}
+	retains, _ := dst.LoadAll(KeyRetain)
+	if len(retains) != 2 || retains["other"] != nil {
+		t.Errorf("retained imported: %v", retains)
+	}
+
+	//filtered on import
+	dst = mqtt.NewMemPersist()
+	if n, _ = Import(bytes.NewReader(buf.Bytes()), dst, StateFilter{NoSession: true}); n != 2 {
+		t.Errorf("want 2 retained imported actual %d", n)
+	}
+
+	if _, err = Import(strings.NewReader(`{"key":"foo","field":"bar"}`), dst, StateFilter{}); err == nil {
+		t.Errorf("unknown record should be refused")
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"hilldan/mqtt"
 	"hilldan/mqtt/connection"
 	"hilldan/mqtt/packet"
-	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +13,7 @@ var (
 	persister mqtt.Persister
 	authCheck func(user, passwd string) bool
 	listener  mqtt.EventListener
+	logger    mqtt.Logger = mqtt.NopLogger{}
 )
 
 // TCP ports 8883 and 1883 are registered with IANA for MQTT TLS and non TLS communication
@@ -25,15 +26,35 @@ var (
 // Accepts Application Messages published by Clients.
 // Processes Subscribe and Unsubscribe requests from Clients.
 // Forwards Application Messages that match Client Subscriptions.
+//
+// A nil persist keeps sessions and retained packets in memory only. The
+// messages not acknowledged yet are recovered from the write-ahead log when
+// enabled, see SetWAL.
 func RunMQTT(server connection.Serverer, persist mqtt.Persister) {
 	persister = persist
 	if persister == nil {
-		panic("persisiter is nil")
+		persister = mqtt.NewMemPersist()
 	}
+	persister = timedPersist{persister}
 	if listener == nil {
 		listener = mqtt.DefaultListener{}
 	}
+	if err := checkStorage(); err != nil {
+		panic(err)
+	}
 	RetainRegistry = NewRetainRegistry()
+	if walEnabled {
+		msgLog = newWAL()
+	}
+	delayed = newScheduler()
+	go delayed.run()
+	go sweep()
+	startBridge()
+	if cluster != nil {
+		if err := cluster.Start(); err != nil {
+			panic(err)
+		}
+	}
 	server.Run(handler)
 }
 
@@ -52,6 +73,17 @@ func SetEventListener(l mqtt.EventListener) {
 	listener = l
 }
 
+// SetLogger assigns the logger of the broker, of the sessions persisted and of
+// the connections, see mqtt.SetLogger. The logs are discarded by default.
+func SetLogger(l mqtt.Logger) {
+	if l == nil {
+		l = mqtt.NopLogger{}
+	}
+	logger = l
+	mqtt.SetLogger(l)
+	connection.SetLogger(l)
+}
+
 // Publish send pub to the client specified by clientId.
 func Publish(pub packet.PublishPacket, clientId string) {
 	c, ok := ConnRegistry.Get(clientId)
@@ -61,7 +93,55 @@ func Publish(pub packet.PublishPacket, clientId string) {
 	c.publish(pub)
 }
 
+// The client ids of the publishers not connected, seen by the rules and in
+// the events.
+const (
+	AdminPublisher   = "$admin"   //admin API
+	RulePublisher    = "$rule"    //rule republishing
+	DelayedPublisher = "$delayed" //delayed and scheduled messages, once due
+)
+
+// inject publishes p as from, a publisher not connected such as the admin API
+// or the bridge, the same as a PUBLISH packet acknowledged: logged, applied
+// the rules, retained, distributed, forwarded and emitted. The rules are not
+// applied to the messages they republish, so that they do not loop.
+func inject(p packet.PublishPacket, from string) error {
+	id, err := msgLog.accept(p, from)
+	if err != nil {
+		metrics.drop("wal")
+		return err
+	}
+	if from != RulePublisher && applyRules(p, from) {
+		msgLog.drop(id)
+		metrics.drop("rule")
+		return nil
+	}
+	return publish(id, p, Event{Type: EventPublished, ClientId: from})
+}
+
+// publish retains, distributes and forwards p accepted as id, published by
+// e.ClientId, and emits e.
+func publish(id uint64, p packet.PublishPacket, e Event) (err error) {
+	if p.Retain {
+		if err = RetainRegistry.Add(string(p.TopicName), p); err == ErrRetainFull {
+			metrics.drop("retain_full")
+		}
+	}
+	msgLog.distribute(id, p, e.ClientId)
+	getBridge().out(p, e.ClientId)
+	cluster.publish(p)
+	e.Topic, e.Qos, e.Retain, e.Payload = string(p.TopicName), p.Qos, bool(p.Retain), []byte(p.ApplicationMessage)
+	emit(e)
+	go listener.OnPublishReceived(p)
+	return
+}
+
 func handler(cnn net.Conn) {
+	if !connectLimits.allow(cnn.RemoteAddr()) {
+		logger.Warn("connection refused", "remote_addr", cnn.RemoteAddr().String(), "err", ErrRateLimited)
+		cnn.Close()
+		return
+	}
 	//init
 	const N = 10
 	c := &mqttConn{
@@ -86,6 +166,13 @@ func handler(cnn net.Conn) {
 	}()
 	//handle all the packet
 	for pr := range c.readch {
+		if pr.Err == errRateDropped {
+			if c.deadline > 0 {
+				c.pingch <- struct{}{}
+			}
+			metrics.drop("rate_limit")
+			continue
+		}
 		if pr.Err != nil {
 			lastwill(pc, string(c.clientId))
 			c.closeConn(pr.Err.Error(), true)
@@ -95,10 +182,20 @@ func handler(cnn net.Conn) {
 			c.closeConn("connect fail", true)
 			goto exit
 		}
+		//handled here, so that the connection lost after it does not publish the will
+		if pr.P.ControlType() == packet.TypeDISCONNECT {
+			c.closeConn("disconnect", true)
+			goto exit
+		}
 		go handlePacket(pr.P, c, pc)
 	}
+	//the network connection closed without a disconnect packet
+	if !c.isDead() {
+		lastwill(pc, string(c.clientId))
+		c.closeConn("connection lost", true)
+	}
 exit:
-	log.Printf("handler no leak")
+	logger.Debug("handler exit", c.fields()...)
 }
 
 func lastwill(pc *packet.ConnectPacket, excludeId string) {
@@ -115,9 +212,13 @@ func lastwill(pc *packet.ConnectPacket, excludeId string) {
 		RetainRegistry.Add(string(pub.TopicName), pub)
 	}
 	ConnRegistry.Publish(pub, excludeId)
+	cluster.publish(pub)
 }
 
 func handlePacket(p packet.ControlPacketer, c *mqttConn, pc *packet.ConnectPacket) {
+	if mqtt.DebugEnabled(logger) {
+		logger.Debug("packet received", c.fields(mqtt.PacketFields(p)...)...)
+	}
 	if c.deadline > 0 {
 		c.pingch <- struct{}{}
 	}
@@ -128,6 +229,26 @@ func handlePacket(p packet.ControlPacketer, c *mqttConn, pc *packet.ConnectPacke
 	// case packet.TypeCONNACK:
 	case packet.TypePUBLISH:
 		pk := p.(*packet.PublishPacket)
+		dup := pk.Qos == packet.QoS2 && bool(pk.Dup) && c.session.GetPubIn(pk.PacketId)
+		var id uint64
+		delay, topic, isDelayed := delayedTopic(string(pk.TopicName))
+		if !dup {
+			//logged or scheduled before acknowledged, not acknowledged if failed
+			var err error
+			if isDelayed {
+				d := *pk
+				d.TopicName = packet.String(topic)
+				if _, err = ScheduleAt(time.Now().Add(delay), d); err != nil {
+					logger.Error("schedule fail", c.fields(append(mqtt.PacketFields(pk), "err", err)...)...)
+					metrics.drop("delayed")
+					return
+				}
+			} else if id, err = msgLog.accept(*pk, c.clientId); err != nil {
+				logger.Error("write-ahead log fail", c.fields(append(mqtt.PacketFields(pk), "err", err)...)...)
+				metrics.drop("wal")
+				return
+			}
+		}
 		//response
 		switch pk.Qos {
 		case packet.QoS0:
@@ -135,27 +256,36 @@ func handlePacket(p packet.ControlPacketer, c *mqttConn, pc *packet.ConnectPacke
 			c.writech <- &packet.PubackPacket{PacketId: pk.PacketId}
 		case packet.QoS2:
 			c.writech <- &packet.PubrecPacket{PacketId: pk.PacketId}
-			if bool(pk.Dup) && c.session.GetPubIn(pk.PacketId) {
+			if dup {
 				return
 			}
 			c.session.AddPubIn(pk.PacketId)
 		}
 
 		// save and distribute
-		if pk.Retain {
-			RetainRegistry.Add(string(pk.TopicName), *pk)
+		atomic.AddUint64(&metrics.received, 1)
+		if isDelayed {
+			//the rules are applied once due
+			return
 		}
-		ConnRegistry.Publish(*pk, c.clientId)
-		go listener.OnPublishReceived(*pk)
+		//applied once accepted, so not again when retried
+		if applyRules(*pk, c.clientId) {
+			msgLog.drop(id)
+			metrics.drop("rule")
+			return
+		}
+		publish(id, *pk, c.event(EventPublished))
 
 	case packet.TypePUBACK:
 		pk := p.(*packet.PubackPacket)
 		c.session.RemovePubOut(pk.PacketId)
+		msgLog.ack(c.clientId, pk.PacketId)
 
 	case packet.TypePUBREC:
 		pk := p.(*packet.PubrecPacket)
 		c.writech <- &packet.PubrelPacket{PacketId: pk.PacketId}
 		c.session.RemovePubOut(pk.PacketId)
+		msgLog.ack(c.clientId, pk.PacketId)
 
 	case packet.TypePUBREL:
 		pk := p.(*packet.PubrelPacket)
@@ -168,13 +298,21 @@ func handlePacket(p packet.ControlPacketer, c *mqttConn, pc *packet.ConnectPacke
 
 	case packet.TypeSUBSCRIBE:
 		pk := p.(*packet.SubscribePacket)
-		c.subscribe(*pk)
+		if rs := replays(pk.TopicFilters); len(rs) > 0 {
+			c.subscribeReplay(*pk, rs)
+		} else {
+			c.subscribe(*pk, nil)
+		}
+		cluster.subscribed(c.clientId, c.session.GetSubscription())
+		e := c.event(EventSubscribed)
+		e.Filters = topicsOf(pk.TopicFilters)
+		emit(e)
 		go listener.OnSubscribeSuccess(pk.TopicFilters)
 
 	// case packet.TypeSUBACK:
 	case packet.TypeUNSUBSCRIBE:
 		pk := p.(*packet.UnsubscribePacket)
-		c.session.Unsubscription(pk.TopicFilter)
+		c.unsubscribe(pk.TopicFilter)
 		c.writech <- &packet.UnsubackPacket{PacketId: pk.PacketId}
 		go listener.OnUnsubscribeSuccess(pk.TopicFilter)
 
@@ -183,10 +321,6 @@ func handlePacket(p packet.ControlPacketer, c *mqttConn, pc *packet.ConnectPacke
 		c.writech <- &packet.PingrespPacket{}
 
 	// case packet.TypePINGRESP:
-	case packet.TypeDISCONNECT:
-		pc.WillFlag = false
-		c.closeConn("disconnect", true)
-
 	default:
 		c.closeConn("invalid packet", true)
 	}
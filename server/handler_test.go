@@ -0,0 +1,49 @@
+package server
+
+import (
+	"hilldan/mqtt/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLastWill(t *testing.T) {
+	initPersister()
+
+	c := testConn(t, "will-watcher")
+	c.session.AddSubscription([]packet.TopicFilter{{Topic: "will/#"}})
+	connect := func(clientId string, disconnect bool) {
+		cnn, peer := net.Pipe()
+		go handler(cnn)
+		(&packet.ConnectPacket{
+			ClientId:     packet.String(clientId),
+			CleanSession: true,
+			WillFlag:     true,
+			WillTopic:    packet.String("will/" + clientId),
+			WillMessage:  "gone",
+		}).WriteTo(peer)
+		if p, err := packet.ParsePacket(peer); err != nil || p.ControlType() != packet.TypeCONNACK {
+			t.Fatalf("not connected %v %v", p, err)
+		}
+		if disconnect {
+			(&packet.DisconnectPacket{}).WriteTo(peer)
+		}
+		peer.Close()
+	}
+	//closed right after the disconnect packet
+	connect("clean", true)
+	connect("lost", false)
+	select {
+	case p := <-c.writech:
+		if pp := p.(*packet.PublishPacket); pp.TopicName != "will/lost" {
+			t.Errorf("will of %s published", pp.TopicName)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("will not published")
+	}
+	select {
+	case p := <-c.writech:
+		t.Errorf("will published %v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
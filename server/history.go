@@ -0,0 +1,339 @@
+package server
+
+import (
+	"errors"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayPrefix prefixes the filters subscribed to replay the history of the
+// messages: subscribing to "$replay/<since>/<filter>" subscribes to <filter>,
+// and sends the messages kept of the topics matched since <since>, which is
+// either a unix time in seconds, or "seq:<n>" for the messages after the nth
+// one, see History.
+const ReplayPrefix = "$replay/"
+
+type historyRule struct {
+	filter    string
+	maxCount  int
+	maxAge    time.Duration
+	maxTopics int
+}
+
+var (
+	historyRules  []historyRule
+	historyRulesl sync.RWMutex
+)
+
+// SetHistoryFor keeps the history of the messages published to the topics
+// matched by filter, the last maxCount messages a topic, and the ones of the
+// last maxAge, zero for no limit. The topics no longer published are dropped
+// once their messages are too old, or once more than maxTopics topics are
+// kept for filter, the topic published the longest ago first. So either
+// maxAge or both maxCount and maxTopics are required. The filter assigned
+// first wins when several match. The history is kept in memory.
+func SetHistoryFor(filter string, maxCount int, maxAge time.Duration, maxTopics int) error {
+	if _, err := WildcardRegistry.Get(filter); err != nil {
+		return err
+	}
+	if maxAge <= 0 && (maxCount <= 0 || maxTopics <= 0) {
+		return errors.New("history not limited")
+	}
+	historyRulesl.Lock()
+	historyRules = append(historyRules, historyRule{filter, maxCount, maxAge, maxTopics})
+	historyRulesl.Unlock()
+	return nil
+}
+
+func getHistoryRules() []historyRule {
+	historyRulesl.RLock()
+	defer historyRulesl.RUnlock()
+	return historyRules
+}
+
+func historyRuleOf(topic string) (historyRule, bool) {
+	for _, v := range getHistoryRules() {
+		if mqtt.MatchTopic(v.filter, topic) {
+			return v, true
+		}
+	}
+	return historyRule{}, false
+}
+
+// HistoryMessage is a message kept in the history.
+type HistoryMessage struct {
+	Seq    uint64 //of the messages of all the topics
+	Time   time.Time
+	Packet packet.PublishPacket
+}
+
+type historyRegistry struct {
+	sync.Mutex
+	seq     uint64
+	topics  map[string][]HistoryMessage //topic->messages, the oldest first
+	tree    *topicTree
+	filters map[string]string              //topic->filter of its rule
+	byRule  map[string]map[string]struct{} //filter->topics
+}
+
+var histories = newHistoryRegistry()
+
+func newHistoryRegistry() *historyRegistry {
+	return &historyRegistry{
+		topics:  make(map[string][]HistoryMessage),
+		tree:    newTopicTree(),
+		filters: make(map[string]string),
+		byRule:  make(map[string]map[string]struct{}),
+	}
+}
+
+// History returns the messages kept of the topics matched by filter, after
+// the message of seq and not before since, by Seq.
+func History(filter string, seq uint64, since time.Time) []HistoryMessage {
+	msgs, _ := histories.since(filter, seq, since)
+	return msgs
+}
+
+// record keeps p, if its topic has history, and returns its Seq, 0 if not
+// kept.
+func (h *historyRegistry) record(p packet.PublishPacket) uint64 {
+	topic := string(p.TopicName)
+	rule, ok := historyRuleOf(topic)
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	p.PacketId, p.Dup, p.Retain = 0, false, false
+	h.Lock()
+	defer h.Unlock()
+	h.seq++
+	msgs := append(h.topics[topic], HistoryMessage{h.seq, now, p})
+	if rule.maxCount > 0 && len(msgs) > rule.maxCount {
+		msgs = append(msgs[:0:0], msgs[len(msgs)-rule.maxCount:]...)
+	}
+	if len(h.topics[topic]) == 0 {
+		h.add(topic, rule)
+	}
+	h.topics[topic] = msgs
+	h.expireTopic(topic, rule, now)
+	return h.seq
+}
+
+// add indexes topic new, dropping the topic of rule published the longest
+// ago once too many.
+func (h *historyRegistry) add(topic string, rule historyRule) {
+	topics := h.byRule[rule.filter]
+	if topics == nil {
+		topics = make(map[string]struct{})
+		h.byRule[rule.filter] = topics
+	}
+	if rule.maxTopics > 0 && len(topics) >= rule.maxTopics {
+		var oldest string
+		var seq uint64
+		for t := range topics {
+			msgs := h.topics[t]
+			if last := msgs[len(msgs)-1].Seq; oldest == "" || last < seq {
+				oldest, seq = t, last
+			}
+		}
+		h.remove(oldest)
+	}
+	topics[topic] = struct{}{}
+	h.filters[topic] = rule.filter
+	h.tree.Add(topic)
+}
+
+// remove drops topic and its messages.
+func (h *historyRegistry) remove(topic string) {
+	delete(h.topics, topic)
+	h.tree.Remove(topic)
+	if topics := h.byRule[h.filters[topic]]; topics != nil {
+		delete(topics, topic)
+		if len(topics) == 0 {
+			delete(h.byRule, h.filters[topic])
+		}
+	}
+	delete(h.filters, topic)
+}
+
+// expireTopic drops the messages of topic older than the rule allows.
+func (h *historyRegistry) expireTopic(topic string, rule historyRule, now time.Time) {
+	if rule.maxAge <= 0 {
+		return
+	}
+	msgs := h.topics[topic]
+	i := sort.Search(len(msgs), func(i int) bool { return now.Sub(msgs[i].Time) < rule.maxAge })
+	if i == 0 {
+		return
+	}
+	if i == len(msgs) {
+		h.remove(topic)
+		return
+	}
+	h.topics[topic] = append(msgs[:0:0], msgs[i:]...)
+}
+
+// Expire drops the messages too old.
+func (h *historyRegistry) Expire() {
+	now := time.Now()
+	h.Lock()
+	defer h.Unlock()
+	for topic := range h.topics {
+		if rule, ok := historyRuleOf(topic); ok && rule.filter == h.filters[topic] {
+			h.expireTopic(topic, rule, now)
+		} else {
+			h.remove(topic)
+		}
+	}
+}
+
+// since returns the messages of History, and the last Seq recorded.
+func (h *historyRegistry) since(filter string, seq uint64, since time.Time) (msgs []HistoryMessage, last uint64) {
+	now := time.Now()
+	h.Lock()
+	defer h.Unlock()
+	for _, topic := range h.tree.Match(filter) {
+		rule, _ := historyRuleOf(topic)
+		for _, m := range h.topics[topic] {
+			if m.Seq <= seq || m.Time.Before(since) || rule.maxAge > 0 && now.Sub(m.Time) >= rule.maxAge {
+				continue
+			}
+			msgs = append(msgs, m)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+	return msgs, h.seq
+}
+
+// parseSince parses the start of a replay, see ReplayPrefix.
+func parseSince(s string) (seq uint64, since time.Time, err error) {
+	if v, ok := strings.CutPrefix(s, "seq:"); ok {
+		seq, err = strconv.ParseUint(v, 10, 64)
+		return
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return
+	}
+	return 0, time.Unix(secs, 0), nil
+}
+
+// replay is a replay subscribed.
+type replay struct {
+	index  int //of the filter subscribed
+	filter packet.TopicFilter
+	seq    uint64
+	since  time.Time
+}
+
+// replays takes the replays out of the filters subscribed, replaced by the
+// filters replayed. The replays invalid are subscribed as they are.
+func replays(tfs []packet.TopicFilter) (rs []replay) {
+	for i, v := range tfs {
+		rest, ok := strings.CutPrefix(string(v.Topic), ReplayPrefix)
+		if !ok {
+			continue
+		}
+		s, filter, _ := strings.Cut(rest, "/")
+		seq, since, err := parseSince(s)
+		if err != nil || filter == "" {
+			continue
+		}
+		if _, err = WildcardRegistry.Get(filter); err != nil {
+			continue
+		}
+		tfs[i].Topic = packet.String(filter)
+		rs = append(rs, replay{i, tfs[i], seq, since})
+	}
+	return
+}
+
+// replaying reports whether the ith filter subscribed is replayed.
+func replaying(rs []replay, i int) bool {
+	for _, r := range rs {
+		if r.index == i {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribeReplay subscribes p, and sends the history of the replays instead
+// of the retained messages. The messages published meanwhile are sent after
+// the history, and once: the ones recorded before the history was taken are
+// in it, and not delivered again. The history is sent unlocked, so that the
+// publishers are not held back by a slow subscriber.
+func (c *mqttConn) subscribeReplay(p packet.SubscribePacket, rs []replay) {
+	done := make(chan struct{})
+	defer close(done)
+	c.replayl.Lock()
+	c.replayDone = done
+	c.replayl.Unlock()
+	c.subscribe(p, rs)
+
+	var msgs []packet.PublishPacket
+	c.replayl.Lock()
+	c.replayFilters = c.replayFilters[:0]
+	for _, r := range rs {
+		ms, last := histories.since(string(r.filter.Topic), r.seq, r.since)
+		for _, m := range ms {
+			p := m.Packet
+			if p.Qos > r.filter.Qos {
+				p.Qos = r.filter.Qos
+			}
+			msgs = append(msgs, p)
+		}
+		if last > c.replayedSeq {
+			c.replayedSeq = last
+		}
+		c.replayFilters = append(c.replayFilters, string(r.filter.Topic))
+	}
+	c.replayl.Unlock()
+	for _, p := range msgs {
+		c.publish(p)
+	}
+}
+
+// deliver sends p of Seq seq published, after the replay in progress, unless
+// sent by the replay: its delivery is acknowledged then, so that the
+// write-ahead log does not keep it.
+func (c *mqttConn) deliver(p packet.PublishPacket, seq uint64) {
+	c.replayl.RLock()
+	done := c.replayDone
+	c.replayl.RUnlock()
+	if done != nil {
+		select {
+		case <-done:
+		case <-c.exitch:
+			return
+		}
+	}
+	if c.replayed(string(p.TopicName), seq) {
+		if p.Qos != packet.QoS0 {
+			msgLog.ack(c.clientId, p.PacketId)
+		}
+		return
+	}
+	c.send(p)
+}
+
+// replayed reports whether the message of topic and Seq seq has been sent by
+// the replay.
+func (c *mqttConn) replayed(topic string, seq uint64) bool {
+	c.replayl.RLock()
+	defer c.replayl.RUnlock()
+	if seq == 0 || seq > c.replayedSeq {
+		return false
+	}
+	for _, f := range c.replayFilters {
+		if mqtt.MatchTopic(f, topic) {
+			return true
+		}
+	}
+	return false
+}
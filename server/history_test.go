@@ -0,0 +1,158 @@
+package server
+
+import (
+	"hilldan/mqtt/packet"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseSince(t *testing.T) {
+	if seq, since, err := parseSince("seq:12"); err != nil || seq != 12 || !since.IsZero() {
+		t.Errorf("seq %d %v %v", seq, since, err)
+	}
+	if seq, since, err := parseSince("1700000000"); err != nil || seq != 0 || since.Unix() != 1700000000 {
+		t.Errorf("time %d %v %v", seq, since, err)
+	}
+	for _, s := range []string{"", "seq:", "seq:-1", "x", "1.5"} {
+		if _, _, err := parseSince(s); err == nil {
+			t.Errorf("'%s' parsed", s)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	initPersister()
+	defer resetHistory()
+
+	if err := SetHistoryFor("a/#/b", 1, time.Minute, 0); err == nil {
+		t.Errorf("invalid filter")
+	}
+	if err := SetHistoryFor("a/#", 1, 0, 0); err == nil {
+		t.Errorf("topics not limited")
+	}
+	if err := SetHistoryFor("a/#", 0, 0, 10); err == nil {
+		t.Errorf("count not limited")
+	}
+	SetHistoryFor("sensors/+/temp", 2, time.Minute, 0)
+	SetHistoryFor("sensors/#", 0, 100*time.Millisecond, 0)
+	SetHistoryFor("count/+", 1, 0, 2)
+
+	pub := testConn(t, "historian")
+	publish := func(topic string, payload string) {
+		handlePacket(&packet.PublishPacket{Qos: 1, PacketId: 1, TopicName: packet.String(topic), ApplicationMessage: packet.String(payload)}, pub, nil)
+		<-pub.writech
+	}
+	for i := 1; i <= 3; i++ {
+		publish("sensors/d1/temp", strconv.Itoa(i))
+	}
+	publish("sensors/d1/hum", "4")
+	publish("other", "5")
+
+	msgs := History("#", 0, time.Time{})
+	if len(msgs) != 3 || msgs[0].Packet.ApplicationMessage != "2" || msgs[2].Packet.TopicName != "sensors/d1/hum" {
+		t.Fatalf("history %+v", msgs)
+	}
+	if msgs := History("sensors/+/temp", msgs[0].Seq, time.Time{}); len(msgs) != 1 || msgs[0].Packet.ApplicationMessage != "3" {
+		t.Errorf("since seq %+v", msgs)
+	}
+	var got []AdminHistory
+	h := AdminHandler("secret")
+	adminDo(t, h, "GET", "/history?filter=sensors/%2B/temp&since=seq:0", "", &got)
+	if len(got) != 2 || got[1].Seq != msgs[1].Seq || string(got[1].Payload) != "3" {
+		t.Errorf("admin %+v", got)
+	}
+	if code := adminDo(t, h, "GET", "/history?since=x", "", nil); code != 400 {
+		t.Errorf("want 400 actual %d", code)
+	}
+
+	//the retained one not sent by the replay
+	RetainRegistry.Add("sensors/d2/temp", packet.PublishPacket{TopicName: "sensors/d2/temp", ApplicationMessage: "r", Retain: true})
+	defer RetainRegistry.Add("sensors/d2/temp", packet.PublishPacket{TopicName: "sensors/d2/temp"})
+	c := testConn(t, "replayer")
+	since := strconv.FormatUint(msgs[0].Seq, 10)
+	handlePacket(&packet.SubscribePacket{PacketId: 2, TopicFilters: []packet.TopicFilter{
+		{Topic: packet.String(ReplayPrefix + "seq:" + since + "/sensors/#"), Qos: 0},
+		{Topic: ReplayPrefix + "x/a", Qos: 0},
+	}}, c, nil)
+	if p, ok := (<-c.writech).(*packet.SubackPacket); !ok || p.Code[0] != 0 {
+		t.Fatalf("not subscribed %v", p)
+	}
+	for _, want := range []string{"3", "4"} {
+		p := (<-c.writech).(*packet.PublishPacket)
+		if string(p.ApplicationMessage) != want || p.Qos != packet.QoS0 {
+			t.Errorf("want %s actual %s qos %d", want, p.ApplicationMessage, p.Qos)
+		}
+	}
+	//the ones replayed not delivered again
+	c.deliver(msgs[1].Packet, msgs[1].Seq)
+	c.deliver(packet.PublishPacket{TopicName: "sensors/d1/temp", ApplicationMessage: "live"}, 0)
+	if p := (<-c.writech).(*packet.PublishPacket); p.ApplicationMessage != "live" {
+		t.Errorf("want live actual %s", p.ApplicationMessage)
+	}
+	select {
+	case p := <-c.writech:
+		t.Errorf("sent %v", p)
+	default:
+	}
+	subs := c.session.GetSubscription()
+	if len(subs) != 2 || subs[0].Topic != "sensors/#" || subs[1].Topic != ReplayPrefix+"x/a" {
+		t.Errorf("subscriptions %v", subs)
+	}
+
+	//the topic published the longest ago dropped
+	for _, topic := range []string{"count/1", "count/2", "count/1", "count/3"} {
+		publish(topic, topic)
+	}
+	if msgs := History("count/+", 0, time.Time{}); len(msgs) != 2 || msgs[0].Packet.TopicName != "count/1" || msgs[1].Packet.TopicName != "count/3" {
+		t.Errorf("topics not limited %+v", msgs)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	histories.Expire()
+	if msgs := History("sensors/#", 0, time.Time{}); len(msgs) != 2 {
+		t.Errorf("expired %+v", msgs)
+	}
+	if msgs := History("count/+", 0, time.Time{}); len(msgs) != 2 {
+		t.Errorf("expired without age %+v", msgs)
+	}
+}
+
+func TestReplayAcknowledged(t *testing.T) {
+	initPersister()
+	defer resetHistory()
+	SetHistoryFor("h/#", 10, time.Minute, 0)
+
+	c := testConn(t, "overlapped")
+	handlePacket(&packet.SubscribePacket{PacketId: 1, TopicFilters: []packet.TopicFilter{
+		{Topic: ReplayPrefix + "0/h/#", Qos: 1},
+	}}, c, nil)
+	<-c.writech
+	//recorded before the history was taken, delivered after the replay
+	histories.Lock()
+	next := histories.seq + 1
+	histories.Unlock()
+	c.replayl.Lock()
+	c.replayedSeq = next
+	c.replayl.Unlock()
+
+	p := packet.PublishPacket{Qos: 1, TopicName: "h/1", ApplicationMessage: "m"}
+	id, err := msgLog.accept(p, "pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgLog.distribute(id, p, "pub")
+	waitFor(t, "skipped delivery acknowledged", func() bool { return msgLog.Len() == 0 })
+	select {
+	case p := <-c.writech:
+		t.Errorf("sent again %v", p)
+	default:
+	}
+}
+
+func resetHistory() {
+	historyRulesl.Lock()
+	historyRules = nil
+	historyRulesl.Unlock()
+	histories.Expire()
+}
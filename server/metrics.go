@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsHandler returns the handler exposing the metrics of the broker in
+// the Prometheus text format, to be mounted, such as:
+//
+//	http.Handle("/metrics", server.MetricsHandler())
+//
+// next to WebsocketServer.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+}
+
+var metrics = newBrokerMetrics()
+
+// labeled is a counter by label.
+type labeled struct {
+	sync.Mutex
+	m map[string]uint64
+}
+
+func (l *labeled) add(label string, n uint64) {
+	l.Lock()
+	if l.m == nil {
+		l.m = make(map[string]uint64)
+	}
+	l.m[label] += n
+	l.Unlock()
+}
+
+func (l *labeled) snapshot() map[string]uint64 {
+	l.Lock()
+	defer l.Unlock()
+	m := make(map[string]uint64, len(l.m))
+	for k, v := range l.m {
+		m[k] = v
+	}
+	return m
+}
+
+type histogram struct {
+	sync.Mutex
+	bounds []float64 //upper bounds of the buckets
+	counts []uint64
+	sum    float64
+	n      uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.Lock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.n++
+	h.Unlock()
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.Lock()
+	defer h.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.n)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.n)
+}
+
+type brokerMetrics struct {
+	connects    uint64
+	disconnects labeled //reason->count
+	packetsIn   labeled //type->count
+	packetsOut  labeled
+	bytesIn     labeled
+	bytesOut    labeled
+	received    uint64
+	fanout      *histogram
+	dropped     labeled               //reason->count
+	limited     labeled               //limit->count
+	persist     map[string]*histogram //operation->latency
+}
+
+func newBrokerMetrics() *brokerMetrics {
+	m := &brokerMetrics{
+		fanout:  newHistogram(0, 1, 2, 5, 10, 50, 100, 1000),
+		persist: make(map[string]*histogram),
+	}
+	for _, op := range []string{"save", "read", "delete", "loadall"} {
+		m.persist[op] = newHistogram(.0001, .0005, .001, .005, .01, .05, .1, .5, 1)
+	}
+	return m
+}
+
+// reasons labels the causes of closing, the other causes are errors.
+var reasons = map[string]string{
+	"disconnect":            "disconnect",
+	"old conn":              "taken_over",
+	"keepalive timeout":     "keepalive_timeout",
+	"auth fail":             "auth_fail",
+	"protocol err":          "protocol_error",
+	"invalid packet":        "invalid_packet",
+	"second connect packet": "invalid_packet",
+	"the first packet is not a connect packet": "invalid_packet",
+	"connect fail":                        "invalid_packet",
+	"rate limited":                        "rate_limited",
+	"waitting for connect packet timeout": "connect_timeout",
+}
+
+func (m *brokerMetrics) disconnect(cause string) {
+	reason, ok := reasons[cause]
+	if !ok {
+		reason = "error"
+	}
+	m.disconnects.add(reason, 1)
+}
+
+func (m *brokerMetrics) packetIn(t packet.Bit4, n int64) {
+	m.packetsIn.add(t.Name(), 1)
+	m.bytesIn.add(t.Name(), uint64(n))
+}
+
+func (m *brokerMetrics) packetOut(t packet.Bit4, n int64) {
+	m.packetsOut.add(t.Name(), 1)
+	m.bytesOut.add(t.Name(), uint64(n))
+}
+
+func (m *brokerMetrics) drop(reason string) {
+	m.dropped.add(reason, 1)
+}
+
+func (m *brokerMetrics) limit(name string) {
+	m.limited.add(name, 1)
+}
+
+func (m *brokerMetrics) observePersist(op string, start time.Time) {
+	m.persist[op].observe(time.Since(start).Seconds())
+}
+
+// write writes all the metrics in the Prometheus text format.
+func (m *brokerMetrics) write(w io.Writer) {
+	gauge := func(name, help string, v int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	vec := func(name, help, label string, l *labeled) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		snap := l.snapshot()
+		keys := make([]string, 0, len(snap))
+		for k := range snap {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, snap[k])
+		}
+	}
+
+	conns, inflight := 0, 0
+	ConnRegistry.RLock()
+	conns = len(ConnRegistry.Conns)
+	for _, c := range ConnRegistry.Conns {
+		c.session.RLock()
+		inflight += len(c.session.PubOut)
+		c.session.RUnlock()
+	}
+	ConnRegistry.RUnlock()
+	retained := 0
+	if RetainRegistry != nil {
+		RetainRegistry.RLock()
+		retained = len(RetainRegistry.PubRetain)
+		RetainRegistry.RUnlock()
+	}
+
+	gauge("mqtt_connections", "Connections established.", conns)
+	counter("mqtt_connects_total", "Connections accepted.", atomic.LoadUint64(&m.connects))
+	vec("mqtt_disconnects_total", "Connections closed by reason.", "reason", &m.disconnects)
+	vec("mqtt_packets_received_total", "Packets received by control type.", "type", &m.packetsIn)
+	vec("mqtt_packets_sent_total", "Packets sent by control type.", "type", &m.packetsOut)
+	vec("mqtt_bytes_received_total", "Bytes received by control type.", "type", &m.bytesIn)
+	vec("mqtt_bytes_sent_total", "Bytes sent by control type.", "type", &m.bytesOut)
+	counter("mqtt_messages_received_total", "Application messages received.", atomic.LoadUint64(&m.received))
+	fmt.Fprintf(w, "# HELP mqtt_publish_fanout Subscribers a message is sent to.\n# TYPE mqtt_publish_fanout histogram\n")
+	m.fanout.write(w, "mqtt_publish_fanout", "")
+	vec("mqtt_messages_dropped_total", "Application messages dropped by reason.", "reason", &m.dropped)
+	vec("mqtt_rate_limited_total", "Rate limits hit by limit.", "limit", &m.limited)
+	gauge("mqtt_inflight_messages", "Messages sent to the connections, not acknowledged.", inflight)
+	gauge("mqtt_wal_messages", "Messages in the write-ahead log.", msgLog.Len())
+	gauge("mqtt_retained_messages", "Messages retained.", retained)
+
+	fmt.Fprintf(w, "# HELP mqtt_persister_seconds Latency of the persister by operation.\n# TYPE mqtt_persister_seconds histogram\n")
+	ops := make([]string, 0, len(m.persist))
+	for op := range m.persist {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		m.persist[op].write(w, "mqtt_persister_seconds", fmt.Sprintf("op=%q", op))
+	}
+}
+
+// timedPersist measures the latency of the persister.
+type timedPersist struct {
+	mqtt.Persister
+}
+
+func (tp timedPersist) Save(key, field string, data []byte) error {
+	defer metrics.observePersist("save", time.Now())
+	return tp.Persister.Save(key, field, data)
+}
+func (tp timedPersist) Read(key, field string) ([]byte, error) {
+	defer metrics.observePersist("read", time.Now())
+	return tp.Persister.Read(key, field)
+}
+func (tp timedPersist) Delete(key, field string) error {
+	defer metrics.observePersist("delete", time.Now())
+	return tp.Persister.Delete(key, field)
+}
+func (tp timedPersist) LoadAll(key string) (map[string][]byte, error) {
+	defer metrics.observePersist("loadall", time.Now())
+	return tp.Persister.LoadAll(key)
+}
+
+// countReader counts the bytes read.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(b []byte) (n int, err error) {
+	n, err = cr.r.Read(b)
+	cr.n += int64(n)
+	return
+}
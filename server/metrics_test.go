@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	//not the global one, written by the connections of other tests still
+	m := newBrokerMetrics()
+	m.disconnect("keepalive timeout")
+	m.disconnect("parse err: EOF")
+	m.packetIn(packet.TypePUBLISH, 12)
+	m.packetIn(packet.TypePUBLISH, 8)
+	m.packetOut(packet.TypePINGRESP, 2)
+	m.fanout.observe(3)
+	m.drop("no_subscriber")
+	m.observePersist("save", time.Now())
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	body := buf.String()
+	for _, want := range []string{
+		`mqtt_disconnects_total{reason="keepalive_timeout"} 1`,
+		`mqtt_disconnects_total{reason="error"} 1`,
+		`mqtt_packets_received_total{type="publish"} 2`,
+		`mqtt_bytes_received_total{type="publish"} 20`,
+		`mqtt_packets_sent_total{type="pingresp"} 1`,
+		`mqtt_publish_fanout_bucket{le="2"} 0`,
+		`mqtt_publish_fanout_bucket{le="5"} 1`,
+		`mqtt_publish_fanout_count 1`,
+		`mqtt_messages_dropped_total{reason="no_subscriber"} 1`,
+		`mqtt_persister_seconds_count{op="save"} 1`,
+		"# TYPE mqtt_connections gauge",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("'%s' not found in:\n%s", want, body)
+		}
+	}
+
+	timedPersist{mqtt.NewMemPersist()}.Save("k", "f", nil)
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `mqtt_persister_seconds_count{op="save"}`) {
+		t.Errorf("persister not timed:\n%s", rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("content type %s", ct)
+	}
+}
+
+func TestCountReader(t *testing.T) {
+	r := &countReader{r: strings.NewReader("\xc0\x00")}
+	p, err := packet.ParsePacket(r)
+	if err != nil || p.ControlType() != packet.TypePINGREQ || r.n != 2 {
+		t.Errorf("%v %v %d", p, err, r.n)
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"errors"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// RatePolicy is what the broker does to a client exceeding a rate limit.
+type RatePolicy int
+
+const (
+	RateDelay      RatePolicy = iota //reading from the client delayed until within the limit
+	RateDropQoS0                     //its QoS 0 messages dropped, the other packets delayed
+	RateDisconnect                   //the client disconnected
+)
+
+// ErrRateLimited closes the connections exceeding a limit of RateDisconnect.
+var ErrRateLimited = errors.New("rate limited")
+
+// errRateDropped marks the packets dropped by RateDropQoS0.
+var errRateDropped = errors.New("rate limit dropped")
+
+// RateLimit is a token bucket refilled by Rate tokens a second, up to Burst,
+// which defaults to Rate and is at least 1. A zero Rate is no limit.
+type RateLimit struct {
+	Rate   float64
+	Burst  float64
+	Policy RatePolicy
+}
+
+// RateLimits are the limits of the broker, see SetRateLimits.
+type RateLimits struct {
+	ConnectsPerIP RateLimit //connections accepted a second of an IP, refused over it whatever the Policy
+	Packets       RateLimit //packets read a second of a client
+	Bytes         RateLimit //bytes read a second of a client
+}
+
+var (
+	rateLimits    RateLimits
+	rateLimitsl   sync.RWMutex //of rateLimits and publishRateRules
+	connectLimits = &ipBuckets{m: make(map[string]*bucket)}
+)
+
+// SetRateLimits assigns the limits of the connections and of every client,
+// none by default. The clients connected keep their limits.
+func SetRateLimits(l RateLimits) {
+	rateLimitsl.Lock()
+	rateLimits = l
+	rateLimitsl.Unlock()
+}
+
+func getRateLimits() RateLimits {
+	rateLimitsl.RLock()
+	defer rateLimitsl.RUnlock()
+	return rateLimits
+}
+
+type publishRateRule struct {
+	filter string
+	b      *bucket
+}
+
+var publishRateRules []publishRateRule
+
+// SetPublishRateFor limits the messages a second published to the topics
+// matched by filter, by all the clients together. The filter assigned first
+// wins when several match. Since the bucket is shared, RateDelay delays a
+// client by Burst/Rate at most for the messages of the others.
+func SetPublishRateFor(filter string, l RateLimit) error {
+	if _, err := WildcardRegistry.Get(filter); err != nil {
+		return err
+	}
+	if l.Rate <= 0 {
+		return errors.New("invalid rate")
+	}
+	rateLimitsl.Lock()
+	publishRateRules = append(publishRateRules, publishRateRule{filter, newBucket(l)})
+	rateLimitsl.Unlock()
+	return nil
+}
+
+func publishRateOf(topic string) *bucket {
+	rateLimitsl.RLock()
+	defer rateLimitsl.RUnlock()
+	for _, v := range publishRateRules {
+		if mqtt.MatchTopic(v.filter, topic) {
+			return v.b
+		}
+	}
+	return nil
+}
+
+type bucket struct {
+	sync.Mutex
+	RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns the bucket of l full, nil if l is no limit.
+func newBucket(l RateLimit) *bucket {
+	if l.Rate <= 0 {
+		return nil
+	}
+	if l.Burst <= 0 {
+		l.Burst = l.Rate
+	}
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	return &bucket{RateLimit: l, tokens: l.Burst}
+}
+
+func (b *bucket) fill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+		if b.tokens > b.Burst {
+			b.tokens = b.Burst
+		}
+	}
+	b.last = now
+}
+
+// available reports whether there are n tokens, n more than Burst taking
+// Burst.
+func (b *bucket) available(n float64, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.fill(now)
+	return b.tokens >= math.Min(n, b.Burst)
+}
+
+// allow takes n tokens if there are, see available.
+func (b *bucket) allow(n float64, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.fill(now)
+	n = math.Min(n, b.Burst)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve takes n tokens, and returns how long to wait for them. The debt is
+// Burst at most, so the wait is Burst/Rate at most.
+func (b *bucket) reserve(n float64, now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	b.fill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	if b.tokens < -b.Burst {
+		b.tokens = -b.Burst
+	}
+	return time.Duration(-b.tokens / b.Rate * float64(time.Second))
+}
+
+// full reports whether b is full at now, as if never used.
+func (b *bucket) full(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.fill(now)
+	return b.tokens >= b.Burst
+}
+
+// refuses reports whether the policy of b refuses a packet over the limit,
+// instead of delaying it.
+func (b *bucket) refuses(qos0 bool) bool {
+	return b.Policy == RateDisconnect || b.Policy == RateDropQoS0 && qos0
+}
+
+// refuse returns errRateDropped to drop a packet taking n tokens of b, or
+// ErrRateLimited to disconnect, by the policy of b, taking none.
+func (b *bucket) refuse(n float64, qos0 bool, now time.Time) error {
+	if !b.refuses(qos0) || b.available(n, now) {
+		return nil
+	}
+	if b.Policy == RateDisconnect {
+		return ErrRateLimited
+	}
+	return errRateDropped
+}
+
+// clientLimiter limits the packets read of a client.
+type clientLimiter struct {
+	packets, bytes *bucket
+}
+
+func newClientLimiter() *clientLimiter {
+	l := getRateLimits()
+	return &clientLimiter{
+		packets: newBucket(l.Packets),
+		bytes:   newBucket(l.Bytes),
+	}
+}
+
+// limit applies the limits to p of n bytes, and returns how long to wait
+// before handling it, or the error of refuse. The tokens are taken only if
+// p is not refused by any limit. The limits hit are counted.
+func (l *clientLimiter) limit(p packet.ControlPacketer, n int64) (wait time.Duration, err error) {
+	now := time.Now()
+	pub, _ := p.(*packet.PublishPacket)
+	qos0 := pub != nil && pub.Qos == packet.QoS0
+	var topic *bucket
+	if pub != nil {
+		topic = publishRateOf(string(pub.TopicName))
+	}
+	limits := []struct {
+		b    *bucket
+		n    float64
+		name string
+	}{
+		{l.packets, 1, "packets"},
+		{l.bytes, float64(n), "bytes"},
+		{topic, 1, "publish"},
+	}
+	for _, v := range limits {
+		if v.b == nil {
+			continue
+		}
+		if err = v.b.refuse(v.n, qos0, now); err != nil {
+			metrics.limit(v.name)
+			return 0, err
+		}
+	}
+	for _, v := range limits {
+		if v.b == nil {
+			continue
+		}
+		if v.b.refuses(qos0) {
+			v.b.allow(v.n, now)
+		} else if d := v.b.reserve(v.n, now); d > 0 {
+			metrics.limit(v.name)
+			if d > wait {
+				wait = d
+			}
+		}
+	}
+	return
+}
+
+// ipBuckets are the buckets of the connections by IP.
+type ipBuckets struct {
+	sync.Mutex
+	m map[string]*bucket
+}
+
+// allow reports whether a connection from addr is accepted.
+func (ib *ipBuckets) allow(addr net.Addr) bool {
+	limit := getRateLimits().ConnectsPerIP
+	if limit.Rate <= 0 || addr == nil {
+		return true
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	ib.Lock()
+	b, ok := ib.m[ip]
+	if !ok {
+		b = newBucket(limit)
+		ib.m[ip] = b
+	}
+	ib.Unlock()
+	if !b.allow(1, time.Now()) {
+		metrics.limit("connects")
+		return false
+	}
+	return true
+}
+
+// Expire drops the buckets full, the IPs not connecting lately.
+func (ib *ipBuckets) Expire() {
+	now := time.Now()
+	ib.Lock()
+	defer ib.Unlock()
+	for ip, b := range ib.m {
+		if b.full(now) {
+			delete(ib.m, ip)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"hilldan/mqtt/packet"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	if newBucket(RateLimit{}) != nil {
+		t.Errorf("no limit")
+	}
+	now := time.Now()
+	b := newBucket(RateLimit{Rate: 10, Burst: 2})
+	if !b.allow(1, now) || !b.allow(1, now) || b.allow(1, now) {
+		t.Errorf("burst")
+	}
+	if !b.allow(1, now.Add(100*time.Millisecond)) {
+		t.Errorf("not refilled")
+	}
+	if d := b.reserve(2, now.Add(100*time.Millisecond)); d != 200*time.Millisecond {
+		t.Errorf("wait %v", d)
+	}
+	if b.full(now.Add(time.Second)) != true {
+		t.Errorf("not full")
+	}
+	if !newBucket(RateLimit{Rate: 100}).allow(1000, now) {
+		t.Errorf("more than burst")
+	}
+
+	//the debt capped at Burst
+	b = newBucket(RateLimit{Rate: 10, Burst: 2})
+	for i := 0; i < 100; i++ {
+		b.reserve(1, now)
+	}
+	if d := b.reserve(1, now); d != 200*time.Millisecond {
+		t.Errorf("wait %v", d)
+	}
+}
+
+func TestClientLimiter(t *testing.T) {
+	defer func() {
+		SetRateLimits(RateLimits{})
+		rateLimitsl.Lock()
+		publishRateRules = nil
+		rateLimitsl.Unlock()
+	}()
+	if err := SetPublishRateFor("a/#/b", RateLimit{Rate: 1}); err == nil {
+		t.Errorf("invalid filter")
+	}
+	SetRateLimits(RateLimits{Packets: RateLimit{Rate: 1, Burst: 2, Policy: RateDropQoS0}})
+	SetPublishRateFor("cmd/#", RateLimit{Rate: 1, Policy: RateDisconnect})
+	qos0 := &packet.PublishPacket{TopicName: "a"}
+	qos1 := &packet.PublishPacket{Qos: 1, TopicName: "a"}
+
+	l := newClientLimiter()
+	for i, want := range []error{nil, nil, errRateDropped} {
+		if _, err := l.limit(qos0, 10); err != want {
+			t.Errorf("%d want %v actual %v", i, want, err)
+		}
+	}
+	if d, err := l.limit(qos1, 10); err != nil || d <= 0 {
+		t.Errorf("qos1 not delayed %v %v", d, err)
+	}
+
+	l = newClientLimiter()
+	cmd := &packet.PublishPacket{Qos: 1, TopicName: "cmd/reboot"}
+	if _, err := l.limit(cmd, 10); err != nil {
+		t.Errorf("limited %v", err)
+	}
+	l = newClientLimiter()
+	if _, err := l.limit(cmd, 10); err != ErrRateLimited {
+		t.Errorf("topic shared: %v", err)
+	}
+	//no token taken of the packets refused
+	if !l.packets.full(time.Now()) {
+		t.Errorf("packet token taken")
+	}
+
+	var buf bytes.Buffer
+	metrics.write(&buf)
+	for _, want := range []string{`mqtt_rate_limited_total{limit="packets"}`, `mqtt_rate_limited_total{limit="publish"}`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s not found", want)
+		}
+	}
+}
+
+func TestConnectLimit(t *testing.T) {
+	defer SetRateLimits(RateLimits{})
+	SetRateLimits(RateLimits{ConnectsPerIP: RateLimit{Rate: 1}})
+	ib := &ipBuckets{m: make(map[string]*bucket)}
+	a1 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	a2 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1001}
+	b := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	if !ib.allow(a1) || ib.allow(a2) || !ib.allow(b) {
+		t.Errorf("per ip")
+	}
+	ib.Expire()
+	if len(ib.m) != 2 {
+		t.Errorf("expired %d", len(ib.m))
+	}
+}
@@ -1,16 +1,20 @@
 package server
 
 import (
-	"encoding/json"
 	"errors"
+	"hilldan/mqtt"
 	"hilldan/mqtt/packet"
-	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
 const (
 	KeyRetain  = "mq:sr"
 	KeySession = "mq:ss"
+	KeyWAL     = "mq:wal"
+	KeyDelayed = "mq:delayed"
+	KeyBridge  = "mq:bs" //session of the bridge, as a client of the remote broker
 )
 
 var (
@@ -30,13 +34,13 @@ type connRegistry struct {
 
 func (cr *connRegistry) Add(key string, c *mqttConn) {
 	cr.Lock()
-	if old, ok := cr.Conns[key]; ok {
-		old.closeConn("old conn", true)
-		// PacketIdRegistry.Remove(key)
-		delete(cr.Conns, key)
-	}
+	old, ok := cr.Conns[key]
 	cr.Conns[key] = c
 	cr.Unlock()
+	//closed unlocked, since closing removes it
+	if ok && old != c {
+		old.closeConn("old conn", true)
+	}
 }
 
 func (cr *connRegistry) Remove(key string) {
@@ -45,6 +49,15 @@ func (cr *connRegistry) Remove(key string) {
 	cr.Unlock()
 }
 
+// removeConn removes c, unless another connection has taken its place.
+func (cr *connRegistry) removeConn(c *mqttConn) {
+	cr.Lock()
+	if cr.Conns[c.clientId] == c {
+		delete(cr.Conns, c.clientId)
+	}
+	cr.Unlock()
+}
+
 func (cr *connRegistry) Get(key string) (c *mqttConn, ok bool) {
 	cr.RLock()
 	defer cr.RUnlock()
@@ -52,90 +65,269 @@ func (cr *connRegistry) Get(key string) (c *mqttConn, ok bool) {
 	return
 }
 
-func (cr *connRegistry) Publish(p packet.PublishPacket, excludeId string) {
+// Publish sends p to the clients subscribed, and returns the deliveries to
+// be acknowledged.
+func (cr *connRegistry) Publish(p packet.PublishPacket, excludeId string) (sent []delivery) {
+	seq := histories.record(p)
 	cr.Lock()
 	defer cr.Unlock()
+	n := 0
+	defer func() {
+		metrics.fanout.observe(float64(n))
+		if n == 0 {
+			metrics.drop("no_subscriber")
+		}
+	}()
 	for _, c := range cr.Conns {
 		if string(c.clientId) == excludeId {
 			continue
 		}
 		if matched, max := match(c.session.GetSubscription(), string(p.TopicName)); matched {
-			if p.Qos > max {
-				p.Qos = max
+			n++
+			v := p
+			if v.Qos > max {
+				v.Qos = max
+			}
+			if v.Qos != packet.QoS0 {
+				v.PacketId = c.nextPacketId()
+				sent = append(sent, delivery{c.clientId, uint16(v.PacketId)})
 			}
-			go c.publish(p)
+			go c.deliver(v, seq)
 		}
 	}
+	return
 }
 
-// retainRegistry manages publish packet retained, such as persistance, delete
+// subscribers returns the clients connected, subscribed to topic with QoS 1
+// or 2, except excludeId.
+func (cr *connRegistry) subscribers(topic string, excludeId string) (ids []string) {
+	cr.RLock()
+	defer cr.RUnlock()
+	ids = []string{}
+	for _, c := range cr.Conns {
+		if c.clientId == excludeId {
+			continue
+		}
+		if matched, max := match(c.session.GetSubscription(), topic); matched && max != packet.QoS0 {
+			ids = append(ids, c.clientId)
+		}
+	}
+	return
+}
+
+// retainRegistry manages publish packet retained, such as persistance, delete,
+// expiry and limits, see SetRetainTTL and SetRetainLimits.
 type retainRegistry struct {
 	sync.RWMutex
 	PubRetain map[string]packet.PublishPacket //topic->packet
+	meta      map[string]retainMeta           //topic->meta
+	bytes     int                             //total size of payload
+	tree      *topicTree                      //index of the topics
+	iol       sync.Mutex                      //of the changes persisted, one at a time, unlocked
 }
 
 func NewRetainRegistry() *retainRegistry {
 	datas, err := persister.LoadAll(KeyRetain)
 	if err != nil {
-		log.Printf("load all retained packet err: %v", err)
+		logger.Error("load retained packets fail", "err", err)
 	}
 
-	m := make(map[string]packet.PublishPacket)
+	rg := &retainRegistry{
+		PubRetain: make(map[string]packet.PublishPacket),
+		meta:      make(map[string]retainMeta),
+		tree:      newTopicTree(),
+	}
 	for k, v := range datas {
-		p := new(packet.PublishPacket)
-		err = json.Unmarshal(v, p)
+		data, _, err := mqtt.Unwrap(mqtt.KindRetain, KeyRetain, k, v, persister)
+		if err != nil {
+			logger.Warn("retained packet invalid", "topic", k, "err", err)
+			continue
+		}
+		p, stored, err := mqtt.DecodeRetain(data)
 		if err == nil {
-			m[k] = *p
+			rg.set(k, p, stored)
 		}
 	}
+	return rg
+}
 
-	return &retainRegistry{
-		PubRetain: m,
+func (rg *retainRegistry) set(topic string, p packet.PublishPacket, stored time.Time) {
+	rg.unset(topic)
+	m := retainMeta{stored: stored, size: len(p.ApplicationMessage)}
+	rg.PubRetain[topic] = p
+	rg.meta[topic] = m
+	rg.bytes += m.size
+	rg.tree.Add(topic)
+}
+
+func (rg *retainRegistry) unset(topic string) {
+	m, ok := rg.meta[topic]
+	if !ok {
+		return
 	}
+	rg.bytes -= m.size
+	delete(rg.PubRetain, topic)
+	delete(rg.meta, topic)
+	rg.tree.Remove(topic)
 }
 
+// Add retains p for topic. A packet with empty payload deletes the one
+// retained for topic instead.
 func (rg *retainRegistry) Add(topic string, p packet.PublishPacket) error {
-	data, err := json.Marshal(p)
+	if p.ApplicationMessage == "" {
+		rg.Remove(topic)
+		return nil
+	}
+	now := time.Now()
+	data, err := mqtt.EncodeRetain(p, now)
+	if err != nil {
+		return err
+	}
+
+	rg.iol.Lock()
+	defer rg.iol.Unlock()
+	rg.RLock()
+	evicted, err := rg.makeRoom(topic, len(p.ApplicationMessage))
+	rg.RUnlock()
 	if err != nil {
 		return err
 	}
-	err = persister.Save(KeyRetain, topic, data)
+	err = persister.Save(KeyRetain, topic, mqtt.Wrap(mqtt.KindRetain, data))
 	if err != nil {
 		return err
 	}
-
+	deleted := evicted[:0]
+	for _, v := range evicted {
+		if persister.Delete(KeyRetain, v) == nil {
+			deleted = append(deleted, v)
+		}
+	}
 	rg.Lock()
-	rg.PubRetain[topic] = p
+	for _, v := range deleted {
+		rg.unset(v)
+	}
+	rg.set(topic, p, now)
 	rg.Unlock()
 	return nil
 }
+
+// makeRoom returns the topics to evict, so that a new packet of size fits
+// the limits.
+func (rg *retainRegistry) makeRoom(topic string, size int) (evicted []string, err error) {
+	count, bytes := len(rg.PubRetain)+1, rg.bytes+size
+	if m, ok := rg.meta[topic]; ok {
+		count--
+		bytes -= m.size
+	}
+	over := func() bool {
+		return (retainMaxCount > 0 && count > retainMaxCount) ||
+			(retainMaxBytes > 0 && bytes > retainMaxBytes)
+	}
+	if !over() {
+		return
+	}
+	if retainEvict == EvictRejectNew || (retainMaxBytes > 0 && size > retainMaxBytes) {
+		err = ErrRetainFull
+		return
+	}
+
+	type entry struct {
+		topic string
+		retainMeta
+	}
+	entries := make([]entry, 0, len(rg.meta))
+	for k, v := range rg.meta {
+		if k != topic {
+			entries = append(entries, entry{k, v})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].stored.Before(entries[j].stored) })
+	for _, v := range entries {
+		if !over() {
+			break
+		}
+		evicted = append(evicted, v.topic)
+		count--
+		bytes -= v.size
+	}
+	return
+}
+
 func (rg *retainRegistry) Get(topic string) (p packet.PublishPacket, ok bool) {
 	rg.RLock()
 	p, ok = rg.PubRetain[topic]
+	expired := ok && rg.meta[topic].expired(topic, time.Now())
 	rg.RUnlock()
+	if expired {
+		rg.remove(topic, time.Now())
+		return packet.PublishPacket{}, false
+	}
 	return
 }
 func (rg *retainRegistry) Remove(topic string) {
-	err := persister.Delete(KeyRetain, topic)
-	if err != nil {
+	rg.remove(topic, time.Time{})
+}
+
+// remove removes the packet retained for topic, if expired at now unless
+// now is zero.
+func (rg *retainRegistry) remove(topic string, now time.Time) {
+	rg.iol.Lock()
+	defer rg.iol.Unlock()
+	if !now.IsZero() {
+		rg.RLock()
+		m, ok := rg.meta[topic]
+		rg.RUnlock()
+		if !ok || !m.expired(topic, now) {
+			return
+		}
+	}
+	if err := persister.Delete(KeyRetain, topic); err != nil {
 		return
 	}
 	rg.Lock()
-	delete(rg.PubRetain, topic)
+	rg.unset(topic)
 	rg.Unlock()
 }
 
+// Expire removes all the retained packets expired.
+func (rg *retainRegistry) Expire() {
+	now := time.Now()
+	var expired []string
+	rg.RLock()
+	for k, v := range rg.meta {
+		if v.expired(k, now) {
+			expired = append(expired, k)
+		}
+	}
+	rg.RUnlock()
+	for _, v := range expired {
+		rg.remove(v, now)
+	}
+}
+
 func (rg *retainRegistry) Publish(sub packet.TopicFilter, c *mqttConn) {
 	rg.RLock()
 	defer rg.RUnlock()
-	for k, v := range rg.PubRetain {
-		if matchOne(string(sub.Topic), k) {
-			if v.Qos > sub.Qos {
-				v.Qos = sub.Qos
-			}
-			go c.publish(v)
+	now := time.Now()
+	for _, k := range rg.tree.Match(string(sub.Topic)) {
+		if rg.meta[k].expired(k, now) {
+			continue
 		}
+		v := rg.PubRetain[k]
+		if v.Qos > sub.Qos {
+			v.Qos = sub.Qos
+		}
+		go c.publish(v)
+	}
+}
+
+// checkStorage upgrades the data persisted by the former versions, and
+// refuses the incompatible one.
+func checkStorage() error {
+	if err := mqtt.Upgrade(mqtt.KindRetain, KeyRetain, persister); err != nil {
+		return err
 	}
+	return mqtt.UpgradeSessions(KeySession, persister)
 }
 
 type wildcardRegistry struct {
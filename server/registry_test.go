@@ -2,16 +2,46 @@ package server
 
 import (
 	"fmt"
-	"hilldan/db/redis"
 	"hilldan/mqtt"
 	"hilldan/mqtt/packet"
+	"os"
 	"sync"
 	"testing"
 )
 
+// TestMain assigns the globals of the broker once, since the goroutines of
+// a test may still read them while the next one runs.
+func TestMain(m *testing.M) {
+	SetPersister(mqtt.NewMemPersist())
+	listener = testListener{}
+	RetainRegistry = NewRetainRegistry()
+	msgLog = newWAL()
+	delayed = newScheduler()
+	go delayed.run()
+	os.Exit(m.Run())
+}
+
+// testListener is the listener of the tests, see TestMain.
+type testListener struct {
+	mqtt.DefaultListener
+}
+
+// initPersister deletes what the tests before persisted.
 func initPersister() {
-	db := redis.NewClient("127.0.0.1:6379", "", 0, 10)
-	SetPersister(mqtt.NewRedisPersist(db))
+	saved, _ := mqtt.SessionsSaved(KeySession, persister)
+	for clientId := range saved {
+		mqtt.DeleteSession(KeySession, clientId, persister)
+	}
+	for _, key := range []string{KeyRetain, KeyWAL, KeyDelayed} {
+		datas, _ := persister.LoadAll(key)
+		for field := range datas {
+			persister.Delete(key, field)
+		}
+	}
+	msgLog.Lock()
+	msgLog.entries = make(map[uint64]*walEntry)
+	msgLog.index = make(map[delivery]uint64)
+	msgLog.Unlock()
 }
 
 func TestPersistRetain(t *testing.T) {
@@ -26,19 +56,17 @@ func TestPersistRetain(t *testing.T) {
 		ApplicationMessage: "message",
 	}
 	var wg sync.WaitGroup
-	var err error
 	const N = 100000
 	for i := 0; i < N; i++ {
 		wg.Add(1)
-		go func(i int) {
+		go func(i int, o packet.PublishPacket) {
 			topic := fmt.Sprintf("%d", i)
 			o.TopicName = packet.String(topic)
-			err = r.Add(topic, o)
-			if err != nil {
+			if err := r.Add(topic, o); err != nil {
 				t.Errorf("add retain packet err : %v", err)
 			}
 			wg.Done()
-		}(i)
+		}(i, o)
 	}
 	wg.Wait()
 
@@ -54,6 +82,28 @@ func TestPersistRetain(t *testing.T) {
 }
 
 func TestPersistSession(t *testing.T) {
-	// initPersister()
-	//
+	initPersister()
+	s := mqtt.NewSession()
+	s.AddPubOut(1, packet.PublishPacket{Qos: 1, TopicName: "a", PacketId: 1})
+	s.AddPubIn(2)
+	s.AddSubscription([]packet.TopicFilter{{Topic: "a/#", Qos: 1}})
+	if err := s.Save(KeySession, "c1", persister); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &mqttConn{clientId: "c1"}
+	if !c.initSession() {
+		t.Fatalf("session should be loaded")
+	}
+	if _, ok := c.session.GetPubOut(1); !ok || !c.session.GetPubIn(2) {
+		t.Errorf("session packets not loaded")
+	}
+	if subs := c.session.GetSubscription(); len(subs) != 1 || subs[0].Topic != "a/#" {
+		t.Errorf("session subscription not loaded: %v", subs)
+	}
+
+	c = &mqttConn{clientId: "c2"}
+	if c.initSession() || c.session == nil {
+		t.Errorf("new session should be created")
+	}
 }
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRetainFull = errors.New("Retained packets full")
+
+// EvictPolicy decides what happens when a new retained packet exceeds the
+// limits assigned by SetRetainLimits.
+type EvictPolicy uint8
+
+const (
+	// EvictOldest removes the retained packets stored earliest until the new
+	// one fits.
+	EvictOldest = EvictPolicy(iota)
+	// EvictRejectNew keeps the retained packets, the new one is not retained.
+	EvictRejectNew
+)
+
+type retainTTLRule struct {
+	filter string
+	ttl    time.Duration
+}
+
+var (
+	retainTTL      time.Duration
+	retainTTLRules []retainTTLRule
+	retainTTLl     sync.RWMutex //of retainTTL and retainTTLRules
+
+	retainMaxCount int
+	retainMaxBytes int
+	retainEvict    EvictPolicy
+)
+
+// SetRetainTTL assigns how long a retained packet is kept, zero means forever.
+func SetRetainTTL(d time.Duration) {
+	retainTTLl.Lock()
+	retainTTL = d
+	retainTTLl.Unlock()
+}
+
+// SetRetainTTLFor overrides the ttl of the retained packets whose topic
+// matches filter. The filter assigned first wins when several match.
+func SetRetainTTLFor(filter string, d time.Duration) {
+	retainTTLl.Lock()
+	retainTTLRules = append(retainTTLRules, retainTTLRule{filter, d})
+	retainTTLl.Unlock()
+}
+
+func getRetainTTLs() (time.Duration, []retainTTLRule) {
+	retainTTLl.RLock()
+	defer retainTTLl.RUnlock()
+	return retainTTL, retainTTLRules
+}
+
+// SetRetainLimits limits the number of retained packets and the total bytes
+// of their payload, handled by policy when exceeded. Zero means no limit.
+func SetRetainLimits(maxCount, maxBytes int, policy EvictPolicy) {
+	retainMaxCount = maxCount
+	retainMaxBytes = maxBytes
+	retainEvict = policy
+}
+
+func retainTTLOf(topic string) time.Duration {
+	ttl, rules := getRetainTTLs()
+	for _, v := range rules {
+		if matchOne(v.filter, topic) {
+			return v.ttl
+		}
+	}
+	return ttl
+}
+
+// retainMeta is the bookkeeping of a retained packet.
+type retainMeta struct {
+	stored time.Time
+	size   int
+}
+
+func (m retainMeta) expired(topic string, now time.Time) bool {
+	ttl := retainTTLOf(topic)
+	return ttl > 0 && now.Sub(m.stored) >= ttl
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"hilldan/mqtt/packet"
+	"testing"
+	"time"
+)
+
+func TestRetainLimits(t *testing.T) {
+	initPersister()
+	defer SetRetainLimits(0, 0, EvictOldest)
+	r := NewRetainRegistry()
+	p := packet.PublishPacket{Retain: true, ApplicationMessage: "12345"}
+
+	SetRetainLimits(2, 12, EvictOldest)
+	for _, topic := range []string{"a", "b", "c"} {
+		p.TopicName = packet.String(topic)
+		if err := r.Add(topic, p); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := r.Get("a"); ok || len(r.PubRetain) != 2 || r.bytes != 10 {
+		t.Errorf("the oldest should be evicted, %d %d", len(r.PubRetain), r.bytes)
+	}
+	if rr := NewRetainRegistry(); len(rr.PubRetain) != 2 {
+		t.Errorf("eviction not persisted, %d retained", len(rr.PubRetain))
+	}
+
+	//replacing an existing one never evicts
+	p.ApplicationMessage = "1234567"
+	if err := r.Add("c", p); err != nil || len(r.PubRetain) != 2 || r.bytes != 12 {
+		t.Errorf("replace err: %v %d %d", err, len(r.PubRetain), r.bytes)
+	}
+
+	SetRetainLimits(2, 0, EvictRejectNew)
+	if err := r.Add("d", p); err != ErrRetainFull {
+		t.Errorf("want ErrRetainFull actual %v", err)
+	}
+
+	//empty payload deletes
+	if err := r.Add("b", packet.PublishPacket{Retain: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Get("b"); ok || r.bytes != 7 {
+		t.Errorf("retained packet should be deleted")
+	}
+}
+
+func TestRetainTTL(t *testing.T) {
+	initPersister()
+	defer func() {
+		SetRetainTTL(0)
+		retainTTLl.Lock()
+		retainTTLRules = nil
+		retainTTLl.Unlock()
+	}()
+	SetRetainTTL(time.Hour)
+	SetRetainTTLFor("tmp/#", time.Millisecond)
+	r := NewRetainRegistry()
+	p := packet.PublishPacket{Retain: true, ApplicationMessage: "x"}
+	r.Add("tmp/a", p)
+	r.Add("tmp/b", p)
+	r.Add("keep", p)
+	time.Sleep(2 * time.Millisecond)
+
+	if _, ok := r.Get("tmp/a"); ok {
+		t.Errorf("tmp/a should be expired")
+	}
+	r.Expire()
+	if _, ok := r.Get("keep"); !ok || len(r.PubRetain) != 1 {
+		t.Errorf("want only 'keep' retained, %v", r.PubRetain)
+	}
+	if rr := NewRetainRegistry(); len(rr.PubRetain) != 1 {
+		t.Errorf("expiry not persisted, %d retained", len(rr.PubRetain))
+	}
+}
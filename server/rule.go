@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RuleFunc is a Go function called by the rules, with the fields selected
+// and the message matched. It is called by the goroutine of the client, so
+// it ought not to block.
+type RuleFunc func(fields map[string]interface{}, p packet.PublishPacket) error
+
+// RuleAction is what a rule does to the messages selected. Republish is the
+// topic template of the message republished, in which ${name} is replaced by
+// the field selected of name, or by the topic and clientid of the message.
+// The message republished is the fields selected in JSON, or the payload
+// itself for SELECT *. It is not matched by the rules again.
+type RuleAction struct {
+	Republish string
+	Qos       packet.Bit2 //of the message republished
+	Retain    bool        //of the message republished
+	Drop      bool        //the message not delivered to the subscribers
+	Call      string      //name of the RuleFunc registered
+}
+
+// Rule selects the messages published to the broker by its SQL, and acts on
+// them. The SQL is
+//
+//	SELECT * | expr [AS name] {, expr [AS name]} FROM "filter" [WHERE expr]
+//
+// where an expr is made of literals (numbers, 'strings', true, false and
+// null), the fields of the message (topic, topic(n) the nth level from 1,
+// clientid, qos, retain, payload and payload.a.b the JSON fields of the
+// payload), comparisons (= != <> < <= > >=), AND, OR, NOT and parentheses. A
+// field missing is null. The name of a field selected defaults to the last
+// part of its path. For example:
+//
+//	Rule{
+//		Name: "alert",
+//		SQL: `SELECT topic(2) AS device, payload.value AS value FROM "sensors/+/temp"
+//			WHERE payload.value > 80`,
+//		Actions: []RuleAction{{Republish: "alerts/${device}", Qos: 1}},
+//	}
+type Rule struct {
+	Name    string
+	SQL     string
+	Actions []RuleAction
+}
+
+type rule struct {
+	Rule
+	st *ruleStatement
+}
+
+var (
+	rules     []*rule
+	ruleFuncs = make(map[string]RuleFunc)
+	rulesl    sync.RWMutex
+)
+
+// RegisterRuleFunc registers f called by the actions of name.
+func RegisterRuleFunc(name string, f RuleFunc) {
+	rulesl.Lock()
+	ruleFuncs[name] = f
+	rulesl.Unlock()
+}
+
+// AddRule compiles r, and applies it to the messages published from now on.
+// It replaces the rule of the same name.
+func AddRule(r Rule) error {
+	st, err := parseRule(r.SQL)
+	if err != nil {
+		return err
+	}
+	rulesl.Lock()
+	defer rulesl.Unlock()
+	for _, a := range r.Actions {
+		if a.Call != "" && ruleFuncs[a.Call] == nil {
+			return errors.New("rule function not registered: " + a.Call)
+		}
+		if a.Qos > packet.QoS2 {
+			return errors.New("invalid qos")
+		}
+	}
+	removeRule(r.Name)
+	rules = append(rules, &rule{r, st})
+	return nil
+}
+
+// RemoveRule removes the rule of name.
+func RemoveRule(name string) {
+	rulesl.Lock()
+	removeRule(name)
+	rulesl.Unlock()
+}
+
+func removeRule(name string) {
+	for i, v := range rules {
+		if v.Name == name {
+			rules = append(rules[:i:i], rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// ruleCall is an action of a rule matched.
+type ruleCall struct {
+	r      *rule
+	a      RuleAction
+	f      RuleFunc
+	fields map[string]interface{}
+}
+
+// applyRules applies the rules to p published by clientId, and reports
+// whether p is dropped. The actions are run unlocked, so that a RuleFunc
+// may add and remove rules.
+func applyRules(p packet.PublishPacket, clientId string) (drop bool) {
+	rulesl.RLock()
+	if len(rules) == 0 {
+		rulesl.RUnlock()
+		return
+	}
+	env := &ruleEnv{
+		topic:    string(p.TopicName),
+		clientId: clientId,
+		qos:      float64(p.Qos),
+		retain:   bool(p.Retain),
+		payload:  []byte(p.ApplicationMessage),
+	}
+	var calls []ruleCall
+	for _, r := range rules {
+		if !mqtt.MatchTopic(r.st.filter, env.topic) {
+			continue
+		}
+		if r.st.where != nil && r.st.where.eval(env) != true {
+			continue
+		}
+		fields := r.st.selectFields(env)
+		for _, a := range r.Actions {
+			if a.Drop {
+				drop = true
+			}
+			calls = append(calls, ruleCall{r, a, ruleFuncs[a.Call], fields})
+		}
+	}
+	rulesl.RUnlock()
+
+	for _, v := range calls {
+		if v.a.Republish != "" {
+			v.r.republish(v.a, v.fields, env)
+		}
+		if v.f != nil {
+			if err := v.f(v.fields, p); err != nil {
+				logger.Warn("rule function fail", "rule", v.r.Name, "func", v.a.Call, "err", err)
+			}
+		}
+	}
+	return
+}
+
+// selectFields returns the fields selected, the JSON object of the payload
+// for SELECT *.
+func (st *ruleStatement) selectFields(env *ruleEnv) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if st.fields == nil {
+		if doc, ok := env.json().(map[string]interface{}); ok {
+			fields = doc
+		}
+		return fields
+	}
+	for _, f := range st.fields {
+		fields[f.name] = f.e.eval(env)
+	}
+	return fields
+}
+
+func (r *rule) republish(a RuleAction, fields map[string]interface{}, env *ruleEnv) {
+	topic := expandTemplate(a.Republish, func(name string) string {
+		if v, ok := fields[name]; ok {
+			return ruleString(v)
+		}
+		switch name {
+		case "topic":
+			return env.topic
+		case "clientid":
+			return env.clientId
+		}
+		return ""
+	})
+	if ok, _ := check(topic); !ok || strings.ContainsAny(topic, "+#") {
+		logger.Warn("rule republish fail", "rule", r.Name, "topic", topic)
+		return
+	}
+	payload := packet.String(env.payload)
+	if r.st.fields != nil {
+		data, err := json.Marshal(fields)
+		if err != nil {
+			logger.Warn("rule republish fail", "rule", r.Name, "err", err)
+			return
+		}
+		payload = packet.String(data)
+	}
+	err := inject(packet.PublishPacket{
+		Qos:                a.Qos,
+		Retain:             packet.Bool(a.Retain),
+		TopicName:          packet.String(topic),
+		ApplicationMessage: payload,
+	}, RulePublisher)
+	if err != nil {
+		logger.Warn("rule republish fail", "rule", r.Name, "topic", topic, "err", err)
+	}
+}
+
+// expandTemplate replaces ${name} in s by mapping(name), leaving the other
+// $ as they are.
+func expandTemplate(s string, mapping func(name string) string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i+2:], '}')
+		if j < 0 {
+			break
+		}
+		b.WriteString(s[:i])
+		b.WriteString(mapping(s[i+2 : i+2+j]))
+		s = s[i+3+j:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// ruleString formats v in a topic.
+func ruleString(v interface{}) string {
+	switch vv := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return vv
+	case float64:
+		return strconv.FormatFloat(vv, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
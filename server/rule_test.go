@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"hilldan/mqtt/packet"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	for sql, ok := range map[string]bool{
+		`SELECT * FROM "a/#"`: true,
+		`select topic(2) as device, payload.value from "sensors/+/temp" where payload.value > 80`: true,
+		`SELECT payload.a.0 FROM "a" WHERE NOT (qos = 0 OR retain) AND clientid <> 'x'`:           true,
+		`SELECT * FROM "a" WHERE payload.v >= -1.5 AND payload = 'on'`:                            true,
+		`SELECT * FROM 'a'`:               false,
+		`SELECT * FROM "a/#/b"`:           false,
+		`SELECT FROM "a"`:                 false,
+		`SELECT topic(0) FROM "a"`:        false,
+		`SELECT topic(1) FROM "a"`:        false, //no name
+		`SELECT size FROM "a"`:            false,
+		`SELECT * FROM "a" WHERE`:         false,
+		`SELECT * FROM "a" WHERE (qos`:    false,
+		`SELECT * FROM "a" WHERE qos ~ 1`: false,
+		`SELECT * FROM "a" LIMIT 1`:       false,
+		`SELECT * FROM "a`:                false,
+	} {
+		_, err := parseRule(sql)
+		if (err == nil) != ok {
+			t.Errorf("%s: %v", sql, err)
+		}
+		if err != nil && !errors.Is(err, ErrRuleSyntax) {
+			t.Errorf("%s: %v not a syntax error", sql, err)
+		}
+	}
+}
+
+func TestRuleWhere(t *testing.T) {
+	env := func() *ruleEnv {
+		return &ruleEnv{
+			topic:    "sensors/d1/temp",
+			clientId: "c1",
+			qos:      1,
+			payload:  []byte(`{"value":90,"unit":"C","tags":["a","b"],"ok":true}`),
+		}
+	}
+	for where, want := range map[string]bool{
+		"payload.value > 80":                        true,
+		"payload.value > 80 AND payload.unit = 'F'": false,
+		"payload.value > 80 AND payload.unit = 'C'": true,
+		"payload.value < 80 OR topic(2) = 'd1'":     true,
+		"payload.tags.1 = 'b'":                      true,
+		"payload.ok = true AND NOT retain":          true,
+		"payload.missing = null":                    true,
+		"payload.missing > 0":                       false,
+		"payload.unit > 1":                          false,
+		"topic(4) = null AND qos >= 1":              true,
+		"clientid != 'c1'":                          false,
+	} {
+		st, err := parseRule(`SELECT * FROM "#" WHERE ` + where)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := st.where.eval(env()); got != want {
+			t.Errorf("%s: want %v actual %v", where, want, got)
+		}
+	}
+	st, _ := parseRule(`SELECT * FROM "#" WHERE payload = 'on'`)
+	if st.where.eval(&ruleEnv{payload: []byte("on")}) != true {
+		t.Errorf("plain payload")
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	initPersister()
+	defer RemoveRule("quiet")
+
+	var called []map[string]interface{}
+	RegisterRuleFunc("record", func(fields map[string]interface{}, p packet.PublishPacket) error {
+		called = append(called, fields)
+		return nil
+	})
+	if err := AddRule(Rule{Name: "x", SQL: `SELECT * FROM "a"`, Actions: []RuleAction{{Call: "missing"}}}); err == nil {
+		t.Errorf("function not registered")
+	}
+	for _, r := range []Rule{
+		{
+			Name:    "alert",
+			SQL:     `SELECT topic(2) AS device, payload.value AS value FROM "sensors/+/temp" WHERE payload.value > 80`,
+			Actions: []RuleAction{{Republish: "alerts/${device}", Qos: 1}, {Call: "record"}},
+		},
+		{Name: "quiet", SQL: `SELECT * FROM "sensors/#" WHERE payload.debug = true`, Actions: []RuleAction{{Drop: true}}},
+	} {
+		if err := AddRule(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := testConn(t, "rules")
+	pub := testConn(t, "sensor")
+	c.session.AddSubscription([]packet.TopicFilter{{Topic: "alerts/#", Qos: 1}, {Topic: "sensors/#", Qos: 0}})
+	//delivered in any order
+	receive := func(want map[string]string) {
+		t.Helper()
+		for range want {
+			select {
+			case p := <-c.writech:
+				pp := p.(*packet.PublishPacket)
+				if payload, ok := want[string(pp.TopicName)]; !ok || payload != string(pp.ApplicationMessage) {
+					t.Errorf("received %s %s", pp.TopicName, pp.ApplicationMessage)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%v not received", want)
+			}
+		}
+	}
+	handlePacket(&packet.PublishPacket{TopicName: "sensors/d1/temp", ApplicationMessage: `{"value":90}`}, pub, nil)
+	receive(map[string]string{"alerts/d1": `{"device":"d1","value":90}`, "sensors/d1/temp": `{"value":90}`})
+	if len(called) != 1 || called[0]["device"] != "d1" {
+		t.Errorf("called %v", called)
+	}
+
+	handlePacket(&packet.PublishPacket{TopicName: "sensors/d1/temp", ApplicationMessage: `{"value":20,"debug":true}`}, pub, nil)
+	handlePacket(&packet.PublishPacket{TopicName: "sensors/d2/temp", ApplicationMessage: `{"value":21}`}, pub, nil)
+	receive(map[string]string{"sensors/d2/temp": `{"value":21}`})
+
+	RemoveRule("alert")
+	if len(rules) != 1 {
+		t.Errorf("rule not removed")
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	fields := map[string]string{"device": "d1", "a": "x"}
+	for tmpl, want := range map[string]string{
+		"alerts/${device}": "alerts/d1",
+		"$SYS/${a}/$b":     "$SYS/x/$b",
+		"${a}${device}":    "xd1",
+		"a/${missing}/b":   "a//b",
+		"a/${unterminated": "a/${unterminated",
+	} {
+		got := expandTemplate(tmpl, func(name string) string { return fields[name] })
+		if got != want {
+			t.Errorf("'%s' want %s actual %s", tmpl, want, got)
+		}
+	}
+}
+
+func TestRuleFuncReentrant(t *testing.T) {
+	defer RemoveRule("reentrant")
+	defer RemoveRule("added")
+	RegisterRuleFunc("reentrant", func(fields map[string]interface{}, p packet.PublishPacket) error {
+		return AddRule(Rule{Name: "added", SQL: `SELECT * FROM "b"`})
+	})
+	AddRule(Rule{Name: "reentrant", SQL: `SELECT * FROM "reentrant"`, Actions: []RuleAction{{Call: "reentrant"}}})
+	done := make(chan struct{})
+	go func() {
+		applyRules(packet.PublishPacket{TopicName: "reentrant"}, "c")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deadlocked")
+	}
+}
@@ -0,0 +1,443 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ruleEnv is the message a statement evaluated on.
+type ruleEnv struct {
+	topic    string
+	clientId string
+	qos      float64
+	retain   bool
+	payload  []byte
+
+	decoded bool
+	doc     interface{} //payload decoded, nil unless JSON
+}
+
+func (env *ruleEnv) json() interface{} {
+	if !env.decoded {
+		env.decoded = true
+		if json.Unmarshal(env.payload, &env.doc) != nil {
+			env.doc = nil
+		}
+	}
+	return env.doc
+}
+
+type ruleExpr interface {
+	eval(env *ruleEnv) interface{}
+}
+
+type ruleLiteral struct{ v interface{} }
+
+func (e ruleLiteral) eval(*ruleEnv) interface{} { return e.v }
+
+// rulePath is a field of the message.
+type rulePath []string
+
+func (e rulePath) eval(env *ruleEnv) interface{} {
+	switch e[0] {
+	case "topic":
+		return env.topic
+	case "clientid":
+		return env.clientId
+	case "qos":
+		return env.qos
+	case "retain":
+		return env.retain
+	}
+	if len(e) == 1 {
+		return string(env.payload)
+	}
+	v := env.json()
+	for _, k := range e[1:] {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			v = vv[k]
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(vv) {
+				return nil
+			}
+			v = vv[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// ruleTopicLevel is topic(n).
+type ruleTopicLevel int
+
+func (e ruleTopicLevel) eval(env *ruleEnv) interface{} {
+	levels := strings.Split(env.topic, "/")
+	if int(e) > len(levels) {
+		return nil
+	}
+	return levels[e-1]
+}
+
+type ruleBinary struct {
+	op   string
+	l, r ruleExpr
+}
+
+func (e ruleBinary) eval(env *ruleEnv) interface{} {
+	l := e.l.eval(env)
+	switch e.op {
+	case "and":
+		return l == true && e.r.eval(env) == true
+	case "or":
+		return l == true || e.r.eval(env) == true
+	}
+	r := e.r.eval(env)
+	switch e.op {
+	case "=":
+		return equalValue(l, r)
+	case "!=":
+		return !equalValue(l, r)
+	}
+	c, ok := compareValue(l, r)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+type ruleNot struct{ e ruleExpr }
+
+func (e ruleNot) eval(env *ruleEnv) interface{} { return e.e.eval(env) != true }
+
+func equalValue(l, r interface{}) bool {
+	if c, ok := compareValue(l, r); ok {
+		return c == 0
+	}
+	lb, ok1 := l.(bool)
+	rb, ok2 := r.(bool)
+	if ok1 && ok2 {
+		return lb == rb
+	}
+	return l == nil && r == nil
+}
+
+// compareValue compares the numbers, or the strings.
+func compareValue(l, r interface{}) (int, bool) {
+	switch lv := l.(type) {
+	case float64:
+		if rv, ok := r.(float64); ok {
+			switch {
+			case lv < rv:
+				return -1, true
+			case lv > rv:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if rv, ok := r.(string); ok {
+			return strings.Compare(lv, rv), true
+		}
+	}
+	return 0, false
+}
+
+// ruleField is a field selected.
+type ruleField struct {
+	name string
+	e    ruleExpr
+}
+
+// ruleStatement is a statement compiled.
+type ruleStatement struct {
+	fields []ruleField //nil for *
+	filter string
+	where  ruleExpr
+}
+
+// ErrRuleSyntax is returned for the statements invalid.
+var ErrRuleSyntax = errors.New("rule syntax error")
+
+type ruleToken struct {
+	kind byte //'i' identifier, 'n' number, 's' 'string', 'q' "string", 'o' operator, 0 end
+	text string
+}
+
+func lexRule(s string) (tokens []ruleToken, err error) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			j := strings.IndexByte(s[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("%w: string not terminated", ErrRuleSyntax)
+			}
+			kind := byte('s')
+			if c == '"' {
+				kind = 'q'
+			}
+			tokens = append(tokens, ruleToken{kind, s[i+1 : i+1+j]})
+			i += j + 2
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{'n', s[i:j]})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{'i', s[i:j]})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "!=", "<>", "<=", ">=":
+					op = two
+				}
+			}
+			switch op {
+			case "=", "!=", "<>", "<", "<=", ">", ">=", "(", ")", ",", "*":
+			default:
+				return nil, fmt.Errorf("%w: unexpected %q", ErrRuleSyntax, op)
+			}
+			i += len(op)
+			if op == "<>" {
+				op = "!="
+			}
+			tokens = append(tokens, ruleToken{'o', op})
+		}
+	}
+	return append(tokens, ruleToken{}), nil
+}
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+func (p *ruleParser) peek() ruleToken { return p.tokens[p.pos] }
+
+func (p *ruleParser) next() ruleToken {
+	t := p.tokens[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+// back unreads t, returned by next.
+func (p *ruleParser) back(t ruleToken) {
+	if t.kind != 0 {
+		p.pos--
+	}
+}
+
+// keyword reports whether the next token is the keyword kw, consumed if so.
+func (p *ruleParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == 'i' && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// operator reports whether the next token is the operator op, consumed if so.
+func (p *ruleParser) operator(op string) bool {
+	if t := p.peek(); t.kind == 'o' && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *ruleParser) fail(want string) error {
+	t := p.peek()
+	if t.kind == 0 {
+		return fmt.Errorf("%w: %s expected at the end", ErrRuleSyntax, want)
+	}
+	return fmt.Errorf("%w: %s expected at %q", ErrRuleSyntax, want, t.text)
+}
+
+// parseRule compiles the statement s.
+func parseRule(s string) (st *ruleStatement, err error) {
+	tokens, err := lexRule(s)
+	if err != nil {
+		return
+	}
+	p := &ruleParser{tokens: tokens}
+	if !p.keyword("select") {
+		return nil, p.fail("SELECT")
+	}
+	st = new(ruleStatement)
+	if !p.operator("*") {
+		for {
+			var f ruleField
+			if f.e, err = p.expr(); err != nil {
+				return nil, err
+			}
+			if p.keyword("as") {
+				t := p.next()
+				if t.kind != 'i' || strings.Contains(t.text, ".") {
+					p.back(t)
+					return nil, p.fail("name")
+				}
+				f.name = t.text
+			} else if path, ok := f.e.(rulePath); ok {
+				f.name = path[len(path)-1]
+			} else {
+				return nil, p.fail("AS")
+			}
+			st.fields = append(st.fields, f)
+			if !p.operator(",") {
+				break
+			}
+		}
+	}
+	if !p.keyword("from") {
+		return nil, p.fail("FROM")
+	}
+	t := p.next()
+	if t.kind != 'q' {
+		p.back(t)
+		return nil, p.fail("\"filter\"")
+	}
+	if _, err = WildcardRegistry.Get(t.text); err != nil {
+		return nil, fmt.Errorf("%w: invalid filter %q", ErrRuleSyntax, t.text)
+	}
+	st.filter = t.text
+	if p.keyword("where") {
+		if st.where, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek().kind != 0 {
+		return nil, p.fail("the end")
+	}
+	return
+}
+
+func (p *ruleParser) expr() (ruleExpr, error) {
+	l, err := p.and()
+	for err == nil && p.keyword("or") {
+		var r ruleExpr
+		r, err = p.and()
+		l = ruleBinary{"or", l, r}
+	}
+	return l, err
+}
+
+func (p *ruleParser) and() (ruleExpr, error) {
+	l, err := p.not()
+	for err == nil && p.keyword("and") {
+		var r ruleExpr
+		r, err = p.not()
+		l = ruleBinary{"and", l, r}
+	}
+	return l, err
+}
+
+func (p *ruleParser) not() (ruleExpr, error) {
+	if p.keyword("not") {
+		e, err := p.not()
+		return ruleNot{e}, err
+	}
+	return p.comparison()
+}
+
+func (p *ruleParser) comparison() (ruleExpr, error) {
+	l, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "!=", "<=", ">=", "<", ">"} {
+		if p.operator(op) {
+			r, err := p.operand()
+			return ruleBinary{op, l, r}, err
+		}
+	}
+	return l, nil
+}
+
+func (p *ruleParser) operand() (ruleExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case 'n':
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number %q", ErrRuleSyntax, t.text)
+		}
+		return ruleLiteral{v}, nil
+	case 's':
+		return ruleLiteral{t.text}, nil
+	case 'o':
+		if t.text == "(" {
+			e, err := p.expr()
+			if err == nil && !p.operator(")") {
+				err = p.fail(")")
+			}
+			return e, err
+		}
+	case 'i':
+		switch strings.ToLower(t.text) {
+		case "true":
+			return ruleLiteral{true}, nil
+		case "false":
+			return ruleLiteral{false}, nil
+		case "null":
+			return ruleLiteral{nil}, nil
+		}
+		path := strings.Split(t.text, ".")
+		switch path[0] {
+		case "topic":
+			if len(path) == 1 && p.operator("(") {
+				n := p.next()
+				i, err := strconv.Atoi(n.text)
+				if n.kind != 'n' || err != nil || i < 1 {
+					p.back(n)
+					return nil, p.fail("level")
+				}
+				if !p.operator(")") {
+					return nil, p.fail(")")
+				}
+				return ruleTopicLevel(i), nil
+			}
+			fallthrough
+		case "clientid", "qos", "retain":
+			if len(path) == 1 {
+				return rulePath(path), nil
+			}
+		case "payload":
+			for _, v := range path[1:] {
+				if v == "" {
+					return nil, fmt.Errorf("%w: invalid field %q", ErrRuleSyntax, t.text)
+				}
+			}
+			return rulePath(path), nil
+		}
+		return nil, fmt.Errorf("%w: unknown field %q", ErrRuleSyntax, t.text)
+	}
+	p.back(t)
+	return nil, p.fail("operand")
+}
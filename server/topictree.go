@@ -0,0 +1,96 @@
+package server
+
+import "strings"
+
+// topicTree indexes topic names level by level, so that a subscription
+// filter only visits the branches it may match, instead of every topic.
+type topicTree struct {
+	children map[string]*topicTree //level->subtree
+	topic    string                //topic name ending at this node
+	leaf     bool
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{children: make(map[string]*topicTree)}
+}
+
+func (t *topicTree) Add(topic string) {
+	n := t
+	for _, level := range strings.Split(topic, "/") {
+		child, ok := n.children[level]
+		if !ok {
+			child = newTopicTree()
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.topic = topic
+	n.leaf = true
+}
+
+func (t *topicTree) Remove(topic string) {
+	t.remove(strings.Split(topic, "/"))
+}
+
+// remove reports whether t is empty after removing.
+func (t *topicTree) remove(levels []string) bool {
+	if len(levels) == 0 {
+		t.leaf = false
+		t.topic = ""
+	} else if child, ok := t.children[levels[0]]; ok && child.remove(levels[1:]) {
+		delete(t.children, levels[0])
+	}
+	return !t.leaf && len(t.children) == 0
+}
+
+// Match returns the topics matched by filter, see matchOne.
+func (t *topicTree) Match(filter string) (topics []string) {
+	if _, err := WildcardRegistry.Get(filter); err != nil {
+		return
+	}
+	t.match(strings.Split(filter, "/"), true, &topics)
+	return
+}
+
+func (t *topicTree) match(levels []string, root bool, topics *[]string) {
+	if len(levels) == 0 {
+		if t.leaf {
+			*topics = append(*topics, t.topic)
+		}
+		return
+	}
+	switch levels[0] {
+	case "#":
+		//includes the parent level
+		if t.leaf && !root {
+			*topics = append(*topics, t.topic)
+		}
+		for k, child := range t.children {
+			if root && strings.HasPrefix(k, "$") {
+				continue
+			}
+			child.all(topics)
+		}
+	case "+":
+		for k, child := range t.children {
+			if root && strings.HasPrefix(k, "$") {
+				continue
+			}
+			child.match(levels[1:], false, topics)
+		}
+	default:
+		if child, ok := t.children[levels[0]]; ok {
+			child.match(levels[1:], false, topics)
+		}
+	}
+}
+
+// all collects every topic under t.
+func (t *topicTree) all(topics *[]string) {
+	if t.leaf {
+		*topics = append(*topics, t.topic)
+	}
+	for _, child := range t.children {
+		child.all(topics)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"sort"
+	"testing"
+)
+
+var treeTopics = []string{
+	"sport", "sport/", "sport/tennis", "sport/tennis/", "sport/tennis/player1",
+	"sport/tennis/player1/ranking", "sport/tennis/player1/score/wimbledon",
+	"sport/tennis/player2", "sport/tennis/xxx/ranking", "/finance", "finance",
+	"$SYS/", "$SYS/monitor/Clients",
+}
+
+// scan is the full scan used before the tree, for comparison.
+func scan(topics []string, filter string) (matched []string) {
+	for _, v := range topics {
+		if matchOne(filter, v) {
+			matched = append(matched, v)
+		}
+	}
+	return
+}
+
+func TestTopicTree(t *testing.T) {
+	tree := newTopicTree()
+	for _, v := range treeTopics {
+		tree.Add(v)
+	}
+	filters := []string{
+		"#", "+", "/+", "/#", "sport/#", "sport/+", "sport/tennis/+/ranking",
+		"+/tennis/#", "sport/tennis/player1/#", "+/monitor/Clients", "$SYS/#",
+		"$SYS/monitor/+", "finance", "nothing/#", "sport/#/x", "+/+", "sport/tennis/+",
+	}
+	for _, f := range filters {
+		want, got := scan(treeTopics, f), tree.Match(f)
+		sort.Strings(want)
+		sort.Strings(got)
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Errorf("'%s' want %v actual %v", f, want, got)
+		}
+	}
+
+	for _, f := range append(filters, "sport+", "sport/#x") {
+		for _, v := range treeTopics {
+			one := newTopicTree()
+			one.Add(v)
+			if got, want := mqtt.MatchTopic(f, v), len(one.Match(f)) > 0; got != want {
+				t.Errorf("MatchTopic '%s' '%s' want %v actual %v", f, v, want, got)
+			}
+		}
+	}
+
+	for _, v := range treeTopics {
+		tree.Remove(v)
+	}
+	if len(tree.children) != 0 {
+		t.Errorf("tree not pruned: %v", tree.children)
+	}
+}
+
+func TestMatchLive(t *testing.T) {
+	//the messages published are matched the same as the retained ones
+	subs := []packet.TopicFilter{{Topic: "+/+", Qos: 1}}
+	if ok, _ := match(subs, "sport/tennis/player1"); ok {
+		t.Errorf("'+/+' matched 'sport/tennis/player1'")
+	}
+	if ok, qos := match(subs, "sport/tennis"); !ok || qos != 1 {
+		t.Errorf("'+/+' not matched 'sport/tennis'")
+	}
+}
+
+func BenchmarkRetainMatch(b *testing.B) {
+	topics := make([]string, 0, 100000)
+	tree := newTopicTree()
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < 100; j++ {
+			topic := fmt.Sprintf("device/%d/sensor/%d", i, j)
+			topics = append(topics, topic)
+			tree.Add(topic)
+		}
+	}
+	filter := "device/42/sensor/+"
+	b.Run("tree", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.Match(filter)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scan(topics, filter)
+		}
+	})
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// The write-ahead log records every QoS 1 and 2 message accepted, before it
+// is acknowledged to the publisher, and keeps it until every subscriber it is
+// sent to has acknowledged it. A message is stored at KeyWAL as:
+//
+//	id -> flag(1) | publisher | count | count*(clientId | packetId(2)) | packet
+//
+// where the strings are prefixed with their length in uvarint, and the packet
+// is in the MQTT wire format. The flag is 1 once distributed, the clients
+// listed being the deliveries not acknowledged, which are resent on recovery.
+// It is 2 when not distributed yet, the clients listed with packet id 0 being
+// the subscribers connected when accepted, which the message is sent to on
+// recovery.
+//
+// Each message is written under its own lock, so the publishers only share
+// the index of the messages.
+var walEnabled bool
+
+// SetWAL enables the write-ahead log of the messages, see RunMQTT.
+func SetWAL(enable bool) {
+	walEnabled = enable
+}
+
+var msgLog *wal
+
+// delivery is a message sent to a subscriber.
+type delivery struct {
+	clientId string
+	packetId uint16
+}
+
+type walEntry struct {
+	sync.Mutex
+	p           packet.PublishPacket
+	from        string
+	distributed bool
+	recipients  []string //subscribed when accepted, till distributed
+	pending     map[delivery]bool
+}
+
+type wal struct {
+	sync.Mutex //of seq, entries and index, taken after the lock of an entry
+	seq        uint64
+	entries    map[uint64]*walEntry //id->message
+	index      map[delivery]uint64  //delivery->id
+}
+
+// newWAL loads the messages logged, and recovers them.
+func newWAL() *wal {
+	w := &wal{
+		entries: make(map[uint64]*walEntry),
+		index:   make(map[delivery]uint64),
+	}
+	datas, err := persister.LoadAll(KeyWAL)
+	if err != nil {
+		logger.Error("load write-ahead log fail", "err", err)
+	}
+	for k, v := range datas {
+		id, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			continue
+		}
+		data, _, err := mqtt.Unwrap(mqtt.KindWAL, KeyWAL, k, v, persister)
+		if err != nil {
+			logger.Warn("logged message invalid", "id", k, "err", err)
+			continue
+		}
+		e, err := decodeWALEntry(data)
+		if err != nil {
+			logger.Warn("logged message invalid", "id", k, "err", err)
+			continue
+		}
+		if id > w.seq {
+			w.seq = id
+		}
+		w.entries[id] = e
+	}
+	w.recover()
+	return w
+}
+
+// recover sends the messages logged to the sessions persisted, w not used
+// yet.
+func (w *wal) recover() {
+	sessions := make(map[string]*mqtt.Session)
+	session := func(clientId string) *mqtt.Session {
+		s, ok := sessions[clientId]
+		if !ok {
+			var err error
+			if s, err = mqtt.LoadSession(KeySession, clientId, persister); err != nil {
+				logger.Error("load session fail", "client_id", clientId, "err", err)
+			}
+			sessions[clientId] = s
+		}
+		return s
+	}
+
+	for id, e := range w.entries {
+		if !e.distributed {
+			if e.p.Retain {
+				RetainRegistry.Add(string(e.p.TopicName), e.p)
+			}
+			for _, clientId := range e.recipients {
+				if clientId == e.from {
+					continue
+				}
+				s := session(clientId)
+				if s == nil {
+					continue
+				}
+				matched, max := match(s.GetSubscription(), string(e.p.TopicName))
+				if !matched || max == packet.QoS0 {
+					continue
+				}
+				p := e.p
+				if p.Qos > max {
+					p.Qos = max
+				}
+				p.PacketId = freePacketId(s)
+				p.Dup = true
+				s.AddPubOut(p.PacketId, p)
+				e.pending[delivery{clientId, uint16(p.PacketId)}] = true
+			}
+			e.distributed = true
+			e.recipients = nil
+		} else {
+			//the packets not added to the session when crashed
+			for d := range e.pending {
+				s := session(d.clientId)
+				if s == nil {
+					delete(e.pending, d)
+					continue
+				}
+				if _, ok := s.GetPubOut(packet.Integer(d.packetId)); !ok {
+					p := e.p
+					p.PacketId = packet.Integer(d.packetId)
+					p.Dup = true
+					s.AddPubOut(p.PacketId, p)
+				}
+			}
+		}
+		for d := range e.pending {
+			w.index[d] = id
+		}
+		w.save(id, e)
+	}
+}
+
+// freePacketId returns a packet id not used by the packets of s.
+func freePacketId(s *mqtt.Session) packet.Integer {
+	s.RLock()
+	defer s.RUnlock()
+	var max uint16
+	for k := range s.PubOut {
+		if k > max {
+			max = k
+		}
+	}
+	for id := max + 1; ; id++ {
+		if _, ok := s.PubOut[id]; !ok && id != 0 {
+			return packet.Integer(id)
+		}
+	}
+}
+
+// save writes e locked, or deletes it once it has been acknowledged by all.
+func (w *wal) save(id uint64, e *walEntry) error {
+	field := strconv.FormatUint(id, 10)
+	if e.distributed && len(e.pending) == 0 {
+		w.Lock()
+		delete(w.entries, id)
+		w.Unlock()
+		return persister.Delete(KeyWAL, field)
+	}
+	data, err := encodeWALEntry(e)
+	if err != nil {
+		return err
+	}
+	return persister.Save(KeyWAL, field, mqtt.Wrap(mqtt.KindWAL, data))
+}
+
+// accept logs p received from the client, with the subscribers connected, it
+// has to be acknowledged after.
+func (w *wal) accept(p packet.PublishPacket, from string) (id uint64, err error) {
+	if w == nil || p.Qos == packet.QoS0 {
+		return
+	}
+	e := &walEntry{
+		p:          p,
+		from:       from,
+		recipients: ConnRegistry.subscribers(string(p.TopicName), from),
+		pending:    make(map[delivery]bool),
+	}
+	e.Lock()
+	defer e.Unlock()
+	w.Lock()
+	w.seq++
+	id = w.seq
+	w.entries[id] = e
+	w.Unlock()
+	if err = w.save(id, e); err != nil {
+		w.Lock()
+		delete(w.entries, id)
+		w.Unlock()
+		return 0, err
+	}
+	return
+}
+
+// entry returns the message logged as id.
+func (w *wal) entry(id uint64) (e *walEntry, ok bool) {
+	w.Lock()
+	defer w.Unlock()
+	e, ok = w.entries[id]
+	return
+}
+
+// distribute sends the message logged to the subscribers, and tracks the
+// deliveries until acknowledged. A message not logged is sent only.
+func (w *wal) distribute(id uint64, p packet.PublishPacket, excludeId string) {
+	if w == nil || id == 0 {
+		ConnRegistry.Publish(p, excludeId)
+		return
+	}
+	e, ok := w.entry(id)
+	if !ok {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	//indexed before unlocked, an acknowledgement comes after
+	w.Lock()
+	for _, d := range ConnRegistry.Publish(p, excludeId) {
+		e.pending[d] = true
+		w.index[d] = id
+	}
+	w.Unlock()
+	e.distributed = true
+	e.recipients = nil
+	if err := w.save(id, e); err != nil {
+		logger.Error("write-ahead log fail", "err", err)
+	}
+}
+
+// drop deletes the message logged, not distributed.
+func (w *wal) drop(id uint64) {
+	if w == nil || id == 0 {
+		return
+	}
+	e, ok := w.entry(id)
+	if !ok {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.distributed = true
+	e.recipients = nil
+	if err := w.save(id, e); err != nil {
+		logger.Error("write-ahead log fail", "err", err)
+	}
+}
+
+// ack records the acknowledgement of the packet sent to the client.
+func (w *wal) ack(clientId string, packetId packet.Integer) {
+	if w == nil {
+		return
+	}
+	d := delivery{clientId, uint16(packetId)}
+	w.Lock()
+	id, ok := w.index[d]
+	delete(w.index, d)
+	e := w.entries[id]
+	w.Unlock()
+	if !ok || e == nil {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	delete(e.pending, d)
+	if err := w.save(id, e); err != nil {
+		logger.Error("write-ahead log fail", "err", err)
+	}
+}
+
+// forget drops the deliveries to the client, whose session is gone.
+func (w *wal) forget(clientId string) {
+	if w == nil {
+		return
+	}
+	forgotten := make(map[uint64][]delivery)
+	w.Lock()
+	for d, id := range w.index {
+		if d.clientId == clientId {
+			delete(w.index, d)
+			forgotten[id] = append(forgotten[id], d)
+		}
+	}
+	w.Unlock()
+	for id, ds := range forgotten {
+		e, ok := w.entry(id)
+		if !ok {
+			continue
+		}
+		e.Lock()
+		for _, d := range ds {
+			delete(e.pending, d)
+		}
+		if err := w.save(id, e); err != nil {
+			logger.Error("write-ahead log fail", "err", err)
+		}
+		e.Unlock()
+	}
+}
+
+// Len returns the number of messages not acknowledged by all.
+func (w *wal) Len() int {
+	if w == nil {
+		return 0
+	}
+	w.Lock()
+	defer w.Unlock()
+	return len(w.entries)
+}
+
+var errWALEntry = errors.New("invalid write-ahead log entry")
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return "", errWALEntry
+	}
+	b := make([]byte, n)
+	io.ReadFull(r, b)
+	return string(b), nil
+}
+
+func encodeWALEntry(e *walEntry) ([]byte, error) {
+	b := []byte{2}
+	if e.distributed {
+		b[0] = 1
+	}
+	b = appendString(b, e.from)
+	if !e.distributed {
+		b = binary.AppendUvarint(b, uint64(len(e.recipients)))
+		for _, clientId := range e.recipients {
+			b = appendString(b, clientId)
+			b = binary.BigEndian.AppendUint16(b, 0)
+		}
+	} else {
+		b = binary.AppendUvarint(b, uint64(len(e.pending)))
+		for d := range e.pending {
+			b = appendString(b, d.clientId)
+			b = binary.BigEndian.AppendUint16(b, d.packetId)
+		}
+	}
+	p, err := mqtt.EncodePublish(e.p)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, p...), nil
+}
+
+func decodeWALEntry(data []byte) (e *walEntry, err error) {
+	r := bytes.NewReader(data)
+	flag, err := r.ReadByte()
+	if err != nil || flag != 1 && flag != 2 {
+		return nil, errWALEntry
+	}
+	e = &walEntry{distributed: flag == 1, pending: make(map[delivery]bool)}
+	if flag == 2 {
+		e.recipients = []string{}
+	}
+	if e.from, err = readString(r); err != nil {
+		return nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errWALEntry
+	}
+	for i := uint64(0); i < n; i++ {
+		var d delivery
+		if d.clientId, err = readString(r); err != nil {
+			return nil, err
+		}
+		var id [2]byte
+		if _, err = io.ReadFull(r, id[:]); err != nil {
+			return nil, errWALEntry
+		}
+		d.packetId = binary.BigEndian.Uint16(id[:])
+		if flag == 2 {
+			e.recipients = append(e.recipients, d.clientId)
+		} else {
+			e.pending[d] = true
+		}
+	}
+	if e.p, err = mqtt.DecodePublish(data[len(data)-r.Len():]); err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+	"testing"
+)
+
+func TestWALRecover(t *testing.T) {
+	initPersister()
+	//subscribed when accepted, or not connected
+	for _, id := range []string{"sub1", "sub2"} {
+		s := testConn(t, id).session
+		s.AddPubOut(1, packet.PublishPacket{Qos: 1, TopicName: "x", PacketId: 1})
+		s.AddSubscription([]packet.TopicFilter{{Topic: "a/#", Qos: 1}})
+	}
+	for _, id := range []string{"pub", "offline"} {
+		s := mqtt.NewSession()
+		s.AddPubOut(1, packet.PublishPacket{Qos: 1, TopicName: "x", PacketId: 1})
+		s.AddSubscription([]packet.TopicFilter{{Topic: "a/#", Qos: 1}})
+		if err := s.Bind(KeySession, id, persister); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := newWAL()
+	p := packet.PublishPacket{Qos: 2, TopicName: "a/b", PacketId: 7, ApplicationMessage: "m"}
+	if _, err := w.accept(p, "pub"); err != nil {
+		t.Fatal(err)
+	}
+	//crashed before distributed
+	w = newWAL()
+	if w.Len() != 1 || len(w.index) != 2 {
+		t.Fatalf("want 1 message to 2 subscribers, actual %d %d", w.Len(), len(w.index))
+	}
+	for _, id := range []string{"sub1", "sub2"} {
+		s, _ := mqtt.LoadSession(KeySession, id, persister)
+		pp, ok := s.GetPubOut(2)
+		if !ok || pp.Qos != 1 || pp.ApplicationMessage != "m" {
+			t.Errorf("'%s' not recovered: %+v", id, s.PubOut)
+		}
+	}
+	if s, _ := mqtt.LoadSession(KeySession, "pub", persister); len(s.PubOut) != 1 {
+		t.Errorf("sent back to the publisher")
+	}
+	if s, _ := mqtt.LoadSession(KeySession, "offline", persister); len(s.PubOut) != 1 {
+		t.Errorf("sent to a session not subscribed when accepted")
+	}
+
+	//acknowledged by one, the other session lost the packet
+	s, _ := mqtt.LoadSession(KeySession, "sub1", persister)
+	s.RemovePubOut(2)
+	w.ack("sub1", 2)
+	s, _ = mqtt.LoadSession(KeySession, "sub2", persister)
+	s.RemovePubOut(2)
+	w = newWAL()
+	if s, _ := mqtt.LoadSession(KeySession, "sub2", persister); !hasPubOut(s, 2) {
+		t.Errorf("lost packet not resent")
+	}
+	if s, _ := mqtt.LoadSession(KeySession, "sub1", persister); len(s.PubOut) != 1 {
+		t.Errorf("acknowledged packet resent")
+	}
+
+	w.forget("sub2")
+	if datas, _ := persister.LoadAll(KeyWAL); w.Len() != 0 || len(datas) != 0 {
+		t.Errorf("message should be removed once acknowledged, %d %d", w.Len(), len(datas))
+	}
+}
+
+func TestWALDistribute(t *testing.T) {
+	initPersister()
+	w := newWAL()
+	id, _ := w.accept(packet.PublishPacket{Qos: 1, TopicName: "a"}, "pub")
+	if datas, _ := persister.LoadAll(KeyWAL); len(datas) != 1 {
+		t.Errorf("message not logged")
+	}
+	//no subscriber
+	w.distribute(id, packet.PublishPacket{Qos: 1, TopicName: "a"}, "pub")
+	if datas, _ := persister.LoadAll(KeyWAL); w.Len() != 0 || len(datas) != 0 {
+		t.Errorf("message without subscriber should be removed")
+	}
+
+	if id, _ = w.accept(packet.PublishPacket{TopicName: "a"}, "pub"); id != 0 || w.Len() != 0 {
+		t.Errorf("QoS 0 message logged")
+	}
+}
+
+func TestWALEntry(t *testing.T) {
+	e := &walEntry{
+		p:           packet.PublishPacket{Qos: 1, TopicName: "a", PacketId: 3, ApplicationMessage: "m"},
+		from:        "pub",
+		distributed: true,
+		pending:     map[delivery]bool{{"c1", 1}: true, {"c2", 65535}: true},
+	}
+	data, err := encodeWALEntry(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ee, err := decodeWALEntry(data)
+	if err != nil || ee.p != e.p || ee.from != e.from || !ee.distributed || len(ee.pending) != 2 || !ee.pending[delivery{"c2", 65535}] {
+		t.Errorf("want %+v actual %+v %v", e, ee, err)
+	}
+	e = &walEntry{p: e.p, from: "pub", recipients: []string{"c1"}, pending: map[delivery]bool{}}
+	if data, err = encodeWALEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	ee, err = decodeWALEntry(data)
+	if err != nil || ee.distributed || len(ee.recipients) != 1 || ee.recipients[0] != "c1" || len(ee.pending) != 0 {
+		t.Errorf("want recipients %v actual %+v %v", e.recipients, ee, err)
+	}
+	data[0] = 0
+	if _, err = decodeWALEntry(data); err == nil {
+		t.Errorf("unknown flag decoded")
+	}
+	data[0] = 2
+	if _, err = decodeWALEntry(data[:5]); err == nil {
+		t.Errorf("truncated entry should be invalid")
+	}
+}
+
+func hasPubOut(s *mqtt.Session, id packet.Integer) bool {
+	_, ok := s.GetPubOut(id)
+	return ok
+}
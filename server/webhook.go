@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hilldan/mqtt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the payload encodings of Webhook
+const (
+	EncodingBase64 = "base64"
+	EncodingPlain  = "plain" //as a string, for the payloads in UTF-8
+)
+
+// Webhook is the EventSink posting the events to URLs, as JSON arrays of up
+// to BatchSize events. The payload of a published event is in "payload",
+// encoded as told by "encoding". It is started by Start, and added by
+// AddEventSink.
+type Webhook struct {
+	URLs      []string
+	Header    http.Header //added to the requests, the authorization for example
+	Events    []string    //types of the events posted, all by default
+	Topics    []string    //filters of the published events posted, all by default
+	Encoding  string      //of the payloads, EncodingBase64 by default
+	BatchSize int         //events a request at most
+	BatchWait time.Duration
+	// Retries is the times a request failed is retried, RetryWait after,
+	// doubled every retry. The events are dropped once all failed. Every URL
+	// is posted to by its own worker, so a URL failing delays only itself.
+	Retries   int
+	RetryWait time.Duration
+	QueueSize int //events waiting to be posted to a URL, dropped once full
+	Client    *http.Client
+
+	queue   chan Event
+	posts   []chan webhookPost //of the URLs
+	exitch  chan struct{}
+	done    chan struct{}
+	workers sync.WaitGroup
+	warned  sync.Once
+}
+
+// webhookPost is a batch of events encoded.
+type webhookPost struct {
+	body   []byte
+	events int
+}
+
+// webhookEvent is an event posted.
+type webhookEvent struct {
+	Event
+	Payload  *string `json:"payload,omitempty"`
+	Encoding string  `json:"encoding,omitempty"`
+}
+
+// Start posts the events sent, till closed.
+func (w *Webhook) Start() {
+	if w.Encoding == "" {
+		w.Encoding = EncodingBase64
+	}
+	if w.BatchSize <= 0 {
+		w.BatchSize = 1
+	}
+	if w.BatchWait <= 0 {
+		w.BatchWait = time.Second
+	}
+	if w.RetryWait <= 0 {
+		w.RetryWait = time.Second
+	}
+	if w.QueueSize <= 0 {
+		w.QueueSize = 1000
+	}
+	if w.Client == nil {
+		w.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	w.queue = make(chan Event, w.QueueSize)
+	w.exitch = make(chan struct{})
+	w.done = make(chan struct{})
+	n := w.QueueSize / w.BatchSize
+	if n < 1 {
+		n = 1
+	}
+	w.posts = make([]chan webhookPost, len(w.URLs))
+	for i, url := range w.URLs {
+		w.posts[i] = make(chan webhookPost, n)
+		w.workers.Add(1)
+		go w.worker(url, w.posts[i])
+	}
+	go w.run()
+}
+
+// Close posts the events queued, tried once more without waiting, and stops.
+func (w *Webhook) Close() {
+	select {
+	case <-w.exitch:
+	default:
+		close(w.exitch)
+	}
+	<-w.done
+}
+
+// Send queues e, if selected by the filters. The events sent before Start
+// or after Close are dropped.
+func (w *Webhook) Send(e Event) {
+	if !w.selected(e) {
+		return
+	}
+	if w.queue == nil || w.closed() {
+		w.warned.Do(func() { logger.Warn("webhook not running, events dropped", "urls", w.URLs) })
+		metrics.drop("webhook_stopped")
+		return
+	}
+	select {
+	case w.queue <- e:
+	default:
+		metrics.drop("webhook_full")
+	}
+}
+
+func (w *Webhook) closed() bool {
+	select {
+	case <-w.exitch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *Webhook) selected(e Event) bool {
+	if len(w.Events) > 0 && !containsString(w.Events, e.Type) {
+		return false
+	}
+	if e.Type != EventPublished || len(w.Topics) == 0 {
+		return true
+	}
+	for _, f := range w.Topics {
+		if mqtt.MatchTopic(f, e.Topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Webhook) run() {
+	defer func() {
+		for _, posts := range w.posts {
+			close(posts)
+		}
+		w.workers.Wait()
+		close(w.done)
+	}()
+	var batch []Event
+	var flush <-chan time.Time
+	for {
+		select {
+		case e := <-w.queue:
+			batch = append(batch, e)
+			if len(batch) < w.BatchSize {
+				if flush == nil {
+					flush = time.After(w.BatchWait)
+				}
+				continue
+			}
+		case <-flush:
+		case <-w.exitch:
+			for len(w.queue) > 0 {
+				batch = append(batch, <-w.queue)
+			}
+			for len(batch) > 0 {
+				n := w.BatchSize
+				if n > len(batch) {
+					n = len(batch)
+				}
+				w.post(batch[:n])
+				batch = batch[n:]
+			}
+			return
+		}
+		w.post(batch)
+		batch, flush = nil, nil
+	}
+}
+
+// post queues the events to the workers of every URL.
+func (w *Webhook) post(events []Event) {
+	body, err := w.encode(events)
+	if err != nil {
+		logger.Error("webhook encode fail", "err", err)
+		return
+	}
+	for i, posts := range w.posts {
+		select {
+		case posts <- webhookPost{body, len(events)}:
+		default:
+			logger.Warn("webhook queue full", "url", w.URLs[i], "events", len(events))
+			metrics.drop("webhook_full")
+		}
+	}
+}
+
+// worker posts to url, retrying till closed.
+func (w *Webhook) worker(url string, posts <-chan webhookPost) {
+	defer w.workers.Done()
+	for p := range posts {
+		wait := w.RetryWait
+		for i := 0; ; i++ {
+			err := w.do(url, p.body)
+			if err == nil {
+				break
+			}
+			if i == w.Retries || w.closed() {
+				logger.Warn("webhook fail", "url", url, "events", p.events, "err", err)
+				metrics.drop("webhook")
+				break
+			}
+			select {
+			case <-time.After(wait):
+			case <-w.exitch:
+			}
+			wait *= 2
+		}
+	}
+}
+
+func (w *Webhook) encode(events []Event) ([]byte, error) {
+	posted := make([]webhookEvent, len(events))
+	for i, e := range events {
+		posted[i].Event = e
+		if e.Type != EventPublished {
+			continue
+		}
+		payload := string(e.Payload)
+		if w.Encoding == EncodingBase64 {
+			payload = base64.StdEncoding.EncodeToString(e.Payload)
+		}
+		posted[i].Payload, posted[i].Encoding = &payload, w.Encoding
+	}
+	return json.Marshal(posted)
+}
+
+func (w *Webhook) do(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range w.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"hilldan/mqtt/packet"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookServer records the events posted, failing the first fails requests.
+type hookServer struct {
+	sync.Mutex
+	fails    int
+	requests int
+	batches  [][]map[string]interface{}
+}
+
+func (h *hookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	h.requests++
+	if h.fails > 0 {
+		h.fails--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var batch []map[string]interface{}
+	if r.Header.Get("Authorization") != "Bearer t" || json.NewDecoder(r.Body).Decode(&batch) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.batches = append(h.batches, batch)
+}
+
+func (h *hookServer) events() (events []map[string]interface{}) {
+	h.Lock()
+	defer h.Unlock()
+	for _, v := range h.batches {
+		events = append(events, v...)
+	}
+	return
+}
+
+func TestWebhook(t *testing.T) {
+	h := &hookServer{fails: 1}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	w := &Webhook{
+		URLs:      []string{srv.URL},
+		Header:    http.Header{"Authorization": {"Bearer t"}},
+		Events:    []string{EventConnected, EventPublished},
+		Topics:    []string{"a/#"},
+		Encoding:  EncodingPlain,
+		BatchSize: 2,
+		BatchWait: 20 * time.Millisecond,
+		Retries:   1,
+		RetryWait: time.Millisecond,
+	}
+	w.Start()
+	w.Send(Event{Type: EventConnected, ClientId: "c"})
+	w.Send(Event{Type: EventSubscribed, ClientId: "c", Filters: []string{"a/#"}})
+	w.Send(Event{Type: EventPublished, ClientId: "c", Topic: "b", Payload: []byte("x")})
+	w.Send(Event{Type: EventPublished, ClientId: "c", Topic: "a/1", Payload: []byte("hello")})
+	waitFor(t, "batch", func() bool { return len(h.events()) == 2 })
+
+	//flushed after BatchWait, and on closing
+	w.Send(Event{Type: EventPublished, ClientId: "c", Topic: "a/2", Qos: 1})
+	waitFor(t, "flush", func() bool { return len(h.events()) == 3 })
+	w.Send(Event{Type: EventConnected, ClientId: "d"})
+	w.Close()
+
+	events := h.events()
+	if len(events) != 4 || len(h.batches) != 3 || h.requests != 4 {
+		t.Fatalf("%d requests %v", h.requests, h.batches)
+	}
+	if e := events[1]; e["type"] != EventPublished || e["topic"] != "a/1" || e["payload"] != "hello" || e["encoding"] != EncodingPlain {
+		t.Errorf("published %v", e)
+	}
+	if e := events[2]; e["payload"] != "" || e["qos"] != 1.0 {
+		t.Errorf("empty payload %v", e)
+	}
+	if e := events[0]; e["client_id"] != "c" || e["payload"] != nil || e["time"] == nil {
+		t.Errorf("connected %v", e)
+	}
+
+	body, _ := (&Webhook{Encoding: EncodingBase64}).encode([]Event{{Type: EventPublished, Payload: []byte{0xff}}})
+	var posted []webhookEvent
+	if json.Unmarshal(body, &posted); *posted[0].Payload != "/w==" {
+		t.Errorf("base64 %s", body)
+	}
+}
+
+func TestWebhookFail(t *testing.T) {
+	h := &hookServer{fails: 3}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	w := &Webhook{URLs: []string{srv.URL}, Retries: 2, RetryWait: time.Millisecond}
+	w.Start()
+	failed := metrics.dropped.snapshot()["webhook"]
+	w.Send(Event{Type: EventConnected})
+	waitFor(t, "retries", func() bool { return metrics.dropped.snapshot()["webhook"] == failed+1 })
+	w.Close()
+	if h.requests != 3 || len(h.batches) != 0 {
+		t.Errorf("%d requests %v", h.requests, h.batches)
+	}
+}
+
+func TestWebhookDeadURL(t *testing.T) {
+	dead := httptest.NewServer(&hookServer{fails: 1 << 30})
+	defer dead.Close()
+	h := &hookServer{}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	w := &Webhook{
+		URLs:      []string{dead.URL, srv.URL},
+		Header:    http.Header{"Authorization": {"Bearer t"}},
+		BatchWait: time.Millisecond,
+		Retries:   5,
+		RetryWait: time.Hour,
+	}
+	//dropped before started
+	stopped := metrics.dropped.snapshot()["webhook_stopped"]
+	w.Send(Event{Type: EventConnected})
+	if metrics.dropped.snapshot()["webhook_stopped"] != stopped+1 {
+		t.Errorf("not started, not dropped")
+	}
+	w.Start()
+	w.Send(Event{Type: EventConnected})
+	waitFor(t, "posted past the dead URL", func() bool { return len(h.events()) == 1 })
+
+	//the retry waiting interrupted
+	start := time.Now()
+	w.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("closed in %v", d)
+	}
+	w.Send(Event{Type: EventConnected})
+	if metrics.dropped.snapshot()["webhook_stopped"] != stopped+2 {
+		t.Errorf("closed, not dropped")
+	}
+}
+
+// chanSink sends the events to a channel.
+type chanSink chan Event
+
+func (s chanSink) Send(e Event) { s <- e }
+
+func TestEmit(t *testing.T) {
+	initPersister()
+	s := make(chanSink, 10)
+	old := sinks
+	sinks = []EventSink{s}
+	defer func() { sinks = old }()
+
+	c := testConn(t, "e")
+	handlePacket(&packet.SubscribePacket{PacketId: 1, TopicFilters: []packet.TopicFilter{{Topic: "a/#", Qos: 1}}}, c, nil)
+	handlePacket(&packet.PublishPacket{TopicName: "a/b", ApplicationMessage: "x"}, c, nil)
+	handlePacket(&packet.UnsubscribePacket{PacketId: 2, TopicFilter: []packet.String{"a/#"}}, c, nil)
+	c.closeConn("test", false)
+	for _, want := range []string{EventSubscribed, EventPublished, EventUnsubscribed, EventDisconnected} {
+		select {
+		case e := <-s:
+			if e.Type != want || e.ClientId != "e" || e.Time.IsZero() {
+				t.Errorf("want %s actual %+v", want, e)
+			}
+			if want == EventPublished && (e.Topic != "a/b" || string(e.Payload) != "x") {
+				t.Errorf("published %+v", e)
+			}
+			if want == EventDisconnected && e.Cause != "test" {
+				t.Errorf("disconnected %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not emitted", want)
+		}
+	}
+}
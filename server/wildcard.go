@@ -1,6 +1,9 @@
 package server
 
-import "hilldan/mqtt/packet"
+import (
+	"hilldan/mqtt"
+	"hilldan/mqtt/packet"
+)
 
 // if a Client subscribes to “sport/tennis/player1/#”, it would receive messages
 // published using these topic names:
@@ -209,17 +212,10 @@ func match(subs []packet.TopicFilter, topic string) (matched bool, maxQos packet
 	return
 }
 
+// matchOne matches the messages published to the subscriptions, the same
+// as the retained ones are, see mqtt.MatchTopic.
 func matchOne(sub, topic string) bool {
-	p1, err := WildcardRegistry.Get(sub)
-	if err != nil {
-		return false
-	}
-	p2, err := WildcardRegistry.Get(topic)
-	if err != nil {
-		return false
-	}
-
-	return matchPath(p1, p2)
+	return mqtt.MatchTopic(sub, topic)
 }
 
 // compare compares 2 subscription topic
@@ -1,7 +1,6 @@
 package mqtt
 
 import (
-	"encoding/json"
 	"sync"
 
 	"hilldan/mqtt/packet"
@@ -20,11 +19,15 @@ type Session struct {
 
 	//The Client’s subscriptions.
 	Subscript []packet.TopicFilter
+
+	//incremental persistence, see Bind
+	store *sessionStore
 }
 
 func (s *Session) AddPubOut(packetId packet.Integer, p packet.PublishPacket) {
 	s.Lock()
 	s.PubOut[uint16(packetId)] = p
+	s.store.saveOut(uint16(packetId), p)
 	s.Unlock()
 }
 func (s *Session) GetPubOut(packetId packet.Integer) (p packet.PublishPacket, ok bool) {
@@ -33,11 +36,22 @@ func (s *Session) GetPubOut(packetId packet.Integer) (p packet.PublishPacket, ok
 	s.RUnlock()
 	return
 }
-func (s *Session) RemovePubOut(packetId packet.Integer) {
+
+// RemovePubOut removes the packet acknowledged, and reports whether it was there.
+func (s *Session) RemovePubOut(packetId packet.Integer) (ok bool) {
 	s.Lock()
+	_, ok = s.PubOut[uint16(packetId)]
 	delete(s.PubOut, uint16(packetId))
+	if ok {
+		s.store.deleteOut(uint16(packetId))
+	}
 	s.Unlock()
+	return
 }
+
+// ResetPubOut takes all the packets not acknowledged out of the session, so
+// that they can be resent and added again. The persisted ones are kept until
+// they are acknowledged.
 func (s *Session) ResetPubOut() (old map[uint16]packet.PublishPacket) {
 	s.Lock()
 	defer s.Unlock()
@@ -52,6 +66,7 @@ func (s *Session) ResetPubOut() (old map[uint16]packet.PublishPacket) {
 func (s *Session) AddPubIn(packetId packet.Integer) {
 	s.Lock()
 	s.PubIn[uint16(packetId)] = true
+	s.store.saveIn(uint16(packetId))
 	s.Unlock()
 }
 func (s *Session) GetPubIn(packetId packet.Integer) (ok bool) {
@@ -62,13 +77,19 @@ func (s *Session) GetPubIn(packetId packet.Integer) (ok bool) {
 }
 func (s *Session) RemovePubIn(packetId packet.Integer) {
 	s.Lock()
+	_, ok := s.PubIn[uint16(packetId)]
 	delete(s.PubIn, uint16(packetId))
+	if ok {
+		s.store.deleteIn(uint16(packetId))
+	}
 	s.Unlock()
 }
 
 func (s *Session) SetSubscription(sub []packet.TopicFilter) {
 	s.Lock()
+	old := s.Subscript
 	s.Subscript = sub
+	s.store.saveSubs(old, s.Subscript)
 	s.Unlock()
 }
 func (s *Session) GetSubscription() []packet.TopicFilter {
@@ -80,7 +101,10 @@ func (s *Session) GetSubscription() []packet.TopicFilter {
 }
 func (s *Session) AddSubscription(tfs []packet.TopicFilter) {
 	s.Lock()
+	old := make([]packet.TopicFilter, len(s.Subscript))
+	copy(old, s.Subscript)
 	s.Subscript = append(s.Subscript, tfs...)
+	s.store.saveSubs(old, s.Subscript)
 	s.Unlock()
 }
 func (s *Session) Unsubscription(unsub []packet.String) {
@@ -89,6 +113,9 @@ func (s *Session) Unsubscription(unsub []packet.String) {
 	}
 	s.Lock()
 	defer s.Unlock()
+	old := make([]packet.TopicFilter, len(s.Subscript))
+	copy(old, s.Subscript)
+	defer func() { s.store.saveSubs(old, s.Subscript) }()
 	for _, v := range unsub {
 		for k, vv := range s.Subscript {
 			if v == vv.Topic {
@@ -106,12 +133,17 @@ func NewSession() *Session {
 	}
 }
 
+// Save records the time the session is saved at key/clientId. The session
+// bound there has been persisted incrementally, otherwise it is bound and
+// written completely, see Bind.
 func (s *Session) Save(key, clientId string, persister Persister) error {
-	b, err := json.Marshal(s)
-	if err != nil {
-		return err
+	s.RLock()
+	st := s.store
+	s.RUnlock()
+	if st == nil || st.key != key || st.clientId != clientId {
+		return s.Bind(key, clientId, persister)
 	}
-	return persister.Save(key, clientId, b)
+	return st.saveMeta()
 }
 func (s *Session) MustInit() {
 	if s.PubOut == nil {
@@ -0,0 +1,330 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"time"
+
+	"hilldan/mqtt/packet"
+)
+
+// A session bound at key/clientId is persisted incrementally as:
+//
+//	key                   clientId -> time saved, 8 bytes unix nano
+//	key:clientId:out      packetId -> packet not acknowledged, MQTT wire format
+//	key:clientId:in       packetId -> 1, QoS 2 packet received
+//	key:clientId:sub      topic    -> qos(1) | position(uvarint)
+//
+// so that every change is written as soon as it happens, and only itself.
+// Every data is wrapped in the envelope of its kind, see Wrap.
+const (
+	kindOut = "out"
+	kindIn  = "in"
+	kindSub = "sub"
+)
+
+type sessionStore struct {
+	key      string
+	clientId string
+	p        Persister
+}
+
+func (st *sessionStore) entryKey(kind string) string {
+	return st.key + ":" + st.clientId + ":" + kind
+}
+
+func (st *sessionStore) logErr(err error) {
+	if err != nil {
+		logger.Error("persist session fail", "client_id", st.clientId, "err", err)
+	}
+}
+
+func (st *sessionStore) meta() []byte {
+	return encodeTime(time.Now())
+}
+
+func (st *sessionStore) saveMeta() error {
+	return st.p.Save(st.key, st.clientId, Wrap(KindSession, st.meta()))
+}
+
+func (st *sessionStore) save(kind, entry, field string, data []byte) error {
+	return st.p.Save(st.entryKey(entry), field, Wrap(kind, data))
+}
+
+func (st *sessionStore) saveOut(packetId uint16, p packet.PublishPacket) {
+	if st == nil {
+		return
+	}
+	data, err := EncodePublish(p)
+	if err == nil {
+		err = st.save(KindSessionOut, kindOut, strconv.Itoa(int(packetId)), data)
+	}
+	st.logErr(err)
+}
+func (st *sessionStore) deleteOut(packetId uint16) {
+	if st == nil {
+		return
+	}
+	st.logErr(st.p.Delete(st.entryKey(kindOut), strconv.Itoa(int(packetId))))
+}
+func (st *sessionStore) saveIn(packetId uint16) {
+	if st == nil {
+		return
+	}
+	st.logErr(st.save(KindSessionIn, kindIn, strconv.Itoa(int(packetId)), []byte{1}))
+}
+func (st *sessionStore) deleteIn(packetId uint16) {
+	if st == nil {
+		return
+	}
+	st.logErr(st.p.Delete(st.entryKey(kindIn), strconv.Itoa(int(packetId))))
+}
+
+// saveSubs writes the difference between the subscriptions old and now.
+func (st *sessionStore) saveSubs(old, now []packet.TopicFilter) {
+	if st == nil {
+		return
+	}
+	type pos struct {
+		qos packet.Bit2
+		i   int
+	}
+	m := make(map[packet.String]pos, len(old))
+	for i, v := range old {
+		m[v.Topic] = pos{v.Qos, i}
+	}
+	for i, v := range now {
+		if o, ok := m[v.Topic]; !ok || o.qos != v.Qos || o.i != i {
+			st.logErr(st.save(KindSessionSub, kindSub, string(v.Topic), encodeSub(v.Qos, i)))
+		}
+		delete(m, v.Topic)
+	}
+	for topic := range m {
+		st.logErr(st.p.Delete(st.entryKey(kindSub), string(topic)))
+	}
+}
+
+// saveEntries writes all the packets and subscriptions of the session.
+func (st *sessionStore) saveEntries(s *Session) error {
+	for k, v := range s.PubOut {
+		data, err := EncodePublish(v)
+		if err != nil {
+			return err
+		}
+		if err = st.save(KindSessionOut, kindOut, strconv.Itoa(int(k)), data); err != nil {
+			return err
+		}
+	}
+	for k := range s.PubIn {
+		if err := st.save(KindSessionIn, kindIn, strconv.Itoa(int(k)), []byte{1}); err != nil {
+			return err
+		}
+	}
+	for i, v := range s.Subscript {
+		if err := st.save(KindSessionSub, kindSub, string(v.Topic), encodeSub(v.Qos, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bind writes the whole session at key/clientId in persister, replacing the
+// one stored there, and persists every later change of it incrementally.
+func (s *Session) Bind(key, clientId string, persister Persister) error {
+	st := &sessionStore{key: key, clientId: clientId, p: persister}
+	if err := DeleteSession(key, clientId, persister); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.store = st
+	if err := st.saveEntries(s); err != nil {
+		return err
+	}
+	return st.saveMeta()
+}
+
+// LoadSession loads the session stored at key/clientId in persister, bound
+// there. It returns nil if there is not any. The data of former versions is
+// upgraded, ErrVersion is returned for the incompatible one.
+func LoadSession(key, clientId string, persister Persister) (s *Session, err error) {
+	raw, err := persister.Read(key, clientId)
+	if err != nil || len(raw) == 0 {
+		return
+	}
+	st := &sessionStore{key: key, clientId: clientId, p: persister}
+	meta, upgraded, err := Unwrap(KindSession, key, clientId, raw, persister)
+	if err != nil {
+		return
+	}
+	if upgraded {
+		if err = persister.Save(key, clientId, Wrap(KindSession, meta)); err != nil {
+			return
+		}
+	}
+
+	s = NewSession()
+	err = st.load(KindSessionOut, kindOut, func(field string, data []byte) {
+		id, e := strconv.Atoi(field)
+		p, e2 := DecodePublish(data)
+		if e == nil && e2 == nil {
+			s.PubOut[uint16(id)] = p
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.load(KindSessionIn, kindIn, func(field string, data []byte) {
+		if id, e := strconv.Atoi(field); e == nil {
+			s.PubIn[uint16(id)] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	subs := make(map[string][]byte)
+	err = st.load(KindSessionSub, kindSub, func(field string, data []byte) {
+		subs[field] = data
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.Subscript = decodeSubs(subs)
+	s.store = st
+	return
+}
+
+// load calls f with every entry of kind, upgraded.
+func (st *sessionStore) load(kind, entry string, f func(field string, data []byte)) error {
+	key := st.entryKey(entry)
+	datas, err := st.p.LoadAll(key)
+	if err != nil {
+		return err
+	}
+	for field, raw := range datas {
+		data, _, err := Unwrap(kind, key, field, raw, st.p)
+		if err != nil {
+			return err
+		}
+		f(field, data)
+	}
+	return nil
+}
+
+// SessionKeys returns the keys of the entries of the session stored at
+// key/clientId, besides key itself.
+func SessionKeys(key, clientId string) []string {
+	st := &sessionStore{key: key, clientId: clientId}
+	return []string{st.entryKey(kindOut), st.entryKey(kindIn), st.entryKey(kindSub)}
+}
+
+// DeleteSession deletes the session stored at key/clientId in persister.
+func DeleteSession(key, clientId string, persister Persister) error {
+	for _, k := range SessionKeys(key, clientId) {
+		datas, err := persister.LoadAll(k)
+		if err != nil {
+			return err
+		}
+		for field := range datas {
+			if err = persister.Delete(k, field); err != nil {
+				return err
+			}
+		}
+	}
+	return persister.Delete(key, clientId)
+}
+
+// EncodePublish encodes p in the MQTT wire format.
+func EncodePublish(p packet.PublishPacket) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodePublish decodes a publish packet encoded by EncodePublish.
+func DecodePublish(data []byte) (p packet.PublishPacket, err error) {
+	pp, err := packet.ParsePublishPacket(data)
+	if err != nil {
+		return
+	}
+	//the lengths cached by parsing are left out, to be comparable
+	p = packet.PublishPacket{
+		Dup:                pp.Dup,
+		Qos:                pp.Qos,
+		Retain:             pp.Retain,
+		TopicName:          pp.TopicName,
+		PacketId:           pp.PacketId,
+		ApplicationMessage: pp.ApplicationMessage,
+	}
+	return
+}
+
+// SessionsSaved returns the time every session stored at key was saved last,
+// by client id. A session bound is saved when bound and when the connection
+// closes.
+func SessionsSaved(key string, persister Persister) (saved map[string]time.Time, err error) {
+	datas, err := persister.LoadAll(key)
+	if err != nil {
+		return
+	}
+	saved = make(map[string]time.Time, len(datas))
+	for clientId, raw := range datas {
+		if t, ok := SessionSaved(key, clientId, raw, persister); ok {
+			saved[clientId] = t
+		}
+	}
+	return
+}
+
+// SessionSaved returns the time the session of clientId was saved last, of
+// raw stored at key, see SessionsSaved.
+func SessionSaved(key, clientId string, raw []byte, persister Persister) (t time.Time, ok bool) {
+	meta, _, err := Unwrap(KindSession, key, clientId, raw, persister)
+	if err != nil {
+		return
+	}
+	return decodeTime(meta)
+}
+
+func encodeTime(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+}
+
+func decodeTime(data []byte) (t time.Time, ok bool) {
+	if len(data) != 8 {
+		return
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), true
+}
+
+func encodeSub(qos packet.Bit2, i int) []byte {
+	return binary.AppendUvarint([]byte{byte(qos)}, uint64(i))
+}
+
+func decodeSubs(datas map[string][]byte) []packet.TopicFilter {
+	type sub struct {
+		tf packet.TopicFilter
+		i  uint64
+	}
+	subs := make([]sub, 0, len(datas))
+	for k, v := range datas {
+		if len(v) < 2 {
+			continue
+		}
+		i, n := binary.Uvarint(v[1:])
+		if n <= 0 {
+			continue
+		}
+		subs = append(subs, sub{packet.TopicFilter{Topic: packet.String(k), Qos: packet.Bit2(v[0])}, i})
+	}
+	sort.Slice(subs, func(a, b int) bool { return subs[a].i < subs[b].i })
+	tfs := make([]packet.TopicFilter, len(subs))
+	for k, v := range subs {
+		tfs[k] = v.tf
+	}
+	return tfs
+}
@@ -0,0 +1,81 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+
+	"hilldan/mqtt/packet"
+)
+
+func TestSessionIncremental(t *testing.T) {
+	mp := NewMemPersist()
+	s := NewSession()
+	if err := s.Bind("ss", "c1", mp); err != nil {
+		t.Fatal(err)
+	}
+	s.AddPubOut(1, packet.PublishPacket{Qos: 1, Dup: true, TopicName: "a", PacketId: 1, ApplicationMessage: "m1"})
+	s.AddPubOut(2, packet.PublishPacket{Qos: 2, TopicName: "b", PacketId: 2})
+	s.RemovePubOut(2)
+	s.AddPubIn(7)
+	s.AddSubscription([]packet.TopicFilter{{Topic: "x/#", Qos: 1}, {Topic: "y", Qos: 0}, {Topic: "z", Qos: 2}})
+	s.Unsubscription([]packet.String{"x/#"})
+
+	//written before the session is saved
+	if outs, _ := mp.LoadAll("ss:c1:out"); len(outs) != 1 {
+		t.Errorf("want 1 packet persisted actual %d", len(outs))
+	}
+
+	l, err := LoadSession("ss", "c1", mp)
+	if err != nil || l == nil {
+		t.Fatalf("load session err: %v", err)
+	}
+	p, ok := l.GetPubOut(1)
+	if !ok || p.TopicName != "a" || p.ApplicationMessage != "m1" || !bool(p.Dup) || p.Qos != 1 {
+		t.Errorf("packet not loaded: %+v", p)
+	}
+	if _, ok = l.GetPubOut(2); ok || !l.GetPubIn(7) {
+		t.Errorf("session packets err")
+	}
+	subs := l.GetSubscription()
+	if len(subs) != 2 || subs[0].Topic != "y" || subs[1].Topic != "z" || subs[1].Qos != 2 {
+		t.Errorf("subscription err: %v", subs)
+	}
+
+	//changes of the loaded session are persisted too
+	l.RemovePubIn(7)
+	if l, _ = LoadSession("ss", "c1", mp); l.GetPubIn(7) {
+		t.Errorf("removing not persisted")
+	}
+
+	if err = DeleteSession("ss", "c1", mp); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ = LoadSession("ss", "c1", mp); l != nil {
+		t.Errorf("session should be deleted")
+	}
+	for _, k := range []string{"ss:c1:out", "ss:c1:in", "ss:c1:sub"} {
+		if datas, _ := mp.LoadAll(k); len(datas) != 0 {
+			t.Errorf("%s should be deleted", k)
+		}
+	}
+}
+
+func TestSessionLegacyJson(t *testing.T) {
+	mp := NewMemPersist()
+	s := NewSession()
+	s.PubOut[3] = packet.PublishPacket{Qos: 1, TopicName: "a", PacketId: 3}
+	s.Subscript = []packet.TopicFilter{{Topic: "a", Qos: 1}}
+	data, _ := json.Marshal(s)
+	mp.Save("ss", "c1", data)
+
+	l, err := LoadSession("ss", "c1", mp)
+	if err != nil || l == nil {
+		t.Fatalf("load session err: %v", err)
+	}
+	if _, ok := l.GetPubOut(3); !ok || len(l.GetSubscription()) != 1 {
+		t.Errorf("legacy session not loaded")
+	}
+	if outs, _ := mp.LoadAll("ss:c1:out"); len(outs) != 1 {
+		t.Errorf("legacy session should be rewritten incrementally")
+	}
+}
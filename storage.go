@@ -0,0 +1,212 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"hilldan/mqtt/packet"
+)
+
+// Everything written through Persister is wrapped in an envelope:
+//
+//	0xff | version(1) | data
+//
+// Data written before the envelope was introduced has no header, and is
+// treated as version 0. A kind of data is read at its current version, the
+// older ones are upgraded by the migrations registered, one version a step.
+const envelopeMagic = 0xff
+
+// The kinds of the data written through Persister.
+const (
+	KindSession    = "session"     //session, see LoadSession
+	KindSessionOut = "session.out" //packet not acknowledged of session
+	KindSessionIn  = "session.in"  //QoS 2 packet received of session
+	KindSessionSub = "session.sub" //subscription of session
+	KindRetain     = "retain"      //retained publish packet
+	KindWAL        = "wal"         //message accepted by the broker, not acknowledged
+	KindDelayed    = "delayed"     //message scheduled, see EncodeDelayed
+)
+
+// Migration upgrades the data of a kind stored at key/field by one version.
+// persister is given for the migration which has to write more than the
+// data itself.
+type Migration func(key, field string, data []byte, persister Persister) ([]byte, error)
+
+type format struct {
+	version    uint8
+	migrations map[uint8]Migration //from version->migration
+}
+
+var (
+	formatsl sync.RWMutex
+	formats  = make(map[string]*format)
+)
+
+// RegisterFormat declares the current version of kind.
+func RegisterFormat(kind string, version uint8) {
+	formatsl.Lock()
+	defer formatsl.Unlock()
+	f := formats[kind]
+	if f == nil {
+		f = &format{migrations: make(map[uint8]Migration)}
+		formats[kind] = f
+	}
+	f.version = version
+}
+
+// RegisterMigration registers m upgrading kind from version from to from+1.
+func RegisterMigration(kind string, from uint8, m Migration) {
+	formatsl.Lock()
+	defer formatsl.Unlock()
+	f := formats[kind]
+	if f == nil {
+		f = &format{migrations: make(map[uint8]Migration)}
+		formats[kind] = f
+	}
+	f.migrations[from] = m
+}
+
+func getFormat(kind string) (version uint8, migrations map[uint8]Migration) {
+	formatsl.RLock()
+	defer formatsl.RUnlock()
+	if f, ok := formats[kind]; ok {
+		return f.version, f.migrations
+	}
+	return
+}
+
+// Wrap wraps data of kind in the envelope of its current version.
+func Wrap(kind string, data []byte) []byte {
+	version, _ := getFormat(kind)
+	b := make([]byte, len(data)+2)
+	b[0] = envelopeMagic
+	b[1] = version
+	copy(b[2:], data)
+	return b
+}
+
+// Unwrap returns the data of kind in raw stored at key/field, upgraded to the
+// current version. upgraded reports whether migrations were applied, so that
+// the caller may write it back. ErrVersion is returned for the data newer
+// than the current version or without migration.
+func Unwrap(kind, key, field string, raw []byte, persister Persister) (data []byte, upgraded bool, err error) {
+	var version uint8
+	data = raw
+	if len(raw) >= 2 && raw[0] == envelopeMagic {
+		version = raw[1]
+		data = raw[2:]
+	}
+	current, migrations := getFormat(kind)
+	if version > current {
+		err = fmt.Errorf("%w: %s version %d is newer than %d", ErrVersion, kind, version, current)
+		return
+	}
+	for ; version < current; version++ {
+		m, ok := migrations[version]
+		if !ok {
+			err = fmt.Errorf("%w: %s has no migration from version %d", ErrVersion, kind, version)
+			return
+		}
+		if data, err = m(key, field, data, persister); err != nil {
+			return
+		}
+		upgraded = true
+	}
+	return
+}
+
+// Upgrade upgrades all the data of kind at key to the current version, and
+// writes them back. It stops at the first data incompatible.
+func Upgrade(kind, key string, persister Persister) error {
+	datas, err := persister.LoadAll(key)
+	if err != nil {
+		return err
+	}
+	for field, raw := range datas {
+		data, upgraded, err := Unwrap(kind, key, field, raw, persister)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", key, field, err)
+		}
+		if !upgraded {
+			continue
+		}
+		if err = persister.Save(key, field, Wrap(kind, data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpgradeSessions upgrades all the sessions stored at key, see Upgrade.
+func UpgradeSessions(key string, persister Persister) error {
+	if err := Upgrade(KindSession, key, persister); err != nil {
+		return err
+	}
+	metas, err := persister.LoadAll(key)
+	if err != nil {
+		return err
+	}
+	for clientId := range metas {
+		st := &sessionStore{key: key, clientId: clientId, p: persister}
+		for kind, entry := range map[string]string{
+			KindSessionOut: kindOut,
+			KindSessionIn:  kindIn,
+			KindSessionSub: kindSub,
+		} {
+			if err = Upgrade(kind, st.entryKey(entry), persister); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func identity(key, field string, data []byte, persister Persister) ([]byte, error) {
+	return data, nil
+}
+
+func init() {
+	for _, kind := range []string{KindSession, KindSessionOut, KindSessionIn, KindSessionSub} {
+		RegisterFormat(kind, 1)
+	}
+	RegisterFormat(KindRetain, 2)
+	//the write-ahead log came after the envelope, no version 0
+	RegisterFormat(KindWAL, 1)
+	RegisterFormat(KindDelayed, 1)
+
+	//version 0 of session is either the whole session in json, or the time
+	//saved written incrementally without envelope
+	RegisterMigration(KindSession, 0, func(key, clientId string, data []byte, persister Persister) ([]byte, error) {
+		if len(data) == 0 || data[0] != '{' {
+			return data, nil
+		}
+		s := new(Session)
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, err
+		}
+		s.MustInit()
+		st := &sessionStore{key: key, clientId: clientId, p: persister}
+		if err := st.saveEntries(s); err != nil {
+			return nil, err
+		}
+		return st.meta(), nil
+	})
+	RegisterMigration(KindSessionOut, 0, identity)
+	RegisterMigration(KindSessionIn, 0, identity)
+	RegisterMigration(KindSessionSub, 0, identity)
+
+	//version 0 of retain is the packet in json
+	RegisterMigration(KindRetain, 0, func(key, field string, data []byte, persister Persister) ([]byte, error) {
+		p := new(packet.PublishPacket)
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, err
+		}
+		return EncodePublish(*p)
+	})
+	//version 1 of retain is the packet in wire format, without the time stored
+	RegisterMigration(KindRetain, 1, func(key, field string, data []byte, persister Persister) ([]byte, error) {
+		return append(encodeTime(time.Now()), data...), nil
+	})
+}
@@ -0,0 +1,79 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"hilldan/mqtt/packet"
+)
+
+func TestUpgrade(t *testing.T) {
+	mp := NewMemPersist()
+	p := packet.PublishPacket{Qos: 1, Retain: true, TopicName: "a/b", ApplicationMessage: "on"}
+	data, _ := json.Marshal(p)
+	mp.Save("sr", "a/b", data)
+
+	if err := Upgrade(KindRetain, "sr", mp); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := mp.Read("sr", "a/b")
+	if raw[0] != envelopeMagic || raw[1] != 2 {
+		t.Fatalf("data should be written back in envelope: %v", raw)
+	}
+	data, upgraded, err := Unwrap(KindRetain, "sr", "a/b", raw, mp)
+	if err != nil || upgraded {
+		t.Fatalf("unwrap err: %v %v", upgraded, err)
+	}
+	if pp, stored, err := DecodeRetain(data); err != nil || pp != p || stored.IsZero() {
+		t.Errorf("want %v actual %v %v %v", p, pp, stored, err)
+	}
+
+	//newer than known
+	mp.Save("sr", "c", []byte{envelopeMagic, 9, 0})
+	if err = Upgrade(KindRetain, "sr", mp); !errors.Is(err, ErrVersion) {
+		t.Errorf("want ErrVersion actual %v", err)
+	}
+}
+
+func TestEncodeDelayed(t *testing.T) {
+	p := packet.PublishPacket{Qos: 1, TopicName: "a/b", ApplicationMessage: "on"}
+	due := time.Now().Add(time.Minute)
+	data, err := EncodeDelayed(p, due)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pp, at, err := DecodeDelayed(data); err != nil || pp != p || !at.Equal(due.Round(0)) {
+		t.Errorf("want %v %v actual %v %v %v", p, due, pp, at, err)
+	}
+	if _, _, err = DecodeDelayed(data[:7]); err != ErrCorrupt {
+		t.Errorf("want ErrCorrupt actual %v", err)
+	}
+}
+
+func TestRegisterMigration(t *testing.T) {
+	const kind = "test.kind"
+	t.Cleanup(func() {
+		formatsl.Lock()
+		delete(formats, kind)
+		formatsl.Unlock()
+	})
+	RegisterFormat(kind, 2)
+	RegisterMigration(kind, 0, func(key, field string, data []byte, p Persister) ([]byte, error) {
+		return append(data, '1'), nil
+	})
+	if _, _, err := Unwrap(kind, "k", "f", []byte("v"), nil); !errors.Is(err, ErrVersion) {
+		t.Errorf("want ErrVersion without migration actual %v", err)
+	}
+	RegisterMigration(kind, 1, func(key, field string, data []byte, p Persister) ([]byte, error) {
+		return append(data, '2'), nil
+	})
+	data, upgraded, err := Unwrap(kind, "k", "f", []byte("v"), nil)
+	if err != nil || !upgraded || string(data) != "v12" {
+		t.Errorf("want v12 actual %s %v %v", data, upgraded, err)
+	}
+	if data, _, _ = Unwrap(kind, "k", "f", Wrap(kind, []byte("x")), nil); string(data) != "x" {
+		t.Errorf("want x actual %s", data)
+	}
+}
@@ -0,0 +1,36 @@
+package mqtt
+
+import "strings"
+
+// MatchTopic reports whether topic is matched by the subscription filter,
+// with the wildcards '+' and '#', level by level without allocating. The
+// topics beginning with '$' are not matched by a first level wildcard.
+func MatchTopic(filter, topic string) bool {
+	if filter == "" || topic == "" || strings.ContainsAny(topic, "+#") {
+		return false
+	}
+	if (filter[0] == '+' || filter[0] == '#') && topic[0] == '$' {
+		return false
+	}
+	for {
+		f, frest, fmore := strings.Cut(filter, "/")
+		if f == "#" {
+			//the last level, including the parent level
+			return !fmore
+		}
+		if f != "+" && strings.ContainsAny(f, "+#") {
+			return false
+		}
+		t, trest, tmore := strings.Cut(topic, "/")
+		if f != "+" && f != t {
+			return false
+		}
+		switch {
+		case !fmore:
+			return !tmore
+		case !tmore:
+			return frest == "#"
+		}
+		filter, topic = frest, trest
+	}
+}
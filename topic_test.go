@@ -0,0 +1,41 @@
+package mqtt
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	var ts = []struct {
+		filter string
+		topic  string
+		result bool
+	}{
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+		{"sport/#", "sport", true},
+		{"#", "sport/tennis", true},
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+
+		{"#", "$SYS/monitor", false},
+		{"+/monitor/Clients", "$SYS/monitor/Clients", false},
+		{"$SYS/monitor/+", "$SYS/monitor/Clients", true},
+	}
+	for _, v := range ts {
+		if MatchTopic(v.filter, v.topic) != v.result {
+			t.Errorf("'%s' and '%s' should match %v", v.filter, v.topic, v.result)
+		}
+	}
+}
+
+func BenchmarkMatchTopic(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		MatchTopic("sport/tennis/+/score/#", "sport/tennis/player1/score/wimbledon")
+	}
+}